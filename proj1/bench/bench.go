@@ -0,0 +1,256 @@
+// Package bench runs the waves of requests of benchmark.go against
+// server.Run in the same process. The requests and responses go through
+// in-memory pipes, so the timings hold neither the compilation nor the start
+// of a twitter process, and no Go toolchain is needed to run them.
+package bench
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"proj1/server"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier is a problem size of the benchmarks
+type Tier struct {
+	Name  string
+	Posts int // Number of posts added by the first wave
+}
+
+// Tiers are the problem sizes of benchmark.go, from the smallest
+var Tiers = []Tier{
+	{"xsmall", 20},
+	{"small", 100},
+	{"medium", 10000},
+	{"large", 25000},
+	{"xlarge", 75000},
+}
+
+// LookupTier returns the tier with a name
+func LookupTier(name string) (Tier, error) {
+	names := make([]string, len(Tiers))
+	for i, tier := range Tiers {
+		if tier.Name == name {
+			return tier, nil
+		}
+		names[i] = tier.Name
+	}
+	return Tier{}, fmt.Errorf("unknown tier %q (available: %v)", name, strings.Join(names, ", "))
+}
+
+// Errors of a run whose responses do not match the requests
+var (
+	ErrMissingResponses = errors.New("the server stopped before answering every request")
+	ErrServerStopped    = errors.New("the server stopped before reading every request")
+)
+
+// Expected outcome of a request
+const (
+	anyOutcome = iota // CONTAINS racing with the ADDs of its wave
+	succeeds
+	fails
+	emptyFeed
+)
+
+// wave is a batch of requests sent at once, the next one is sent after every
+// response of the batch was received
+type wave struct {
+	frames   []byte // The encoded requests
+	first    int    // Id of the first request, the ids are consecutive
+	requests int
+}
+
+// Workload holds the encoded requests of a tier, it can be run any number
+// of times. The requests are sent in waves, then DONE:
+//  1. ADD every post in a random order, then CONTAINS every post
+//  2. REMOVE the even posts, from the most recent
+//  3. CONTAINS the even posts, which fail, and REMOVE the odd posts
+//  4. FEED, which is empty
+type Workload struct {
+	protocol server.Protocol
+	waves    []wave
+	expected []int // Outcome of each request by id
+	done     []byte
+}
+
+// request is a request of a wave and its expected outcome
+type request struct {
+	message  map[string]interface{}
+	expected int
+}
+
+func newRequest(command string, post int, expected int) request {
+	return request{map[string]interface{}{"command": command, "timestamp": float64(post)}, expected}
+}
+
+// NewWorkload encodes the waves of a number of posts, shuffled with a seed
+func NewWorkload(posts int, protocol server.Protocol, seed int64) (*Workload, error) {
+	if protocol == nil {
+		protocol = server.JSON
+	}
+	order := rand.New(rand.NewSource(seed)).Perm(posts)
+	var adds, reads, removeEvens, readEvens, removeOdds []request
+	for _, post := range order {
+		add := newRequest("ADD", post, succeeds)
+		add.message["body"] = strconv.Itoa(post)
+		adds = append(adds, add)
+		reads = append(reads, newRequest("CONTAINS", post, anyOutcome))
+	}
+	for post := posts - 1; post >= 0; post-- {
+		if post%2 == 0 {
+			removeEvens = append(removeEvens, newRequest("REMOVE", post, succeeds))
+			readEvens = append(readEvens, newRequest("CONTAINS", post, fails))
+		} else {
+			removeOdds = append(removeOdds, newRequest("REMOVE", post, succeeds))
+		}
+	}
+	feed := request{map[string]interface{}{"command": "FEED"}, emptyFeed}
+
+	workload := &Workload{protocol: protocol}
+	for _, requests := range [][]request{append(adds, reads...), removeEvens, append(readEvens, removeOdds...), {feed}} {
+		wave := wave{first: len(workload.expected), requests: len(requests)}
+		for _, request := range requests {
+			request.message["id"] = float64(len(workload.expected))
+			workload.expected = append(workload.expected, request.expected)
+			var err error
+			if wave.frames, err = protocol.AppendFrame(wave.frames, request.message); err != nil {
+				return nil, err
+			}
+		}
+		workload.waves = append(workload.waves, wave)
+	}
+	var err error
+	workload.done, err = protocol.AppendFrame(nil, map[string]interface{}{"command": "DONE"})
+	return workload, err
+}
+
+// Requests returns the number of requests of the workload, DONE excluded
+func (workload *Workload) Requests() int {
+	return len(workload.expected)
+}
+
+// Run serves the workload with a configuration and returns how long the
+// server took from its start until it stopped after the DONE. The Reader,
+// Writer, Decoder, Encoder and Protocol of the configuration are replaced by
+// the pipes of the run. Run returns an error if the server failed or a
+// response does not match its request.
+func Run(config server.Config, workload *Workload) (time.Duration, error) {
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	config.Reader, config.Decoder = requestReader, nil
+	config.Writer, config.Encoder = responseWriter, nil
+	config.Protocol = workload.protocol
+
+	// The checker reports every wave answered, then the end of the responses
+	checked := make(chan error, len(workload.waves)+1)
+	go workload.check(responseReader, checked)
+
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() {
+		err := server.Run(config)
+		requestReader.CloseWithError(ErrServerStopped)
+		responseWriter.CloseWithError(err)
+		stopped <- err
+	}()
+
+	var err error
+	for _, wave := range workload.waves {
+		if _, err = requestWriter.Write(wave.frames); err != nil {
+			break
+		}
+		if err = <-checked; err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = requestWriter.Write(workload.done)
+	}
+	requestWriter.CloseWithError(err)
+	if err != nil {
+		// Unblock the server if it is still answering
+		responseReader.CloseWithError(err)
+	}
+	serverErr := <-stopped
+	elapsed := time.Since(start)
+	if serverErr != nil {
+		return elapsed, serverErr
+	}
+	if err == nil {
+		err = <-checked
+	}
+	return elapsed, err
+}
+
+// check reads the responses and sends nil on results after each wave, or
+// the first mismatch. Once every wave is answered, it sends whether the
+// responses ended without another one.
+func (workload *Workload) check(responses io.Reader, results chan<- error) {
+	reader := bufio.NewReader(responses)
+	answered := make([]bool, len(workload.expected))
+	for _, wave := range workload.waves {
+		for received := 0; received < wave.requests; received++ {
+			message, err := workload.readResponse(reader)
+			if err == io.EOF {
+				err = ErrMissingResponses
+			}
+			if err == nil {
+				err = workload.verify(message, wave, answered)
+			}
+			if err != nil {
+				results <- err
+				return
+			}
+		}
+		results <- nil
+	}
+	message, err := workload.readResponse(reader)
+	switch {
+	case err == io.EOF:
+		results <- nil
+	case err != nil:
+		results <- err
+	default:
+		results <- fmt.Errorf("unexpected response %v after the last wave", message)
+	}
+}
+
+// readResponse returns the next response, io.EOF once there are none
+func (workload *Workload) readResponse(reader *bufio.Reader) (map[string]interface{}, error) {
+	for {
+		frame, err := workload.protocol.ReadFrame(reader)
+		if frame != nil {
+			return workload.protocol.Unmarshal(frame)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// verify checks a response against the expected outcome of its request
+func (workload *Workload) verify(response map[string]interface{}, wave wave, answered []bool) error {
+	number, _ := response["id"].(float64)
+	id := int(number)
+	if float64(id) != number || id < wave.first || id >= wave.first+wave.requests || answered[id] {
+		return fmt.Errorf("unexpected response %v, expected the ids %v to %v once", response, wave.first, wave.first+wave.requests-1)
+	}
+	answered[id] = true
+	success, _ := response["success"].(bool)
+	switch workload.expected[id] {
+	case succeeds, fails:
+		if success != (workload.expected[id] == succeeds) {
+			return fmt.Errorf("expected success %v for request %v, got %v", workload.expected[id] == succeeds, id, response)
+		}
+	case emptyFeed:
+		if feed, ok := response["feed"].([]interface{}); response["feed"] != nil && (!ok || len(feed) > 0) {
+			return fmt.Errorf("expected an empty feed, got %v", response)
+		}
+	}
+	return nil
+}
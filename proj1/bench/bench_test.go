@@ -0,0 +1,88 @@
+package bench
+
+import (
+	"fmt"
+	"proj1/server"
+	"testing"
+	"time"
+)
+
+// Versions of the benchmarks, the sequential one runs without consumers
+var versions = []string{"s", "p", "ws", "a", "pipeline"}
+
+// Numbers of consumers of the benchmarks of the parallel versions
+var consumerCounts = []int{1, 2, 4, 6, 8, 12}
+
+func TestRun(t *testing.T) {
+	for _, protocol := range []server.Protocol{server.JSON, server.Binary} {
+		workload, err := NewWorkload(100, protocol, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workload.Requests() != 100*2+50*3+1 {
+			t.Errorf("Expected 351 requests, got %v", workload.Requests())
+		}
+		for _, mode := range versions {
+			if _, err := Run(server.Config{Mode: mode, ConsumersCount: 4, FeedImpl: testFeed}, workload); err != nil {
+				t.Errorf("%v: %v", mode, err)
+			}
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	workload, _ := NewWorkload(20, nil, 1)
+	if _, err := Run(server.Config{FeedImpl: "unknown"}, workload); err == nil {
+		t.Errorf("Expected the error of the server")
+	}
+
+	// A workload expecting an ADD to fail
+	workload.expected[0] = fails
+	if _, err := Run(server.Config{}, workload); err == nil {
+		t.Errorf("Expected a mismatched response")
+	}
+}
+
+func TestLookupTier(t *testing.T) {
+	if tier, err := LookupTier("large"); err != nil || tier.Posts != 25000 {
+		t.Errorf("Expected the large tier, got %+v (%v)", tier, err)
+	}
+	if _, err := LookupTier("huge"); err == nil {
+		t.Errorf("Expected an error for an unknown tier")
+	}
+}
+
+// BenchmarkAllRequests runs every tier with every version and number of
+// consumers, e.g. go test -bench 'AllRequests/medium/p-4' ./bench
+func BenchmarkAllRequests(b *testing.B) {
+	for _, tier := range Tiers {
+		workload, err := NewWorkload(tier.Posts, nil, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, mode := range versions {
+			counts := consumerCounts
+			if mode == "s" {
+				counts = []int{0}
+			}
+			for _, consumers := range counts {
+				name := fmt.Sprintf("%v/%v-%v", tier.Name, mode, consumers)
+				if mode == "s" {
+					name = tier.Name + "/s"
+				}
+				config := server.Config{Mode: mode, ConsumersCount: consumers}
+				b.Run(name, func(b *testing.B) {
+					var total time.Duration
+					for i := 0; i < b.N; i++ {
+						elapsed, err := Run(config, workload)
+						if err != nil {
+							b.Fatal(err)
+						}
+						total += elapsed
+					}
+					b.ReportMetric(float64(workload.Requests()*b.N)/total.Seconds(), "requests/s")
+				})
+			}
+		}
+	}
+}
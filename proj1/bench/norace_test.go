@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package bench
+
+// testFeed is the feed of the tests, the default list feed when the race
+// detector is off (see race_test.go)
+const testFeed = ""
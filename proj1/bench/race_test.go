@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package bench
+
+// testFeed is the feed of the tests, the coarse feed under the race
+// detector, which reports the lock-free traversals of the list feed
+const testFeed = "coarse"
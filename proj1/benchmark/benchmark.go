@@ -9,18 +9,21 @@ import (
 	"os/exec"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-const usage = "Usage: benchmark version testSize threads\n" +
-	" version =  (p) - parallel version, (s) sequential version \n" +
+const usage = "Usage: benchmark version testSize threads [producers]\n" +
+	" version =  (p) - parallel version, (ws) - work stealing parallel version, (a) - adaptive parallel version, (pipeline) - pipeline version, (s) sequential version \n" +
 	" testSize = the test size \n" +
 	"\t xsmall = Run the extra small test size\n" +
 	"\t small = Run the small test size\n" +
 	"\t medium = Run the  medium test size\n" +
 	"\t large = Run the large test size\n" +
 	"\t xlarge = Run the extra large test size\n" +
-	" threads (required for  p version only) = the number of threads to pass to twitter.go\n"
+	" threads (required for  p, ws, a and pipeline versions only, the maximum for a) = the number of threads to pass to twitter.go\n" +
+	" producers (optional) = the number of goroutines decoding the input (default 1)\n" +
+	" The TWITTER_FLAGS environment variable holds extra flags of twitter.go, e.g. TWITTER_FLAGS=\"-queue-impl mutex\"\n"
 
 type _TestAddRequest struct {
 	Command   string  `json:"command"`
@@ -147,16 +150,19 @@ func getParity(numbers []int, parity int) []int {
 	sort.Sort(sort.Reverse(sort.IntSlice(parityNums)))
 	return parityNums
 }
-func runAllRequests(threads, version string, postInfo []int) {
+func runAllRequests(threads, producers, version string, postInfo []int) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
 	var cmd *exec.Cmd
 
-	if version == "p" {
-		cmd = exec.CommandContext(ctx, "go", "run", "proj1/twitter", threads)
+	// Extra flags such as the implementations to compare are passed through
+	// the TWITTER_FLAGS environment variable
+	args := append([]string{"run", "proj1/twitter"}, strings.Fields(os.Getenv("TWITTER_FLAGS"))...)
+	if version == "p" || version == "ws" || version == "a" || version == "pipeline" {
+		cmd = exec.CommandContext(ctx, "go", append(args, "-mode", version, "-producers", producers, threads)...)
 	} else {
-		cmd = exec.CommandContext(ctx, "go", "run", "proj1/twitter")
+		cmd = exec.CommandContext(ctx, "go", args...)
 	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -379,10 +385,10 @@ func runAllRequests(threads, version string, postInfo []int) {
 // 4. Sends Remove requests by removing only the odd ids
 // 5. Checks to make sure the evens are still there and all the odds are gone by sending contains requests
 // 6. Sends a Done request and waits for the server to exit.
-func AllRequestsXtraSmall(threads string, version string) {
+func AllRequestsXtraSmall(threads, producers, version string) {
 	posts := generateSlice(20)
 	rand.Shuffle(len(posts), func(i, j int) { posts[i], posts[j] = posts[j], posts[i] })
-	runAllRequests(threads, version, posts)
+	runAllRequests(threads, producers, version, posts)
 }
 
 // AllRequestsSmall
@@ -394,10 +400,10 @@ func AllRequestsXtraSmall(threads string, version string) {
 // 4. Sends Remove requests by removing only the odd ids
 // 5. Checks to make sure the evens are still there and all the odds are gone by sending contains requests
 // 6. Sends a Done request and waits for the server to exit.
-func AllRequestsSmall(threads string, version string) {
+func AllRequestsSmall(threads, producers, version string) {
 	posts := generateSlice(100)
 	rand.Shuffle(len(posts), func(i, j int) { posts[i], posts[j] = posts[j], posts[i] })
-	runAllRequests(threads,version, posts)
+	runAllRequests(threads, producers, version, posts)
 }
 
 // AllRequestsMedium
@@ -409,10 +415,10 @@ func AllRequestsSmall(threads string, version string) {
 // 4. Sends Remove requests by removing only the odd ids
 // 5. Checks to make sure the evens are still there and all the odds are gone by sending contains requests
 // 6. Sends a Done request and waits for the server to exit.
-func AllRequestsMedium(threads string, version string) {
+func AllRequestsMedium(threads, producers, version string) {
 	posts := generateSlice(10000)
 	rand.Shuffle(len(posts), func(i, j int) { posts[i], posts[j] = posts[j], posts[i] })
-	runAllRequests(threads, version, posts)
+	runAllRequests(threads, producers, version, posts)
 }
 
 // AllRequestsLarge
@@ -424,10 +430,10 @@ func AllRequestsMedium(threads string, version string) {
 // 4. Sends Remove requests by removing only the odd ids
 // 5. Checks to make sure the evens are still there and all the odds are gone by sending contains requests
 // 6. Sends a Done request and waits for the server to exit.
-func AllRequestsLarge(threads string, version string) {
+func AllRequestsLarge(threads, producers, version string) {
 	posts := generateSlice(25000)
 	rand.Shuffle(len(posts), func(i, j int) { posts[i], posts[j] = posts[j], posts[i] })
-	runAllRequests(threads, version, posts)
+	runAllRequests(threads, producers, version, posts)
 }
 
 // AllRequestsXtraLarge
@@ -439,10 +445,10 @@ func AllRequestsLarge(threads string, version string) {
 // 4. Sends Remove requests by removing only the odd ids
 // 5. Checks to make sure the evens are still there and all the odds are gone by sending contains requests
 // 6. Sends a Done request and waits for the server to exit.
-func AllRequestsXtraLarge(threads string, version string) {
+func AllRequestsXtraLarge(threads, producers, version string) {
 	posts := generateSlice(75000)
 	rand.Shuffle(len(posts), func(i, j int) { posts[i], posts[j] = posts[j], posts[i] })
-	runAllRequests(threads, version, posts)
+	runAllRequests(threads, producers, version, posts)
 }
 
 func main() {
@@ -453,22 +459,26 @@ func main() {
 		version := os.Args[1]
 		test := os.Args[2]
 		var threads string
-		if version == "p" {
+		producers := "1"
+		if version == "p" || version == "ws" || version == "a" || version == "pipeline" {
 			threads = os.Args[3]
+			if len(os.Args) > 4 {
+				producers = os.Args[4]
+			}
 		}
 
 		start := time.Now()
 
 		if test == "xsmall" {
-			AllRequestsXtraSmall(threads,  version)
+			AllRequestsXtraSmall(threads, producers, version)
 		} else if test == "small" {
-			AllRequestsSmall(threads, version)
+			AllRequestsSmall(threads, producers, version)
 		} else if test == "medium" {
-			AllRequestsMedium(threads,  version)
+			AllRequestsMedium(threads, producers, version)
 		} else if test == "large" {
-			AllRequestsLarge(threads,  version)
+			AllRequestsLarge(threads, producers, version)
 		} else if test == "xlarge" {
-			AllRequestsXtraLarge(threads, version)
+			AllRequestsXtraLarge(threads, producers, version)
 		} else {
 			fmt.Printf("Invalid argument:%v", test)
 			fmt.Println(usage)
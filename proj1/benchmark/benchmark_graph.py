@@ -28,7 +28,7 @@ def get_sequential_times(problem_sizes, average_over, run_command):
         print('--------------------------------')
     return sequential_times
 
-def get_parallel_times(problem_sizes, thread_nums, average_over, run_command):
+def get_parallel_times(problem_sizes, thread_nums, average_over, run_command, mode='p'):
     '''
     Get the parallel runtimes for the benchmark graphs
     Args:
@@ -36,11 +36,11 @@ def get_parallel_times(problem_sizes, thread_nums, average_over, run_command):
         thread_nums: The number of threads to run the benchmark with.
         average_over: The number of times to run the benchmark and average timings over.
         run_command: The command to run the benchmark with.
+        mode: The parallel version to run, 'p' (fixed consumers) or 'a' (adaptive consumers, thread_num is the maximum).
     Returns:
         A dictionary of the parallel runtimes for each benchmark graph.
     '''
     encoding = 'utf-8'
-    mode = 'p'
     parallel_times = {problem_size: {str(thread_num): 0 for thread_num in thread_nums} for problem_size in problem_sizes}
     print('Running parallel benchmarks...')
     print('--------------------------------')
@@ -85,23 +85,26 @@ def get_speedups(sequential_times, parallel_times):
             speedups[problem_size][thread_num] = get_speedup(sequential_times[problem_size], parallel_times[problem_size][thread_num])
     return speedups
 
-def plot_speedups(num_threads, speedups):
+def plot_speedups(num_threads, speedups, title='Twitter Feed Speedup Graph', filename='speedup.png'):
     '''
     Plot the speedups for each benchmark.
     Args:
         num_threads: The number of threads used for the parallel runs.
         speedups: The speedups for each benchmark graph.
+        title: The title of the graph.
+        filename: The file to save the graph to.
     '''
+    plt.figure()
     for problem_size in speedups:
         plt.plot(num_threads, list(speedups[problem_size].values()), label=problem_size)
 
     plt.xlabel('Number of threads')
     plt.ylabel('Speedup')
-    plt.title('Twitter Feed Speedup Graph')
+    plt.title(title)
     plt.legend(loc='best')
     plt.tight_layout()
     plt.grid()
-    plt.savefig('speedup.png')
+    plt.savefig(filename)
 
 if __name__ == '__main__':
     # The different problem sizes to benchmark.
@@ -139,5 +142,14 @@ if __name__ == '__main__':
     # Plot the speedups.
     print('Plotting speedups...')
     plot_speedups(num_threads=thread_nums, speedups=speedups)
+
+    # Get the adaptive runtimes, where the number of threads is the maximum number of consumers.
+    adaptive_times = get_parallel_times(problem_sizes=problem_sizes, thread_nums=thread_nums, average_over=average_over, run_command=run_command, mode='a')
+    print(f'Adaptive times: {adaptive_times}\n')
+
+    # Get and plot the adaptive speedups.
+    adaptive_speedups = get_speedups(sequential_times=sequential_times, parallel_times=adaptive_times)
+    print(f'Adaptive speedups: {adaptive_speedups}\n')
+    plot_speedups(num_threads=thread_nums, speedups=adaptive_speedups, title='Twitter Feed Adaptive Speedup Graph (threads = max consumers)', filename='speedup_adaptive.png')
     print('Done!')
 
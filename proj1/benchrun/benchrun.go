@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	parser "flag"
+	"fmt"
+	"os"
+	"proj1/bench"
+	"proj1/server"
+	"strconv"
+	"strings"
+)
+
+func Usage() {
+	fmt.Println("Usage: benchrun [flags] \n Runs the waves of benchmark.go against the server in this process, through in-memory pipes instead of a go run subprocess, for every tier, version and number of consumers. \n Each run is printed to stdout as a JSON object on its own line.\nFlags:")
+	parser.CommandLine.SetOutput(os.Stdout)
+	parser.PrintDefaults()
+}
+
+// result is the timing of a run, the seconds are what benchmark.go prints
+type result struct {
+	Tier       string  `json:"tier"`
+	Posts      int     `json:"posts"`
+	Requests   int     `json:"requests"` // DONE excluded
+	Mode       string  `json:"mode"`
+	Consumers  int     `json:"consumers"` // 0 for the sequential version
+	Producers  int     `json:"producers"`
+	Protocol   string  `json:"protocol"`
+	Run        int     `json:"run"` // Repetition of the same benchmark, from 1
+	Seconds    float64 `json:"seconds"`
+	Throughput float64 `json:"requests_per_second"`
+}
+
+func main() {
+	tierList := parser.String("tiers", "xsmall,small,medium,large,xlarge", "problem sizes to run (xsmall, small, medium, large, xlarge)")
+	modeList := parser.String("modes", "s,p", "versions to run: s, p, ws, a and pipeline")
+	consumersList := parser.String("consumers", "2,4,6,8,12", "numbers of consumers of the parallel versions, the maximum for a")
+	producers := parser.Int("producers", 1, "number of goroutines decoding the input")
+	runs := parser.Int("runs", 1, "number of times each benchmark is run")
+	protocolName := parser.String("protocol", "json", "protocol of the requests and responses: json or binary")
+	feedImpl := parser.String("feed-impl", "", "implementation of the feed (default list)")
+	queueImpl := parser.String("queue-impl", "", "implementation of the task queue of the p and a versions (default lockfree)")
+	lockImpl := parser.String("lock-impl", "", "implementation of the locks of the feed (default rwlock)")
+	seed := parser.Int64("seed", 1, "seed of the order the posts are added in")
+	parser.Usage = Usage
+	parser.Parse()
+	if len(parser.Args()) > 0 || *runs < 1 || *producers < 1 {
+		Usage()
+		return
+	}
+
+	protocol, err := server.LookupProtocol(*protocolName)
+	var tiers []bench.Tier
+	var consumers []int
+	modes := strings.Split(*modeList, ",")
+	for _, name := range strings.Split(*tierList, ",") {
+		if err == nil {
+			var tier bench.Tier
+			tier, err = bench.LookupTier(strings.TrimSpace(name))
+			tiers = append(tiers, tier)
+		}
+	}
+	for i, mode := range modes {
+		modes[i] = strings.TrimSpace(mode)
+		switch modes[i] {
+		case "s", "p", "ws", "a", "pipeline":
+		default:
+			if err == nil {
+				err = fmt.Errorf("unknown mode %q", mode)
+			}
+		}
+	}
+	for _, item := range strings.Split(*consumersList, ",") {
+		count, countErr := strconv.Atoi(strings.TrimSpace(item))
+		if err == nil && (countErr != nil || count < 1) {
+			err = fmt.Errorf("invalid number of consumers %q", item)
+		}
+		consumers = append(consumers, count)
+	}
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, tier := range tiers {
+		workload, err := bench.NewWorkload(tier.Posts, protocol, *seed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+		for _, mode := range modes {
+			counts := consumers
+			if mode == "s" {
+				counts = []int{0}
+			}
+			for _, count := range counts {
+				config := server.Config{
+					Mode:           mode,
+					ConsumersCount: count,
+					ProducersCount: *producers,
+					FeedImpl:       *feedImpl,
+					QueueImpl:      *queueImpl,
+					LockImpl:       *lockImpl,
+				}
+				for run := 1; run <= *runs; run++ {
+					elapsed, err := bench.Run(config, workload)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %v %v with %v consumers: %v\n", tier.Name, mode, count, err)
+						os.Exit(1)
+					}
+					encoder.Encode(result{
+						Tier:       tier.Name,
+						Posts:      tier.Posts,
+						Requests:   workload.Requests(),
+						Mode:       mode,
+						Consumers:  count,
+						Producers:  *producers,
+						Protocol:   *protocolName,
+						Run:        run,
+						Seconds:    elapsed.Seconds(),
+						Throughput: float64(workload.Requests()) / elapsed.Seconds(),
+					})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Package client talks to a twitter server over its standard input and
+// output or over a TCP connection. Requests are pipelined: each method sends
+// its request without waiting for the previous responses and returns a
+// Future, which is resolved when the response with the id of the request
+// comes back, in whatever order the server answers.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"proj1/server"
+	"sync"
+)
+
+// Errors of the futures that cannot get a response
+var (
+	ErrClosed         = errors.New("client: closed")
+	ErrConnectionLost = errors.New("client: the server closed the connection before answering")
+)
+
+// Client sends requests to a server and matches the responses to them. Its
+// methods can be called concurrently.
+type Client struct {
+	protocol  server.Protocol
+	output    *bufio.Writer
+	frames    chan []byte  // Encoded requests waiting to be written
+	sendMutex sync.RWMutex // Held for reading while a request is sent, guards closed
+	closed    bool
+	written   chan struct{} // Closed once every request was written
+	stopped   chan struct{} // Closed once the responses stopped
+	mutex     sync.Mutex    // Guards the fields below
+	nextID    float64
+	pending   map[float64]*Future // Requests waiting for their response, by id
+	lost      error               // Why the responses stopped (nil = still reading)
+	writeErr  error               // First error writing the requests
+	// Called once every request was written, and once the responses
+	// stopped (nil = nothing to do)
+	closeInput func() error
+	finish     func() error
+}
+
+// New creates a client sending requests to w and reading their responses from
+// r, e.g. the standard input and output of a server. A nil protocol is JSON.
+// If w is an io.Closer, Close closes it after the DONE command.
+func New(r io.Reader, w io.Writer, protocol server.Protocol) *Client {
+	if protocol == nil {
+		protocol = server.JSON
+	}
+	client := &Client{
+		protocol: protocol,
+		output:   bufio.NewWriter(w),
+		frames:   make(chan []byte, 1024),
+		written:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		pending:  make(map[float64]*Future),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		client.closeInput = closer.Close
+	}
+	go client.write()
+	go client.read(protocol.NewDecoder(bufio.NewReader(r)))
+	return client
+}
+
+// Dial connects to a server started with -listen
+func Dial(address string, protocol server.Protocol) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// The server closes the connection once the DONE command is answered
+	client := New(conn, writerOnly{conn}, protocol)
+	client.finish = conn.Close
+	return client, nil
+}
+
+// Exec starts a server process and talks to it over its standard input and
+// output. Close waits for the process to exit and returns its error.
+func Exec(cmd *exec.Cmd, protocol server.Protocol) (*Client, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	client := New(stdout, stdin, protocol)
+	client.finish = cmd.Wait
+	return client, nil
+}
+
+// Add posts a body with a timestamp, the response reports whether it was
+// added
+func (client *Client) Add(body string, timestamp float64) *Future {
+	return client.Do(context.Background(), server.Request{Command: "ADD", Body: body, Timestamp: timestamp})
+}
+
+// Remove removes the post with a timestamp, the response reports whether it
+// was in the feed
+func (client *Client) Remove(timestamp float64) *Future {
+	return client.Do(context.Background(), server.Request{Command: "REMOVE", Timestamp: timestamp})
+}
+
+// Contains checks whether the feed has a post with a timestamp
+func (client *Client) Contains(timestamp float64) *Future {
+	return client.Do(context.Background(), server.Request{Command: "CONTAINS", Timestamp: timestamp})
+}
+
+// Feed requests every post, the most recent first
+func (client *Client) Feed() *Future {
+	return client.Do(context.Background(), server.Request{Command: "FEED"})
+}
+
+// Do sends any request. The deadline of ctx is sent as the deadline of the
+// request, the server answers with a TIMEOUT error once it passed.
+func (client *Client) Do(ctx context.Context, request server.Request) *Future {
+	future := newFuture()
+	message, err := request.Message(ctx)
+	if err != nil {
+		future.resolve(server.Response{}, err)
+		return future
+	}
+	client.sendMutex.RLock()
+	defer client.sendMutex.RUnlock()
+	if client.closed {
+		future.resolve(server.Response{}, ErrClosed)
+		return future
+	}
+	// The future is registered first, the response can come back before the
+	// request is queued
+	client.mutex.Lock()
+	if client.lost != nil {
+		client.mutex.Unlock()
+		future.resolve(server.Response{}, client.lost)
+		return future
+	}
+	client.nextID++
+	id := client.nextID
+	client.pending[id] = future
+	future.id = id
+	client.mutex.Unlock()
+	message["id"] = id
+	frame, err := client.protocol.AppendFrame(nil, message)
+	if err != nil {
+		client.complete(id, server.Response{}, err)
+		return future
+	}
+	client.frames <- frame
+	return future
+}
+
+// Close sends the DONE command, waits until every request is answered and the
+// server closed the connection, and returns the first error of the
+// connection. The requests sent after Close fail with ErrClosed.
+func (client *Client) Close() error {
+	client.sendMutex.Lock()
+	if !client.closed {
+		client.closed = true
+		if frame, err := client.protocol.AppendFrame(nil, map[string]interface{}{"command": "DONE"}); err == nil {
+			client.frames <- frame
+		}
+		close(client.frames)
+	}
+	client.sendMutex.Unlock()
+	<-client.written
+	<-client.stopped
+
+	client.mutex.Lock()
+	// The requests that were not answered report it themselves
+	err := client.writeErr
+	if client.lost != ErrConnectionLost && err == nil {
+		err = client.lost
+	}
+	finish := client.finish
+	client.finish = nil
+	client.mutex.Unlock()
+	if finish != nil {
+		if finishErr := finish(); err == nil {
+			err = finishErr
+		}
+	}
+	return err
+}
+
+// write writes the requests in batches: the buffer is flushed whenever no
+// other request is waiting
+func (client *Client) write() {
+	defer close(client.written)
+	for frame := range client.frames {
+		if _, err := client.output.Write(frame); err != nil {
+			client.failWrite(err)
+			continue
+		}
+		if len(client.frames) == 0 {
+			if err := client.output.Flush(); err != nil {
+				client.failWrite(err)
+			}
+		}
+	}
+	if err := client.output.Flush(); err != nil {
+		client.failWrite(err)
+	}
+	if client.closeInput != nil {
+		if err := client.closeInput(); err != nil {
+			client.failWrite(err)
+		}
+	}
+}
+
+// failWrite records the first write error, the requests still queued are
+// discarded and fail once the server closes the connection
+func (client *Client) failWrite(err error) {
+	client.mutex.Lock()
+	if client.writeErr == nil {
+		client.writeErr = err
+	}
+	client.mutex.Unlock()
+}
+
+// read resolves the future of each response until the connection is closed
+func (client *Client) read(decoder server.Decoder) {
+	defer close(client.stopped)
+	for {
+		var message map[string]interface{}
+		if err := decoder.Decode(&message); err != nil {
+			client.stop(err)
+			return
+		}
+		id, ok := message["id"].(float64)
+		if !ok {
+			continue
+		}
+		response, err := server.ResponseOf(message)
+		client.complete(id, response, err)
+	}
+}
+
+// complete resolves the future of a request
+func (client *Client) complete(id float64, response server.Response, err error) {
+	client.mutex.Lock()
+	future := client.pending[id]
+	delete(client.pending, id)
+	client.mutex.Unlock()
+	if future != nil {
+		future.resolve(response, err)
+	}
+}
+
+// stop fails the requests that will not be answered once the connection is
+// closed
+func (client *Client) stop(err error) {
+	if err == io.EOF {
+		err = ErrConnectionLost
+	}
+	client.mutex.Lock()
+	client.lost = err
+	pending := client.pending
+	client.pending = make(map[float64]*Future)
+	client.mutex.Unlock()
+	for _, future := range pending {
+		future.resolve(server.Response{}, err)
+	}
+}
+
+// writerOnly hides the Close method of a connection, which must stay open
+// for the responses after the requests were written
+type writerOnly struct {
+	io.Writer
+}
+
+// Future is the response to a request that may not have arrived yet
+type Future struct {
+	id        float64       // Id the request was sent with (0 = not sent)
+	done      chan struct{} // Closed once the response arrived
+	response  server.Response
+	err       error
+	mutex     sync.Mutex // Guards the fields below
+	resolved  bool
+	callbacks []func(server.Response, error)
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// ID returns the id the request was sent with, 0 if it was not sent
+func (future *Future) ID() float64 {
+	return future.id
+}
+
+// Done returns a channel closed once the response arrived
+func (future *Future) Done() <-chan struct{} {
+	return future.done
+}
+
+// Wait waits for the response. The error is a *server.ResponseError if the
+// server answered with an error code, or an error of the connection.
+func (future *Future) Wait() (server.Response, error) {
+	<-future.done
+	return future.response, future.err
+}
+
+// Success waits for the result of an ADD, REMOVE or CONTAINS
+func (future *Future) Success() (bool, error) {
+	response, err := future.Wait()
+	return response.Success, err
+}
+
+// Posts waits for the posts of a FEED
+func (future *Future) Posts() ([]server.Post, error) {
+	response, err := future.Wait()
+	return response.Feed, err
+}
+
+// Then calls callback with the response once it arrives, right away if it
+// already did. The callbacks run on the goroutine reading the responses, so
+// they must not wait for other responses.
+func (future *Future) Then(callback func(server.Response, error)) {
+	future.mutex.Lock()
+	if !future.resolved {
+		future.callbacks = append(future.callbacks, callback)
+		future.mutex.Unlock()
+		return
+	}
+	future.mutex.Unlock()
+	callback(future.response, future.err)
+}
+
+// resolve sets the response and runs the callbacks
+func (future *Future) resolve(response server.Response, err error) {
+	future.mutex.Lock()
+	future.response, future.err = response, err
+	future.resolved = true
+	callbacks := future.callbacks
+	future.callbacks = nil
+	close(future.done)
+	future.mutex.Unlock()
+	for _, callback := range callbacks {
+		callback(response, err)
+	}
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"proj1/server"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeServer runs a server reading the requests of a client from pipes
+func pipeServer(t *testing.T, config server.Config) (*Client, chan error) {
+	requests, requestWriter := io.Pipe()
+	responses, responseWriter := io.Pipe()
+	config.Reader, config.Writer = requests, responseWriter
+	result := make(chan error, 1)
+	go func() {
+		err := server.Run(config)
+		responseWriter.Close()
+		result <- err
+	}()
+	return New(responses, requestWriter, config.Protocol), result
+}
+
+func TestClientPipelining(t *testing.T) {
+	for _, protocol := range []server.Protocol{server.JSON, server.Binary} {
+		client, result := pipeServer(t, server.Config{Mode: "p", ConsumersCount: 4, Protocol: protocol})
+		// Every request is sent before the first response is awaited
+		posts := 1000
+		adds := make([]*Future, posts)
+		for i := range adds {
+			adds[i] = client.Add("post", float64(i))
+		}
+		for i, add := range adds {
+			if ok, err := add.Success(); !ok || err != nil {
+				t.Fatalf("Expected post %v to be added, got %v (%v)", i, ok, err)
+			}
+		}
+		feed, err := client.Feed().Posts()
+		if err != nil || len(feed) != posts || feed[0] != (server.Post{Body: "post", Timestamp: float64(posts - 1)}) {
+			t.Fatalf("Expected %v posts, got %v (%v)", posts, len(feed), err)
+		}
+
+		var tests = []struct {
+			future   *Future
+			expected bool
+		}{
+			{client.Contains(1), true},
+			{client.Remove(1), true},
+			{client.Remove(1), false},
+			{client.Contains(1), false},
+			{client.Contains(float64(posts)), false},
+		}
+		for i, test := range tests {
+			if ok, err := test.future.Success(); ok != test.expected || err != nil {
+				t.Errorf("Test %v: expected %v, got %v (%v)", i, test.expected, ok, err)
+			}
+		}
+
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Add("late", 0).Wait(); err != ErrClosed {
+			t.Errorf("Expected the client to be closed, got %v", err)
+		}
+	}
+}
+
+func TestClientCallbacks(t *testing.T) {
+	client, result := pipeServer(t, server.Config{Mode: "s"})
+	var group sync.WaitGroup
+	answered := make([]bool, 100)
+	for i := range answered {
+		group.Add(1)
+		i := i
+		client.Add("post", float64(i)).Then(func(response server.Response, err error) {
+			answered[i] = response.Success && err == nil
+			group.Done()
+		})
+	}
+	group.Wait()
+	for i, ok := range answered {
+		if !ok {
+			t.Errorf("Expected post %v to be added", i)
+		}
+	}
+	// The callback of a resolved future runs right away
+	future := client.Contains(0)
+	future.Wait()
+	called := false
+	future.Then(func(response server.Response, err error) { called = response.Success })
+	if !called {
+		t.Errorf("Expected the callback to run")
+	}
+
+	// Error codes are returned as errors
+	_, err := client.Do(context.Background(), server.Request{Command: "ADD", Body: "late", Timestamp: 1000, Timeout: time.Nanosecond}).Wait()
+	if responseErr, ok := err.(*server.ResponseError); !ok || responseErr.Code != server.ErrorTimeout {
+		t.Errorf("Expected a TIMEOUT, got %v", err)
+	}
+	if _, err := client.Do(context.Background(), server.Request{Command: "LIKE"}).Wait(); err != server.ErrInvalidRequest {
+		t.Errorf("Expected an invalid request, got %v", err)
+	}
+	client.Close()
+	<-result
+}
+
+func TestClientDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Serve(server.Config{Mode: "p", ConsumersCount: 4, Protocol: server.Binary, Shutdown: signals}, listener)
+	}()
+
+	// The clients use the same ids, their responses are not mixed up
+	clients, posts := 4, 100
+	var group sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		group.Add(1)
+		go func(c int) {
+			defer group.Done()
+			client, err := Dial(listener.Addr().String(), server.Binary)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			contains := make([]*Future, posts)
+			for i := range contains {
+				client.Add("post", float64(c*posts+i))
+				contains[i] = client.Contains(float64(c*posts + i))
+			}
+			for i, future := range contains {
+				if ok, err := future.Success(); !ok || err != nil {
+					t.Errorf("Client %v: expected post %v, got %v (%v)", c, i, ok, err)
+				}
+			}
+			if err := client.Close(); err != nil {
+				t.Errorf("Client %v: %v", c, err)
+			}
+		}(c)
+	}
+	group.Wait()
+	signals <- os.Interrupt
+	if err := <-result; err != server.ErrInterrupted {
+		t.Errorf("Expected %v, got %v", server.ErrInterrupted, err)
+	}
+}
+
+func TestClientConnectionLost(t *testing.T) {
+	// A server that never answers
+	requests, requestWriter := io.Pipe()
+	responses, responseWriter := io.Pipe()
+	go io.Copy(io.Discard, requests)
+	client := New(responses, requestWriter, nil)
+	future := client.Feed()
+	responseWriter.Close()
+	if _, err := future.Wait(); err != ErrConnectionLost {
+		t.Errorf("Expected the connection to be lost, got %v", err)
+	}
+	if _, err := client.Feed().Wait(); err != ErrConnectionLost {
+		t.Errorf("Expected the connection to be lost, got %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Expected the unanswered requests to report the error, got %v", err)
+	}
+}
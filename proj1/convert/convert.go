@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	parser "flag"
+	"fmt"
+	"io"
+	"os"
+	"proj1/wire"
+)
+
+func Usage() {
+	fmt.Println("Usage: convert [-decode] [<input file> [<output file>]] \n Converts newline-delimited JSON tasks to the binary protocol of twitter.go, or back with -decode. \n The input and output default to stdin and stdout.")
+}
+
+func main() {
+	decode := parser.Bool("decode", false, "convert binary frames (e.g. the responses of twitter.go -protocol binary) to newline-delimited JSON")
+	parser.Usage = Usage
+	parser.Parse()
+	args := parser.Args()
+	if len(args) > 2 {
+		Usage()
+		return
+	}
+
+	var input io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+	output := os.Stdout
+	if len(args) > 1 && args[1] != "-" {
+		file, err := os.Create(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+		output = file
+	}
+
+	writer := bufio.NewWriter(output)
+	var err error
+	if *decode {
+		err = convert(wire.NewDecoder(input), json.NewEncoder(writer))
+	} else {
+		err = convert(json.NewDecoder(input), wire.NewEncoder(writer))
+	}
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
+
+// decoder reads messages, a *json.Decoder or a *wire.Decoder
+type decoder interface {
+	Decode(v interface{}) error
+}
+
+// encoder writes messages, a *json.Encoder or a *wire.Encoder
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+// convert copies every message of the input to the output
+func convert(input decoder, output encoder) error {
+	for {
+		var message map[string]interface{}
+		if err := input.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := output.Encode(&message); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package feed
+
+import (
+	"proj1/lock"
+	"sort"
+	"time"
+)
+
+// coarseFeed is a feed kept in a slice ordered by decreasing timestamp and
+// guarded by a single lock, the coarse-grained baseline of the list feed
+type coarseFeed struct {
+	lock  lock.Locker
+	posts []post // Only the body and timestamp of each post are used
+}
+
+// NewCoarseFeed creates an empty feed guarded by a single lock from newLock
+func NewCoarseFeed(newLock lock.Constructor) Feed {
+	return &coarseFeed{lock: newLock()}
+}
+
+// find returns the index of the first post that is not more recent than the
+// timestamp, the caller holds the lock
+func (f *coarseFeed) find(timestamp float64) int {
+	return sort.Search(len(f.posts), func(i int) bool {
+		return f.posts[i].timestamp <= timestamp
+	})
+}
+
+// Add inserts a post at its place in the feed, or replaces the body of the
+// post with the same timestamp
+func (f *coarseFeed) Add(body string, timestamp float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	i := f.find(timestamp)
+	if i < len(f.posts) && f.posts[i].timestamp == timestamp {
+		f.posts[i].body = body
+		return
+	}
+	f.posts = append(f.posts, post{})
+	copy(f.posts[i+1:], f.posts[i:])
+	f.posts[i] = post{body: body, timestamp: timestamp}
+}
+
+// Remove deletes the post with the given timestamp and returns whether it
+// was in the feed
+func (f *coarseFeed) Remove(timestamp float64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	i := f.find(timestamp)
+	if i == len(f.posts) || f.posts[i].timestamp != timestamp {
+		return false
+	}
+	f.posts = append(f.posts[:i], f.posts[i+1:]...)
+	return true
+}
+
+// Contains returns whether a post with the given timestamp is in the feed
+func (f *coarseFeed) Contains(timestamp float64) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	i := f.find(timestamp)
+	return i < len(f.posts) && f.posts[i].timestamp == timestamp
+}
+
+// Show displays the entire feed
+func (f *coarseFeed) Show() []interface{} {
+	displayFeed, _ := f.ShowUntil(time.Time{})
+	return displayFeed
+}
+
+// ShowUntil displays the entire feed like Show but gives up once the deadline
+// has passed, in which case it returns false. A zero deadline never expires.
+func (f *coarseFeed) ShowUntil(deadline time.Time) ([]interface{}, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	// An empty feed is shown as an empty list like the list feed does
+	displayFeed := make([]interface{}, 0, len(f.posts))
+	for i, post := range f.posts {
+		// Check the deadline every few posts, the clock is too slow to read for every post
+		if !deadline.IsZero() && i%showCheckInterval == 0 && !time.Now().Before(deadline) {
+			return nil, false
+		}
+		displayFeed = append(displayFeed, map[string]interface{}{"body": post.body, "timestamp": post.timestamp})
+	}
+	return displayFeed, true
+}
@@ -3,6 +3,7 @@ package feed
 import (
 	"math"
 	"proj1/lock"
+	"time"
 )
 
 // Feed represents a user's twitter feed
@@ -12,6 +13,7 @@ type Feed interface {
 	Remove(timestamp float64) bool
 	Contains(timestamp float64) bool
 	Show() []interface{}
+	ShowUntil(deadline time.Time) ([]interface{}, bool)
 }
 
 // feed is the internal representation of a user's twitter feed (hidden from outside packages)
@@ -20,7 +22,9 @@ type Feed interface {
 type feed struct {
 	head *post // a pointer to the beginning post
 	tail *post // a pointer to the last post
-	lock *lock.RWLock
+	lock lock.Locker
+	// creates the lock of every post
+	newLock lock.Constructor
 }
 
 // post is the internal representation of a post on a user's twitter feed (hidden from outside packages)
@@ -31,22 +35,25 @@ type post struct {
 	timestamp float64 // Unix timestamp of the post
 	removed   bool    // used to determine if a post has been removed
 	next      *post   // the next post in the feed
-	lock      *lock.RWLock
+	lock      lock.Locker
 }
 
 // NewPost creates and returns a new post value given its body and timestamp
-func newPost(body string, timestamp float64, next *post) *post {
-	rwLock := lock.NewRWLock()
+func newPost(body string, timestamp float64, next *post, rwLock lock.Locker) *post {
 	return &post{body: body, timestamp: timestamp, next: next, removed: false, lock: rwLock}
 }
 
 // NewFeed creates a empy user feed
 func NewFeed() Feed {
-	head := newPost("", math.MaxFloat64, nil)
-	tail := newPost("", -math.MaxFloat64, nil)
+	return NewListFeed(func() lock.Locker { return lock.NewRWLock() })
+}
+
+// NewListFeed creates an empty user feed whose locks are created by newLock
+func NewListFeed(newLock lock.Constructor) Feed {
+	head := newPost("", math.MaxFloat64, nil, newLock())
+	tail := newPost("", -math.MaxFloat64, nil, newLock())
 	head.next = tail
-	rwLock := lock.NewRWLock()
-	return &feed{head, tail, rwLock}
+	return &feed{head, tail, newLock(), newLock}
 }
 
 // Add inserts a new post to the feed. The feed is always ordered by the timestamp where
@@ -79,7 +86,7 @@ func (f *feed) Add(body string, timestamp float64) {
 				return
 			} else {
 				// We have found the place to insert the new post
-				newPost := newPost(body, timestamp, curr)
+				newPost := newPost(body, timestamp, curr, f.newLock())
 				prev.next = newPost
 
 				// Unlock the posts and return
@@ -156,6 +163,16 @@ func validate(prev, curr *post) bool {
 
 // Function to display the entire feed
 func (f *feed) Show() []interface{} {
+	displayFeed, _ := f.ShowUntil(time.Time{})
+	return displayFeed
+}
+
+// showCheckInterval is the number of posts displayed between deadline checks
+const showCheckInterval = 256
+
+// ShowUntil displays the entire feed like Show but gives up once the deadline
+// has passed, in which case it returns false. A zero deadline never expires.
+func (f *feed) ShowUntil(deadline time.Time) ([]interface{}, bool) {
 
 	f.lock.RLock()
 
@@ -165,6 +182,12 @@ func (f *feed) Show() []interface{} {
 	var displayFeed []interface{}
 
 	for currPost != nil {
+		// Check the deadline every few posts, the clock is too slow to read for every post
+		if !deadline.IsZero() && len(displayFeed)%showCheckInterval == 0 && !time.Now().Before(deadline) {
+			f.lock.RUnlock()
+			return nil, false
+		}
+
 		// Create post to display
 		displayPost := make(map[string]interface{})
 
@@ -183,5 +206,5 @@ func (f *feed) Show() []interface{} {
 
 	f.lock.RUnlock()
 
-	return displayFeed
+	return displayFeed, true
 }
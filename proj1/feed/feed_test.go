@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func addGoroutine(amount int, feed Feed, localCount int, wg *sync.WaitGroup) {
@@ -319,4 +320,20 @@ func TestParallelAll(t *testing.T) {
 			t.Errorf("Removed all items but not all were removed:\n"+"(Got):%v\n", i)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestShowUntil(t *testing.T) {
+	feed := NewFeed()
+	for i := 0; i < 1000; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+	}
+	if posts, ok := feed.ShowUntil(time.Time{}); !ok || len(posts) != 1000 {
+		t.Errorf("Expected the entire feed without a deadline, got %v posts (ok = %v)", len(posts), ok)
+	}
+	if posts, ok := feed.ShowUntil(time.Now().Add(time.Minute)); !ok || len(posts) != 1000 {
+		t.Errorf("Expected the entire feed before the deadline, got %v posts (ok = %v)", len(posts), ok)
+	}
+	if posts, ok := feed.ShowUntil(time.Now().Add(-time.Millisecond)); ok || posts != nil {
+		t.Errorf("Expected no posts after the deadline, got %v posts (ok = %v)", len(posts), ok)
+	}
+}
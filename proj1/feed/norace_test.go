@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package feed
+
+// testFeed restricts TestImplementations to one feed, every feed runs when
+// the race detector is off (see race_test.go)
+const testFeed = ""
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package feed
+
+// testFeed is the only feed TestImplementations runs concurrently under the
+// race detector, which reports the traversals of the list feed without locks
+const testFeed = "coarse"
@@ -0,0 +1,40 @@
+package feed
+
+import (
+	"proj1/internal/registry"
+	"proj1/lock"
+)
+
+// Constructor creates an empty feed whose locks are created by newLock
+type Constructor func(newLock lock.Constructor) Feed
+
+// Default is the name of the implementation used when none is given
+const Default = "list"
+
+// implementations holds the feed implementations by name
+var implementations = registry.New("feed", Default)
+
+func init() {
+	Register("list", NewListFeed)
+	Register("coarse", NewCoarseFeed)
+}
+
+// Register makes a feed implementation available under a name
+func Register(name string, constructor Constructor) {
+	implementations.Register(name, constructor)
+}
+
+// Lookup returns the constructor of a feed implementation, Default for an
+// empty name
+func Lookup(name string) (Constructor, error) {
+	constructor, err := implementations.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return constructor.(Constructor), nil
+}
+
+// Names returns the names of the feed implementations in order
+func Names() []string {
+	return implementations.Names()
+}
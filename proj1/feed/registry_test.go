@@ -0,0 +1,81 @@
+package feed
+
+import (
+	"proj1/lock"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	if _, err := Lookup(""); err != nil {
+		t.Errorf("Expected the default implementation, got %v", err)
+	}
+	if _, err := Lookup("tree"); err == nil {
+		t.Errorf("Expected an error for an unknown implementation")
+	}
+}
+
+// Every feed implementation behaves the same with every lock implementation
+func TestImplementations(t *testing.T) {
+	for _, feedName := range Names() {
+		if testFeed != "" && feedName != testFeed {
+			t.Logf("%v: skipped under the race detector", feedName)
+			continue
+		}
+		for _, lockName := range lock.Names() {
+			newFeed, err := Lookup(feedName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newLock, err := lock.Lookup(lockName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			feed := newFeed(newLock)
+			name := feedName + "/" + lockName
+			if posts := feed.Show(); posts == nil || len(posts) != 0 {
+				t.Errorf("%v: expected an empty feed, got %#v", name, posts)
+			}
+
+			// Add the posts concurrently, then remove the even ones concurrently
+			const threadCount = 8
+			const localCount = 200
+			var wg sync.WaitGroup
+			for i := 0; i < threadCount; i++ {
+				wg.Add(1)
+				go addGoroutine(i*localCount, feed, localCount, &wg)
+			}
+			wg.Wait()
+			feed.Add("replaced", 0)
+			for i := 0; i < threadCount; i++ {
+				wg.Add(2)
+				go func(start int) {
+					defer wg.Done()
+					for num := start; num < start+localCount; num += 2 {
+						if !feed.Remove(float64(num)) {
+							t.Errorf("%v: expected to remove %v", name, num)
+						}
+					}
+				}(i * localCount)
+				go randomReads(feed, localCount, &wg)
+			}
+			wg.Wait()
+
+			posts := feed.Show()
+			if len(posts) != threadCount*localCount/2 {
+				t.Fatalf("%v: expected %v posts, got %v", name, threadCount*localCount/2, len(posts))
+			}
+			for i, displayed := range posts {
+				num := threadCount*localCount - 1 - 2*i
+				post := displayed.(map[string]interface{})
+				if post["timestamp"] != float64(num) || post["body"] != strconv.Itoa(num) {
+					t.Errorf("%v: expected post %v at %v, got %v", name, num, i, post)
+				}
+				if feed.Contains(float64(num - 1)) {
+					t.Errorf("%v: expected %v to be removed", name, num-1)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package registry keeps implementations under a name, for the packages
+// whose implementation is picked by name (feed, lock and queue). Those
+// packages wrap a Registry with typed Register, Lookup and Names functions.
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Registry maps names to the constructors of one kind of implementation. It
+// is safe for concurrent use.
+type Registry struct {
+	kind         string // What is registered, for the errors
+	fallback     string // Name looked up for an empty name
+	mutex        sync.Mutex
+	constructors map[string]interface{}
+}
+
+// New creates an empty registry of a kind of implementation, whose default
+// is registered under fallback
+func New(kind string, fallback string) *Registry {
+	return &Registry{kind: kind, fallback: fallback, constructors: make(map[string]interface{})}
+}
+
+// Register makes an implementation available under a name, replacing any
+// implementation registered under the same name
+func (registry *Registry) Register(name string, constructor interface{}) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.constructors[name] = constructor
+}
+
+// Lookup returns the constructor registered under a name, the default one
+// for an empty name
+func (registry *Registry) Lookup(name string) (interface{}, error) {
+	if name == "" {
+		name = registry.fallback
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	constructor, ok := registry.constructors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown %v implementation %q (available: %v)", registry.kind, name, registry.names())
+	}
+	return constructor, nil
+}
+
+// Names returns the names of the registered implementations in order
+func (registry *Registry) Names() []string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.names()
+}
+
+// names lists the registry, the caller holds the mutex
+func (registry *Registry) names() []string {
+	list := make([]string, 0, len(registry.constructors))
+	for name := range registry.constructors {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := New("test", "b")
+	registry.Register("b", 2)
+	registry.Register("a", 1)
+	registry.Register("b", 3)
+	if names := registry.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Expected the sorted names [a b], got %v", names)
+	}
+
+	var tests = []struct {
+		name     string
+		expected interface{}
+	}{
+		{"a", 1},
+		{"b", 3},
+		{"", 3},
+	}
+	for _, test := range tests {
+		if constructor, err := registry.Lookup(test.name); err != nil || constructor != test.expected {
+			t.Errorf("Expected %v for %q, got %v (%v)", test.expected, test.name, constructor, err)
+		}
+	}
+	if _, err := registry.Lookup("c"); err == nil || !strings.Contains(err.Error(), `unknown test implementation "c" (available: [a b])`) {
+		t.Errorf("Expected an error listing the implementations, got %v", err)
+	}
+}
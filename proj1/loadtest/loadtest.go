@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	parser "flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"proj1/client"
+	"proj1/server"
+	"proj1/workload"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func Usage() {
+	fmt.Println("Usage: loadtest [flags] [-- <flags of the spawned server>] \n Sends requests to twitter.go at a fixed rate, whether or not the previous ones were answered, and reports the latency percentiles and the throughput. \n Every rate of -rates is run against a fresh server for every number of -consumers, the rates stop once the server is saturated.\nFlags:")
+	parser.CommandLine.SetOutput(os.Stdout)
+	parser.PrintDefaults()
+}
+
+func main() {
+	serverPath := parser.String("server", "twitter", "twitter binary to spawn")
+	connect := parser.String("connect", "", "load a server started with -listen at this address instead of spawning one, -consumers is not used")
+	consumersList := parser.String("consumers", "1,2,4,8", "numbers of consumers of the spawned servers, 0 is the sequential version")
+	ratesList := parser.String("rates", "1000,2000,5000,10000,20000,50000,100000", "target rates in requests per second, in increasing order")
+	duration := parser.Duration("duration", 5*time.Second, "how long each rate is sustained")
+	slo := parser.Duration("slo", 100*time.Millisecond, "p99 latency above which the server is saturated")
+	protocolName := parser.String("protocol", "binary", "protocol of the server: json or binary")
+	mixSpec := parser.String("mix", workload.DefaultMix, "relative weight of each command as command=weight,... (see workgen)")
+	targets := parser.String("targets", workload.Uniform, "which posts CONTAINS and REMOVE target: uniform or zipf")
+	bodySizes := parser.String("body-size", "16", "length of the bodies (see workgen)")
+	seed := parser.Int64("seed", 1, "seed of the workload")
+	jsonOutput := parser.Bool("json", false, "print each run as a JSON line instead of a table")
+	parser.Usage = Usage
+	parser.Parse()
+
+	protocol, err := server.LookupProtocol(*protocolName)
+	var consumers []int
+	var rates []float64
+	if err == nil {
+		consumers, err = parseInts(*consumersList)
+	}
+	if err == nil {
+		rates, err = parseRates(*ratesList)
+	}
+	config := workload.Config{Targets: *targets, Seed: *seed}
+	if err == nil {
+		config.Mix, err = workload.ParseMix(*mixSpec)
+	}
+	if err == nil {
+		config.Bodies, err = workload.ParseBodySizes(*bodySizes)
+	}
+	if err == nil && *duration <= 0 {
+		err = fmt.Errorf("invalid duration %v", *duration)
+	}
+	if err == nil {
+		_, err = workload.NewGenerator(config)
+	}
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+	if *connect != "" {
+		consumers = []int{-1}
+	}
+
+	report := newReport(os.Stdout, *jsonOutput)
+	for _, count := range consumers {
+		for _, rate := range rates {
+			var conn *client.Client
+			if *connect != "" {
+				conn, err = client.Dial(*connect, protocol)
+			} else {
+				args := []string{"-protocol", *protocolName, "-consumers", strconv.Itoa(count)}
+				if count == 0 {
+					args = []string{"-protocol", *protocolName, "-mode", "s"}
+				}
+				cmd := exec.Command(*serverPath, append(args, parser.Args()...)...)
+				cmd.Stderr = os.Stderr
+				conn, err = client.Exec(cmd, protocol)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error: ", err)
+				os.Exit(1)
+			}
+			// The same requests for every number of consumers
+			config.Requests = int(rate * duration.Seconds())
+			generator, _ := workload.NewGenerator(config)
+			result := run(conn, generator, rate)
+			if err := conn.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, "Error: ", err)
+				os.Exit(1)
+			}
+			result.Consumers = count
+			result.Saturated = result.saturated(*slo)
+			report.add(result)
+			if result.Saturated {
+				break
+			}
+		}
+	}
+	report.summary()
+}
+
+// parseInts parses a comma-separated list of non-negative integers
+func parseInts(list string) ([]int, error) {
+	var values []int
+	for _, item := range strings.Split(list, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid number %q in %q", item, list)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// parseRates parses a comma-separated list of increasing positive rates
+func parseRates(list string) ([]float64, error) {
+	var rates []float64
+	for _, item := range strings.Split(list, ",") {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) || (len(rates) > 0 && rate <= rates[len(rates)-1]) {
+			return nil, fmt.Errorf("invalid rate %q in %q, the rates must be positive and increasing", item, list)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// result is the outcome of a run at a target rate
+type result struct {
+	Consumers  int     `json:"consumers"` // -1 = a server started with -listen
+	Rate       float64 `json:"rate"`      // Target rate in requests per second
+	Requests   int     `json:"requests"`
+	Errors     int     `json:"errors"`     // Requests answered with an error code or never answered
+	Throughput float64 `json:"throughput"` // Responses per second from the first request to the last response
+	// Latency percentiles and maximum in milliseconds, from the time each
+	// request was due to be sent
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P99       float64 `json:"p99_ms"`
+	P999      float64 `json:"p999_ms"`
+	Max       float64 `json:"max_ms"`
+	Saturated bool    `json:"saturated"` // The server did not keep up with the rate
+}
+
+// run sends the requests of the generator at a fixed rate. The requests are
+// sent on schedule whatever the responses do: if the server falls behind,
+// the latency of each request still counts from when it was due, so the
+// stall shows up in the percentiles instead of slowing down the load
+// (coordinated omission).
+func run(conn *client.Client, generator *workload.Generator, rate float64) result {
+	interval := float64(time.Second) / rate
+	var latencies []time.Duration
+	var mutex sync.Mutex
+	var failed int64
+	var group sync.WaitGroup
+	start := time.Now()
+	for i := 0; ; i++ {
+		request, ok := generator.Next()
+		if !ok {
+			break
+		}
+		due := start.Add(time.Duration(float64(i) * interval))
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(wait)
+		}
+		group.Add(1)
+		conn.Do(context.Background(), request).Then(func(response server.Response, err error) {
+			latency := time.Since(due)
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+			}
+			mutex.Lock()
+			latencies = append(latencies, latency)
+			mutex.Unlock()
+			group.Done()
+		})
+	}
+	group.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result := result{Rate: rate, Requests: len(latencies), Errors: int(failed)}
+	if len(latencies) > 0 {
+		result.Throughput = float64(len(latencies)) / elapsed.Seconds()
+		result.P50 = milliseconds(percentile(latencies, 0.5))
+		result.P90 = milliseconds(percentile(latencies, 0.9))
+		result.P99 = milliseconds(percentile(latencies, 0.99))
+		result.P999 = milliseconds(percentile(latencies, 0.999))
+		result.Max = milliseconds(latencies[len(latencies)-1])
+	}
+	return result
+}
+
+// percentile returns the latency below which a share q of the sorted
+// latencies falls
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// saturated tells whether the server fell behind the target rate, answered
+// too slowly or failed requests
+func (result result) saturated(slo time.Duration) bool {
+	return result.Throughput < 0.95*result.Rate || result.P99 > milliseconds(slo) || result.Errors > 0
+}
+
+// report prints the runs and the saturation point of each number of
+// consumers
+type report struct {
+	out        io.Writer
+	jsonLines  bool // Print each run as a JSON line, without the summary
+	runs       []result
+	headerDone bool
+}
+
+func newReport(out io.Writer, jsonLines bool) *report {
+	return &report{out: out, jsonLines: jsonLines}
+}
+
+// add prints a run
+func (report *report) add(run result) {
+	report.runs = append(report.runs, run)
+	if report.jsonLines {
+		encoded, _ := json.Marshal(run)
+		fmt.Fprintf(report.out, "%s\n", encoded)
+		return
+	}
+	if !report.headerDone {
+		fmt.Fprintf(report.out, "%9v %10v %10v %9v %9v %9v %9v %9v %7v\n", "consumers", "rate/s", "done/s", "p50 ms", "p90 ms", "p99 ms", "p999 ms", "max ms", "errors")
+		report.headerDone = true
+	}
+	saturated := ""
+	if run.Saturated {
+		saturated = "  saturated"
+	}
+	fmt.Fprintf(report.out, "%9v %10.0f %10.0f %9.2f %9.2f %9.2f %9.2f %9.2f %7v%v\n",
+		consumersName(run.Consumers), run.Rate, run.Throughput, run.P50, run.P90, run.P99, run.P999, run.Max, run.Errors, saturated)
+}
+
+// summary prints the highest rate each number of consumers sustained
+func (report *report) summary() {
+	if report.jsonLines {
+		return
+	}
+	fmt.Fprintln(report.out)
+	for i, run := range report.runs {
+		if i+1 < len(report.runs) && report.runs[i+1].Consumers == run.Consumers {
+			continue
+		}
+		// The last run of these consumers, saturated unless every rate was
+		// sustained
+		sustained := "no rate"
+		if previous := i - 1; run.Saturated && previous >= 0 && report.runs[previous].Consumers == run.Consumers {
+			sustained = fmt.Sprintf("%.0f requests/s", report.runs[previous].Rate)
+		} else if !run.Saturated {
+			sustained = fmt.Sprintf("every rate, up to %.0f requests/s", run.Rate)
+		}
+		name := "the server"
+		if run.Consumers >= 0 {
+			name = consumersName(run.Consumers) + " consumers"
+		}
+		fmt.Fprintf(report.out, "%v: sustained %v\n", name, sustained)
+	}
+}
+
+// consumersName describes a number of consumers in the report
+func consumersName(consumers int) string {
+	if consumers < 0 {
+		return "server"
+	}
+	return strconv.Itoa(consumers)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"proj1/client"
+	"proj1/workload"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowServer answers every request, one at a time, after a delay
+func slowServer(delay time.Duration) *client.Client {
+	requests, requestWriter := io.Pipe()
+	responses, responseWriter := io.Pipe()
+	go func() {
+		decoder := json.NewDecoder(requests)
+		encoder := json.NewEncoder(responseWriter)
+		for {
+			var request map[string]interface{}
+			if err := decoder.Decode(&request); err != nil || request["command"] == "DONE" {
+				break
+			}
+			time.Sleep(delay)
+			encoder.Encode(map[string]interface{}{"id": request["id"], "success": true})
+		}
+		responseWriter.Close()
+	}()
+	return client.New(responses, requestWriter, nil)
+}
+
+func TestRun(t *testing.T) {
+	generator, _ := workload.NewGenerator(workload.Config{Requests: 200, Seed: 1})
+	conn := slowServer(0)
+	result := run(conn, generator, 2000)
+	conn.Close()
+	if result.Requests != 200 || result.Errors != 0 {
+		t.Fatalf("Expected 200 answered requests, got %+v", result)
+	}
+	// The 200 requests are sent over 100ms
+	if result.Throughput < 1000 || result.Throughput > 2100 {
+		t.Errorf("Expected about 2000 requests per second, got %v", result.Throughput)
+	}
+	if !(result.P50 <= result.P90 && result.P90 <= result.P99 && result.P99 <= result.P999 && result.P999 <= result.Max) {
+		t.Errorf("Expected increasing percentiles, got %+v", result)
+	}
+
+	// The server takes 5ms per request and gets one every 1ms, request i
+	// waits for the 4i ms the server is behind. Measured from when each
+	// request was sent in a closed loop, every latency would be 5ms.
+	generator, _ = workload.NewGenerator(workload.Config{Requests: 100, Seed: 1})
+	conn = slowServer(5 * time.Millisecond)
+	result = run(conn, generator, 1000)
+	conn.Close()
+	if result.P50 < 150 || result.P99 < 350 {
+		t.Errorf("Expected the queueing behind the slow server in the latencies, got %+v", result)
+	}
+	if !result.saturated(100 * time.Millisecond) {
+		t.Errorf("Expected the server to be saturated")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 1000)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	var tests = []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{0.5, 500 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+		{0.999, 999 * time.Millisecond},
+		{1, 1000 * time.Millisecond},
+		{0, time.Millisecond},
+	}
+	for _, test := range tests {
+		if latency := percentile(latencies, test.q); latency != test.expected {
+			t.Errorf("Expected %v for %v, got %v", test.expected, test.q, latency)
+		}
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	if rates, err := parseRates("1000, 2500.5,10000"); err != nil || len(rates) != 3 || rates[1] != 2500.5 {
+		t.Errorf("Expected 3 rates, got %v (%v)", rates, err)
+	}
+	for _, list := range []string{"", "0", "-5", "2000,1000", "1000,1000", "x"} {
+		if _, err := parseRates(list); err == nil {
+			t.Errorf("Expected an error for %q", list)
+		}
+	}
+	if consumers, err := parseInts("0,1,8"); err != nil || len(consumers) != 3 {
+		t.Errorf("Expected 3 numbers of consumers, got %v (%v)", consumers, err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var tests = []struct {
+		result    result
+		saturated bool
+	}{
+		{result{Rate: 1000, Throughput: 990, P99: 5}, false},
+		{result{Rate: 1000, Throughput: 900, P99: 5}, true},
+		{result{Rate: 1000, Throughput: 1000, P99: 500}, true},
+		{result{Rate: 1000, Throughput: 1000, P99: 5, Errors: 1}, true},
+	}
+	for _, test := range tests {
+		if saturated := test.result.saturated(100 * time.Millisecond); saturated != test.saturated {
+			t.Errorf("Expected saturated = %v for %+v", test.saturated, test.result)
+		}
+	}
+
+	var output bytes.Buffer
+	report := newReport(&output, false)
+	report.add(result{Consumers: 1, Rate: 1000})
+	report.add(result{Consumers: 1, Rate: 2000, Saturated: true})
+	report.add(result{Consumers: 2, Rate: 1000, Saturated: true})
+	report.add(result{Consumers: 4, Rate: 1000})
+	report.add(result{Consumers: 4, Rate: 2000})
+	report.summary()
+	for _, line := range []string{"1 consumers: sustained 1000 requests/s", "2 consumers: sustained no rate", "4 consumers: sustained every rate, up to 2000 requests/s"} {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("Expected %q in the report:\n%v", line, output.String())
+		}
+	}
+
+	output.Reset()
+	report = newReport(&output, true)
+	report.add(result{Consumers: 8, Rate: 1000, P99: 1.5})
+	report.summary()
+	var decoded result
+	if err := json.Unmarshal(output.Bytes(), &decoded); err != nil || decoded.Consumers != 8 || decoded.P99 != 1.5 {
+		t.Errorf("Expected a JSON line, got %q (%v)", output.String(), err)
+	}
+}
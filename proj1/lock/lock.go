@@ -0,0 +1,48 @@
+package lock
+
+import (
+	"proj1/internal/registry"
+	"sync"
+)
+
+// Locker is a read-write lock. RWLock and sync.RWMutex implement it.
+type Locker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+}
+
+// Constructor creates a new unlocked Locker
+type Constructor func() Locker
+
+// Default is the name of the implementation used when none is given
+const Default = "rwlock"
+
+// implementations holds the lock implementations by name
+var implementations = registry.New("lock", Default)
+
+func init() {
+	Register("rwlock", func() Locker { return NewRWLock() })
+	Register("rwmutex", func() Locker { return &sync.RWMutex{} })
+}
+
+// Register makes a lock implementation available under a name
+func Register(name string, constructor Constructor) {
+	implementations.Register(name, constructor)
+}
+
+// Lookup returns the constructor of a lock implementation, Default for an
+// empty name
+func Lookup(name string) (Constructor, error) {
+	constructor, err := implementations.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return constructor.(Constructor), nil
+}
+
+// Names returns the names of the lock implementations in order
+func Names() []string {
+	return implementations.Names()
+}
@@ -0,0 +1,50 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	if _, err := Lookup(""); err != nil {
+		t.Errorf("Expected the default implementation, got %v", err)
+	}
+	if _, err := Lookup("spinlock"); err == nil {
+		t.Errorf("Expected an error for an unknown implementation")
+	}
+}
+
+func TestImplementations(t *testing.T) {
+	for _, name := range Names() {
+		newLock, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock := newLock()
+		counter := 0
+		var wg sync.WaitGroup
+		for goID := 0; goID < 8; goID++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					lock.Lock()
+					counter++
+					lock.Unlock()
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					lock.RLock()
+					_ = counter
+					lock.RUnlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if counter != 8*1000 {
+			t.Errorf("%v: expected %v increments, got %v", name, 8*1000, counter)
+		}
+	}
+}
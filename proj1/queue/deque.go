@@ -0,0 +1,70 @@
+package queue
+
+import (
+	"sync"
+)
+
+// Deque is a double-ended queue of Requests owned by a single consumer in
+// the work stealing version. The producer adds tasks at the back, the owner
+// takes them from the front (oldest first) and idle consumers steal from the
+// back so they rarely compete with the owner for the same tasks.
+type Deque struct {
+	mutex sync.Mutex
+	tasks []*Request // tasks[head:] are the queued tasks
+	head  int
+}
+
+// NewDeque creates an empty Deque
+func NewDeque() *Deque {
+	return &Deque{}
+}
+
+// PushBack adds a task at the back of the deque
+func (deque *Deque) PushBack(task *Request) {
+	deque.mutex.Lock()
+	// Reuse the space of the tasks already taken from the front
+	if deque.head > 0 && deque.head == len(deque.tasks) {
+		deque.tasks = deque.tasks[:0]
+		deque.head = 0
+	} else if deque.head > 0 && deque.head >= cap(deque.tasks)/2 {
+		n := copy(deque.tasks, deque.tasks[deque.head:])
+		deque.tasks = deque.tasks[:n]
+		deque.head = 0
+	}
+	deque.tasks = append(deque.tasks, task)
+	deque.mutex.Unlock()
+}
+
+// PopFront removes the oldest task. It returns false if the deque is empty.
+func (deque *Deque) PopFront() (*Request, bool) {
+	deque.mutex.Lock()
+	defer deque.mutex.Unlock()
+	if deque.head == len(deque.tasks) {
+		return nil, false
+	}
+	task := deque.tasks[deque.head]
+	deque.tasks[deque.head] = nil
+	deque.head++
+	return task, true
+}
+
+// StealBack removes the newest task. It returns false if the deque is empty.
+func (deque *Deque) StealBack() (*Request, bool) {
+	deque.mutex.Lock()
+	defer deque.mutex.Unlock()
+	if deque.head == len(deque.tasks) {
+		return nil, false
+	}
+	last := len(deque.tasks) - 1
+	task := deque.tasks[last]
+	deque.tasks[last] = nil
+	deque.tasks = deque.tasks[:last]
+	return task, true
+}
+
+// Len returns the number of tasks in the deque
+func (deque *Deque) Len() int {
+	deque.mutex.Lock()
+	defer deque.mutex.Unlock()
+	return len(deque.tasks) - deque.head
+}
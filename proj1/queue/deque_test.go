@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestDequeEnds(t *testing.T) {
+	deque := NewDeque()
+	for i := 0; i < 5; i++ {
+		deque.PushBack(&Request{Message: map[string]interface{}{"id": float64(i)}})
+	}
+	if task, _ := deque.PopFront(); task.Message["id"] != float64(0) {
+		t.Errorf("Expected the owner to take id 0, got %v", task.Message["id"])
+	}
+	if task, _ := deque.StealBack(); task.Message["id"] != float64(4) {
+		t.Errorf("Expected a thief to take id 4, got %v", task.Message["id"])
+	}
+	if deque.Len() != 3 {
+		t.Errorf("Expected length 3, got %v", deque.Len())
+	}
+	for i := 1; i <= 3; i++ {
+		if task, ok := deque.PopFront(); !ok || task.Message["id"] != float64(i) {
+			t.Errorf("Expected id %v, got %v", i, task)
+		}
+	}
+	if _, ok := deque.PopFront(); ok {
+		t.Errorf("Expected an empty deque")
+	}
+	if _, ok := deque.StealBack(); ok {
+		t.Errorf("Expected an empty deque")
+	}
+}
+
+func TestDequeConcurrentSteal(t *testing.T) {
+	deque := NewDeque()
+	tasks := 10000
+	taken := make([]int32, tasks)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	take := func(steal bool) {
+		defer wg.Done()
+		for {
+			var task *Request
+			var ok bool
+			if steal {
+				task, ok = deque.StealBack()
+			} else {
+				task, ok = deque.PopFront()
+			}
+			if !ok {
+				return
+			}
+			mutex.Lock()
+			taken[int(task.Message["id"].(float64))]++
+			mutex.Unlock()
+		}
+	}
+	for i := 0; i < tasks; i++ {
+		deque.PushBack(&Request{Message: map[string]interface{}{"id": float64(i)}})
+	}
+	wg.Add(4)
+	go take(false)
+	for goID := 0; goID < 3; goID++ {
+		go take(true)
+	}
+	wg.Wait()
+	for id, count := range taken {
+		if count != 1 {
+			t.Fatalf("Task %v was taken %v times", id, count)
+		}
+	}
+}
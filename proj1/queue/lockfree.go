@@ -6,7 +6,9 @@ import (
 )
 
 type Request struct {
-	Message map[string]interface{}
+	Message  map[string]interface{}
+	Priority int         // Level in a PriorityQueue (PriorityHigh to PriorityLow)
+	Value    interface{} // Data of the caller carried with the message, the queues do not use it
 }
 
 type node struct {
@@ -17,8 +19,9 @@ type node struct {
 // LockfreeQueue represents a FIFO structure with operations to enqueue
 // and dequeue tasks represented as Request
 type LockFreeQueue struct {
-	head unsafe.Pointer
-	tail unsafe.Pointer
+	length int64 // Number of queued tasks, first for 64-bit alignment of the atomic operations
+	head   unsafe.Pointer
+	tail   unsafe.Pointer
 }
 
 // NewQueue creates and initializes a LockFreeQueue
@@ -32,6 +35,8 @@ func NewLockFreeQueue() *LockFreeQueue {
 func (queue *LockFreeQueue) Enqueue(task *Request) {
 	// Node to add to the queue
 	node_ := &node{value: *task}
+	// Count the task before it is visible so Len never goes negative
+	atomic.AddInt64(&queue.length, 1)
 	for {
 		// Traverse the queue
 		tailNode := (*node)(atomic.LoadPointer(&queue.tail))
@@ -74,6 +79,7 @@ func (queue *LockFreeQueue) Dequeue() *Request {
 				// If the head is not the same as the tail
 				request := nextNode.value
 				if atomic.CompareAndSwapPointer(&queue.head, unsafe.Pointer(headNode), unsafe.Pointer(nextNode)) {
+					atomic.AddInt64(&queue.length, -1)
 					return &request
 				}
 			}
@@ -81,3 +87,8 @@ func (queue *LockFreeQueue) Dequeue() *Request {
 
 	}
 }
+
+// Len returns the number of tasks currently in the queue
+func (queue *LockFreeQueue) Len() int64 {
+	return atomic.LoadInt64(&queue.length)
+}
@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestFIFOOrder(t *testing.T) {
+	queue := NewLockFreeQueue()
+	for i := 0; i < 10; i++ {
+		queue.Enqueue(&Request{Message: map[string]interface{}{"id": float64(i)}})
+	}
+	if queue.Len() != 10 {
+		t.Fatalf("Expected length 10, got %v", queue.Len())
+	}
+	for i := 0; i < 10; i++ {
+		request := queue.Dequeue()
+		if request.Message["id"] != float64(i) {
+			t.Errorf("Expected id %v, got %v", i, request.Message["id"])
+		}
+	}
+	if request := queue.Dequeue(); request.Message != nil {
+		t.Errorf("Expected an empty queue, got %v", request.Message)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Expected length 0, got %v", queue.Len())
+	}
+}
+
+func TestConcurrentLen(t *testing.T) {
+	queue := NewLockFreeQueue()
+	var wg sync.WaitGroup
+	for goID := 0; goID < 8; goID++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				queue.Enqueue(&Request{Message: map[string]interface{}{}})
+				if i%2 == 0 {
+					queue.Dequeue()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if queue.Len() != 8*500 {
+		t.Errorf("Expected length %v, got %v", 8*500, queue.Len())
+	}
+}
@@ -0,0 +1,53 @@
+package queue
+
+import "sync"
+
+// MutexQueue is a FIFO queue of tasks guarded by a single mutex, the
+// baseline the LockFreeQueue is compared against
+type MutexQueue struct {
+	mutex sync.Mutex
+	tasks []*Request
+	head  int // Index of the first queued task in tasks
+}
+
+// NewMutexQueue creates an empty MutexQueue
+func NewMutexQueue() *MutexQueue {
+	return &MutexQueue{}
+}
+
+// Enqueue adds a task to the back of the queue
+func (queue *MutexQueue) Enqueue(task *Request) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.tasks = append(queue.tasks, task)
+}
+
+// Dequeue removes the task at the front of the queue and returns it, or a
+// Request with a nil Message if the queue is empty
+func (queue *MutexQueue) Dequeue() *Request {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.head == len(queue.tasks) {
+		return &Request{Message: nil}
+	}
+	task := queue.tasks[queue.head]
+	queue.tasks[queue.head] = nil
+	queue.head++
+	// Reuse the slice once it is drained, or compact it once half of it is
+	// dequeued tasks
+	if queue.head == len(queue.tasks) {
+		queue.tasks = queue.tasks[:0]
+		queue.head = 0
+	} else if queue.head > 64 && queue.head*2 >= len(queue.tasks) {
+		queue.tasks = append(queue.tasks[:0], queue.tasks[queue.head:]...)
+		queue.head = 0
+	}
+	return task
+}
+
+// Len returns the number of queued tasks
+func (queue *MutexQueue) Len() int64 {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return int64(len(queue.tasks) - queue.head)
+}
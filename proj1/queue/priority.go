@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"sync/atomic"
+)
+
+// Priority levels of a Request, a lower level is served first
+const (
+	PriorityHigh   = 0
+	PriorityNormal = 1
+	PriorityLow    = 2
+	PriorityLevels = 3 // Number of levels of a PriorityQueue
+)
+
+// PriorityQueue is a multi-level queue of Requests with one Queue per
+// priority level. Dequeue serves the highest non-empty level, except that a
+// level passed over maxSkips times while it held tasks is served first, so
+// low priority tasks are delayed but never starved.
+type PriorityQueue struct {
+	levels   [PriorityLevels]Queue
+	skips    [PriorityLevels]int64 // Times each level was passed over while not empty
+	maxSkips int64
+}
+
+// NewPriorityQueue creates a PriorityQueue of LockFreeQueues that passes over
+// a non-empty level at most maxSkips times in a row (at least 1)
+func NewPriorityQueue(maxSkips int) *PriorityQueue {
+	return NewPriorityQueueOf(maxSkips, func() Queue { return NewLockFreeQueue() })
+}
+
+// NewPriorityQueueOf is like NewPriorityQueue with the levels created by
+// newLevel
+func NewPriorityQueueOf(maxSkips int, newLevel Constructor) *PriorityQueue {
+	if maxSkips < 1 {
+		maxSkips = 1
+	}
+	queue := &PriorityQueue{maxSkips: int64(maxSkips)}
+	for level := range queue.levels {
+		queue.levels[level] = newLevel()
+	}
+	return queue
+}
+
+// level returns the level of a task, out of range priorities are clamped
+func level(task *Request) int {
+	if task.Priority < PriorityHigh {
+		return PriorityHigh
+	} else if task.Priority >= PriorityLevels {
+		return PriorityLevels - 1
+	}
+	return task.Priority
+}
+
+// Enqueue adds a task to the level of its priority
+func (queue *PriorityQueue) Enqueue(task *Request) {
+	queue.levels[level(task)].Enqueue(task)
+}
+
+// Dequeue removes the next task. Like LockFreeQueue.Dequeue it returns a
+// Request with a nil Message if the queue is empty.
+func (queue *PriorityQueue) Dequeue() *Request {
+	// Serve the starving levels first, the lowest one before the others
+	for level := PriorityLevels - 1; level > PriorityHigh; level-- {
+		if atomic.LoadInt64(&queue.skips[level]) >= queue.maxSkips && queue.levels[level].Len() > 0 {
+			if request := queue.levels[level].Dequeue(); request.Message != nil {
+				atomic.StoreInt64(&queue.skips[level], 0)
+				return request
+			}
+		}
+	}
+	for level := range queue.levels {
+		request := queue.levels[level].Dequeue()
+		if request.Message == nil {
+			continue
+		}
+		atomic.StoreInt64(&queue.skips[level], 0)
+		// Every waiting lower level was passed over once more
+		for lower := level + 1; lower < PriorityLevels; lower++ {
+			if queue.levels[lower].Len() > 0 {
+				atomic.AddInt64(&queue.skips[lower], 1)
+			}
+		}
+		return request
+	}
+	return &Request{Message: nil}
+}
+
+// Len returns the number of tasks currently in the queue
+func (queue *PriorityQueue) Len() int64 {
+	var length int64
+	for _, level := range queue.levels {
+		length += level.Len()
+	}
+	return length
+}
@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+)
+
+// prioritized returns a request with the given id and priority
+func prioritized(id int, priority int) *Request {
+	return &Request{Message: map[string]interface{}{"id": float64(id)}, Priority: priority}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	queue := NewPriorityQueue(100)
+	queue.Enqueue(prioritized(0, PriorityLow))
+	queue.Enqueue(prioritized(1, PriorityNormal))
+	queue.Enqueue(prioritized(2, PriorityHigh))
+	queue.Enqueue(prioritized(3, PriorityHigh))
+	queue.Enqueue(prioritized(4, PriorityLevels+1)) // Clamped to PriorityLow
+	queue.Enqueue(prioritized(5, -1))               // Clamped to PriorityHigh
+	if queue.Len() != 6 {
+		t.Fatalf("Expected length 6, got %v", queue.Len())
+	}
+	expected := []float64{2, 3, 5, 1, 0, 4}
+	for _, id := range expected {
+		if request := queue.Dequeue(); request.Message["id"] != id {
+			t.Errorf("Expected id %v, got %v", id, request.Message["id"])
+		}
+	}
+	if request := queue.Dequeue(); request.Message != nil {
+		t.Errorf("Expected an empty queue, got %v", request.Message)
+	}
+}
+
+func TestPriorityStarvation(t *testing.T) {
+	var tests = []struct {
+		maxSkips int
+		served   int // High priority tasks served before the low priority one
+	}{
+		{1, 1},
+		{3, 3},
+		{10, 10},
+	}
+	for _, test := range tests {
+		queue := NewPriorityQueue(test.maxSkips)
+		queue.Enqueue(prioritized(-1, PriorityLow))
+		for i := 0; i < 20; i++ {
+			queue.Enqueue(prioritized(i, PriorityHigh))
+		}
+		served := 0
+		for queue.Dequeue().Message["id"] != float64(-1) {
+			served++
+		}
+		if served != test.served {
+			t.Errorf("maxSkips %v: expected the low priority task after %v tasks, got %v", test.maxSkips, test.served, served)
+		}
+	}
+}
+
+func TestPriorityConcurrent(t *testing.T) {
+	queue := NewPriorityQueue(4)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[float64]bool)
+	for goID := 0; goID < 8; goID++ {
+		wg.Add(1)
+		go func(goID int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				queue.Enqueue(prioritized(goID*1000+i, i%PriorityLevels))
+				if request := queue.Dequeue(); request.Message != nil {
+					mutex.Lock()
+					seen[request.Message["id"].(float64)] = true
+					mutex.Unlock()
+				}
+			}
+		}(goID)
+	}
+	wg.Wait()
+	for request := queue.Dequeue(); request.Message != nil; request = queue.Dequeue() {
+		seen[request.Message["id"].(float64)] = true
+	}
+	if len(seen) != 8000 {
+		t.Errorf("Expected 8000 distinct tasks, got %v", len(seen))
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Expected length 0, got %v", queue.Len())
+	}
+}
@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"proj1/internal/registry"
+)
+
+// Queue is a FIFO queue of tasks shared by the producer and the consumers.
+// LockFreeQueue and MutexQueue implement it.
+type Queue interface {
+	Enqueue(task *Request)
+	Dequeue() *Request // Returns a Request with a nil Message when empty
+	Len() int64
+}
+
+// Constructor creates a new empty Queue
+type Constructor func() Queue
+
+// Default is the name of the implementation used when none is given
+const Default = "lockfree"
+
+// implementations holds the queue implementations by name
+var implementations = registry.New("queue", Default)
+
+func init() {
+	Register("lockfree", func() Queue { return NewLockFreeQueue() })
+	Register("mutex", func() Queue { return NewMutexQueue() })
+}
+
+// Register makes a queue implementation available under a name
+func Register(name string, constructor Constructor) {
+	implementations.Register(name, constructor)
+}
+
+// Lookup returns the constructor of a queue implementation, Default for an
+// empty name
+func Lookup(name string) (Constructor, error) {
+	constructor, err := implementations.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return constructor.(Constructor), nil
+}
+
+// Names returns the names of the queue implementations in order
+func Names() []string {
+	return implementations.Names()
+}
@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	if _, err := Lookup(""); err != nil {
+		t.Errorf("Expected the default implementation, got %v", err)
+	}
+	if _, err := Lookup("stack"); err == nil {
+		t.Errorf("Expected an error for an unknown implementation")
+	}
+}
+
+func TestImplementations(t *testing.T) {
+	for _, name := range Names() {
+		newQueue, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks come out in the order they went in, across compactions
+		queue := newQueue()
+		next := 0
+		for i := 0; i < 500; i++ {
+			queue.Enqueue(&Request{Message: map[string]interface{}{"id": float64(i)}})
+			if i%3 == 0 {
+				if request := queue.Dequeue(); request.Message["id"] != float64(next) {
+					t.Fatalf("%v: expected id %v, got %v", name, next, request.Message["id"])
+				}
+				next++
+			}
+		}
+		for ; next < 500; next++ {
+			if request := queue.Dequeue(); request.Message["id"] != float64(next) {
+				t.Fatalf("%v: expected id %v, got %v", name, next, request.Message["id"])
+			}
+		}
+		if request := queue.Dequeue(); request.Message != nil || queue.Len() != 0 {
+			t.Errorf("%v: expected an empty queue, got %v (length %v)", name, request.Message, queue.Len())
+		}
+
+		// Every task is dequeued exactly once by concurrent consumers
+		queue = newQueue()
+		var mutex sync.Mutex
+		seen := make(map[float64]bool)
+		var wg sync.WaitGroup
+		for goID := 0; goID < 4; goID++ {
+			wg.Add(2)
+			go func(goID int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					queue.Enqueue(&Request{Message: map[string]interface{}{"id": float64(goID*1000 + i)}})
+				}
+			}(goID)
+			go func() {
+				defer wg.Done()
+				for taken := 0; taken < 1000; {
+					if request := queue.Dequeue(); request.Message != nil {
+						mutex.Lock()
+						seen[request.Message["id"].(float64)] = true
+						mutex.Unlock()
+						taken++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if len(seen) != 4*1000 {
+			t.Errorf("%v: expected %v distinct tasks, got %v", name, 4*1000, len(seen))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package record captures server sessions so they can be replayed: every
+// request with its arrival order, the consumer that executed it, when its
+// feed operation ran and its response.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Entry is the record of one request. Every method can be called on a nil
+// *Entry, which records nothing.
+type Entry struct {
+	Arrival  uint64                 `json:"arrival"`  // Position of the request in the input, from 1
+	Request  map[string]interface{} `json:"request"`  // The request as decoded
+	Consumer int                    `json:"consumer"` // Consumer that executed the request (-1 = none)
+	// Feed clock when the feed operation started and returned (0 = the
+	// request did not reach the feed). The operations are linearized in the
+	// order they returned, operations whose intervals overlap ran concurrently.
+	Invoked    uint64                 `json:"invoked,omitempty"`
+	Linearized uint64                 `json:"linearized,omitempty"`
+	Response   map[string]interface{} `json:"response"` // nil = dropped without a response
+	// The request was answered or dropped. Only the finished entries are
+	// written, the others are the requests lost by the server.
+	Finished bool `json:"-"`
+	recorder *Recorder
+}
+
+// Invoke records that the feed operation of the request starts now
+func (entry *Entry) Invoke() {
+	if entry != nil {
+		entry.Invoked = atomic.AddUint64(&entry.recorder.clock, 1)
+	}
+}
+
+// Linearize records that the feed operation of the request returned now
+func (entry *Entry) Linearize() {
+	if entry != nil {
+		entry.Linearized = atomic.AddUint64(&entry.recorder.clock, 1)
+	}
+}
+
+// Overlaps checks whether the feed operations of two entries ran concurrently
+func (entry *Entry) Overlaps(other *Entry) bool {
+	return entry.Invoked < other.Linearized && other.Invoked < entry.Linearized
+}
+
+// Recorder writes the entry of every finished request as one JSON line and
+// keeps the entries for Entries if asked to. Every method can be called on a
+// nil *Recorder, which records nothing.
+type Recorder struct {
+	arrival uint64 // Arrivals so far, only touched by the goroutine reading the input
+	clock   uint64 // atomic, the feed clock
+	mutex   sync.Mutex
+	writer  *bufio.Writer // Receives the recording (nil = not written)
+	encoder *json.Encoder
+	err     error // First write error
+	keep    bool  // Keep every entry for Entries
+	entries []*Entry
+}
+
+// NewRecorder creates a recorder writing to w if it is not nil and keeping
+// the entries for Entries if keep is set
+func NewRecorder(w io.Writer, keep bool) *Recorder {
+	recorder := &Recorder{keep: keep}
+	if w != nil {
+		recorder.writer = bufio.NewWriter(w)
+		recorder.encoder = json.NewEncoder(recorder.writer)
+	}
+	return recorder
+}
+
+// Arrive creates the entry of the next request read from the input. It must
+// be called in input order, before the request is decoded if decoding does
+// not happen in order, in which case the request is set with Decoded.
+func (recorder *Recorder) Arrive(message map[string]interface{}) *Entry {
+	if recorder == nil {
+		return nil
+	}
+	recorder.arrival++
+	entry := &Entry{Arrival: recorder.arrival, Request: message, Consumer: -1, recorder: recorder}
+	if recorder.keep {
+		recorder.mutex.Lock()
+		recorder.entries = append(recorder.entries, entry)
+		recorder.mutex.Unlock()
+	}
+	return entry
+}
+
+// Decoded sets the request of an entry created before it was decoded
+func (entry *Entry) Decoded(message map[string]interface{}) {
+	if entry != nil {
+		entry.Request = message
+	}
+}
+
+// Finish writes the entry of a request with the consumer that executed it
+// and its response, nil if it was dropped
+func (recorder *Recorder) Finish(entry *Entry, consumer int, response map[string]interface{}) {
+	if recorder == nil || entry == nil {
+		return
+	}
+	entry.Consumer = consumer
+	entry.Response = response
+	entry.Finished = true
+	if recorder.encoder == nil {
+		return
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if err := recorder.encoder.Encode(entry); err != nil && recorder.err == nil {
+		recorder.err = err
+	}
+}
+
+// Entries returns every request that arrived in arrival order, including the
+// ones that were not finished. It must only be called once the server
+// stopped.
+func (recorder *Recorder) Entries() []*Entry {
+	if recorder == nil {
+		return nil
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return append([]*Entry(nil), recorder.entries...)
+}
+
+// Close flushes the recording and returns the first write error
+func (recorder *Recorder) Close() error {
+	if recorder == nil {
+		return nil
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.writer == nil {
+		return nil
+	}
+	if err := recorder.writer.Flush(); err != nil && recorder.err == nil {
+		recorder.err = err
+	}
+	return recorder.err
+}
+
+// Read reads the entries of a recording, sorted by arrival
+func Read(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	decoder := json.NewDecoder(r)
+	for {
+		entry := &Entry{Finished: true}
+		if err := decoder.Decode(entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Arrival < entries[j].Arrival
+	})
+	return entries, nil
+}
+
+// Linearization returns the entries that reached the feed in the order of
+// their linearization points
+func Linearization(entries []*Entry) []*Entry {
+	var executed []*Entry
+	for _, entry := range entries {
+		if entry.Linearized > 0 {
+			executed = append(executed, entry)
+		}
+	}
+	sort.Slice(executed, func(i, j int) bool {
+		return executed[i].Linearized < executed[j].Linearized
+	})
+	return executed
+}
@@ -0,0 +1,70 @@
+package record
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNilRecorder(t *testing.T) {
+	var recorder *Recorder
+	entry := recorder.Arrive(map[string]interface{}{"id": 1.0})
+	entry.Decoded(nil)
+	entry.Invoke()
+	entry.Linearize()
+	recorder.Finish(entry, 0, nil)
+	if entry != nil || recorder.Close() != nil {
+		t.Errorf("Expected a nil recorder to record nothing")
+	}
+}
+
+func TestRecording(t *testing.T) {
+	var output bytes.Buffer
+	recorder := NewRecorder(&output, true)
+	first := recorder.Arrive(map[string]interface{}{"command": "ADD", "id": 1.0})
+	second := recorder.Arrive(nil)
+	second.Decoded(map[string]interface{}{"command": "CONTAINS", "id": 2.0})
+	dropped := recorder.Arrive(map[string]interface{}{"command": "LIKE"})
+
+	// The second request reaches the feed first, the operations overlap
+	second.Invoke()
+	first.Invoke()
+	second.Linearize()
+	first.Linearize()
+	recorder.Finish(first, 1, map[string]interface{}{"id": 1.0, "success": true})
+	recorder.Finish(second, 0, map[string]interface{}{"id": 2.0, "success": false})
+	recorder.Finish(dropped, -1, nil)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept := recorder.Entries(); len(kept) != 3 || kept[1] != second || !kept[2].Finished {
+		t.Errorf("Expected the 3 entries to be kept, got %v", kept)
+	}
+	unfinished := recorder.Arrive(map[string]interface{}{"command": "FEED"})
+	if kept := recorder.Entries(); len(kept) != 4 || kept[3] != unfinished || unfinished.Finished {
+		t.Errorf("Expected the unfinished entry to be kept, got %v", kept)
+	}
+
+	entries, err := Read(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %v", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Arrival != uint64(i+1) {
+			t.Errorf("Expected the entries in arrival order, got %v at %v", entry.Arrival, i)
+		}
+	}
+	if entries[0].Consumer != 1 || entries[1].Request["command"] != "CONTAINS" || entries[2].Response != nil {
+		t.Errorf("Unexpected entries %+v %+v %+v", entries[0], entries[1], entries[2])
+	}
+	linearization := Linearization(entries)
+	if len(linearization) != 2 || linearization[0].Arrival != 2 || linearization[1].Arrival != 1 {
+		t.Errorf("Expected the second request to be linearized first, got %v", linearization)
+	}
+	if !entries[0].Overlaps(entries[1]) {
+		t.Errorf("Expected the operations to overlap")
+	}
+}
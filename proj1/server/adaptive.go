@@ -0,0 +1,214 @@
+package server
+
+import (
+	"log"
+	"proj1/feed"
+	"proj1/queue"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScalingConfig configures the adaptive version, which runs the parallel
+// version with a number of consumers that follows the load
+type ScalingConfig struct {
+	MinConsumers int           // Consumers that are never retired (default 1)
+	MaxConsumers int           // Upper bound on the consumers (default ConsumersCount)
+	Interval     time.Duration // How often the load is checked (default 10ms)
+	MaxWait      time.Duration // Queue wait that triggers a scale up (default 5ms)
+	IdleTimeout  time.Duration // How long consumers sit idle before one is retired (default 100ms)
+	Logger       *log.Logger   // Receives every scaling decision (nil = not logged)
+}
+
+// consumerPool is the state of the adaptive consumers. Apart from maxWait
+// every field is guarded by the mutex of the SharedContext.
+type consumerPool struct {
+	settings  ScalingConfig
+	active    int       // Running consumers
+	idle      int       // Consumers waiting on the condition variable
+	retiring  int       // Consumers asked to exit by the supervisor
+	nextID    int       // Index of the next consumer to spawn
+	idleSince time.Time // Since when at least one consumer has been idle
+	maxWait   int64     // Longest queue wait (ns) since the last check, atomic
+}
+
+// withDefaults fills in the unset scaling settings
+func (settings ScalingConfig) withDefaults(consumersCount int) ScalingConfig {
+	if settings.MinConsumers < 1 {
+		settings.MinConsumers = 1
+	}
+	if settings.MaxConsumers < 1 {
+		settings.MaxConsumers = consumersCount
+	}
+	if settings.MaxConsumers < settings.MinConsumers {
+		settings.MaxConsumers = settings.MinConsumers
+	}
+	if settings.Interval <= 0 {
+		settings.Interval = 10 * time.Millisecond
+	}
+	if settings.MaxWait <= 0 {
+		settings.MaxWait = 5 * time.Millisecond
+	}
+	if settings.IdleTimeout <= 0 {
+		settings.IdleTimeout = 100 * time.Millisecond
+	}
+	return settings
+}
+
+// logf logs a scaling decision if a logger is configured
+func (pool *consumerPool) logf(format string, v ...interface{}) {
+	if pool.settings.Logger != nil {
+		pool.settings.Logger.Printf(format, v...)
+	}
+}
+
+// adaptiveServer runs the parallel version with between MinConsumers and
+// MaxConsumers consumers. A supervisor adds consumers when the queue grows
+// or requests wait too long and retires them when they sit idle.
+func adaptiveServer(config Config, feed feed.Feed, q queue.Queue, source *messageSource) error {
+	// Shared context
+	group := sync.WaitGroup{}
+	mutex := sync.Mutex{}
+	context := SharedContext{
+		mutex:   &mutex,
+		cond:    sync.NewCond(&mutex),
+		notFull: sync.NewCond(&mutex),
+		group:   &group,
+		feed:    &feed,
+		queue:   q,
+	}
+	pool := &consumerPool{settings: config.Scaling.withDefaults(config.ConsumersCount)}
+
+	// Spawn the minimum number of consumers
+	context.mutex.Lock()
+	for i := 0; i < pool.settings.MinConsumers; i++ {
+		pool.spawn(config, &context)
+	}
+	context.mutex.Unlock()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		supervisor(config, &context, pool, stop)
+	}()
+
+	// producer to add requests to the queue
+	err := producer(config, &context, source)
+	// The supervisor keeps scaling while the consumers drain the queue
+	context.group.Wait()
+	close(stop)
+	<-stopped
+	return err
+}
+
+// spawn starts a new consumer, it must be called with the mutex held
+func (pool *consumerPool) spawn(config Config, context *SharedContext) {
+	pool.active++
+	context.group.Add(1)
+	go adaptiveConsumer(config, context, pool, pool.nextID)
+	pool.nextID++
+}
+
+// supervisor periodically compares the load with the number of consumers
+func supervisor(config Config, context *SharedContext, pool *consumerPool, stop <-chan struct{}) {
+	ticker := time.NewTicker(pool.settings.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		maxWait := time.Duration(atomic.SwapInt64(&pool.maxWait, 0))
+
+		context.mutex.Lock()
+		depth := context.queue.Len()
+		before := pool.active
+		if depth > 0 && pool.active < pool.settings.MaxConsumers &&
+			(depth > int64(pool.active) || maxWait > pool.settings.MaxWait) {
+			// Scale up, doubling the consumers when the backlog is large
+			add := 1
+			if depth > 4*int64(pool.active) {
+				add = pool.active
+			}
+			if pool.active+add > pool.settings.MaxConsumers {
+				add = pool.settings.MaxConsumers - pool.active
+			}
+			for i := 0; i < add; i++ {
+				pool.spawn(config, context)
+			}
+			pool.idleSince = time.Time{}
+			pool.logf("scale up: %v -> %v consumers (queue depth %v, max wait %v)", before, pool.active, depth, maxWait)
+		} else if pool.idle > 0 && pool.active-pool.retiring > pool.settings.MinConsumers {
+			// Retire one consumer per idle timeout
+			now := time.Now()
+			if pool.idleSince.IsZero() {
+				pool.idleSince = now
+			} else if now.Sub(pool.idleSince) >= pool.settings.IdleTimeout {
+				pool.retiring++
+				pool.idleSince = now
+				context.cond.Signal()
+			}
+		} else {
+			pool.idleSince = time.Time{}
+		}
+		// Wake up an idle consumer if work is waiting, in case it missed
+		// the producer's signal
+		if depth > 0 && pool.idle > 0 {
+			context.cond.Signal()
+		}
+		context.mutex.Unlock()
+	}
+}
+
+// adaptiveConsumer processes requests from the queue until the queue is
+// drained after DONE, or until the supervisor retires it
+func adaptiveConsumer(config Config, context *SharedContext, pool *consumerPool, i int) {
+	defer context.group.Done()
+	times := config.Metrics.consumer(i)
+	for {
+		context.mutex.Lock()
+		for context.queue.Len() == 0 && !context.done && pool.retiring == 0 {
+			pool.idle++
+			idle := time.Now()
+			context.cond.Wait()
+			times.addIdle(idle)
+			pool.idle--
+		}
+		if context.queue.Len() == 0 {
+			pool.active--
+			if context.done {
+				// The queue is drained and the producer has seen DONE
+				context.mutex.Unlock()
+				return
+			}
+			pool.retiring--
+			pool.logf("scale down: %v -> %v consumers (consumer %v retired after %v idle)",
+				pool.active+1, pool.active, i, pool.settings.IdleTimeout)
+			context.mutex.Unlock()
+			return
+		}
+
+		// Get the next request from the queue
+		request := taskOf(context.queue.Dequeue())
+		request.Span.Take(i)
+		context.notFull.Signal()
+		context.mutex.Unlock()
+		reportQueueDepth(config, context)
+
+		// Track the longest wait for the supervisor
+		wait := int64(time.Since(request.Enqueued))
+		for {
+			current := atomic.LoadInt64(&pool.maxWait)
+			if wait <= current || atomic.CompareAndSwapInt64(&pool.maxWait, current, wait) {
+				break
+			}
+		}
+
+		// Process the request
+		busy := time.Now()
+		processRequest(config, *context.feed, *request)
+		times.addBusy(busy)
+	}
+}
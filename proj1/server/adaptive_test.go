@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveScaling(t *testing.T) {
+	input, inputWriter := io.Pipe()
+	output := newGatedWriter()
+	scaledUp, scaledDown := "scale up: 1 -> ", "scale down: 2 -> 1 consumers"
+	logs := newLogWatcher(scaledUp, scaledDown)
+	config := Config{
+		Encoder:        json.NewEncoder(output),
+		Decoder:        json.NewDecoder(input),
+		Mode:           "a",
+		FeedImpl:       testFeed,
+		ConsumersCount: 8,
+		Scaling: ScalingConfig{
+			MinConsumers: 1,
+			Interval:     time.Millisecond,
+			IdleTimeout:  5 * time.Millisecond,
+			Logger:       log.New(logs, "", 0),
+		},
+	}
+	result := runAsync(config)
+
+	// A backlog builds up while the output is blocked
+	tasks := 500
+	go io.WriteString(inputWriter, addRequests(tasks))
+	logs.wait(t, scaledUp)
+	close(output.open)
+	// Then the consumers sit idle until they are retired
+	logs.wait(t, scaledDown)
+	io.WriteString(inputWriter, "{\"command\": \"DONE\"}\n")
+
+	if err := waitResult(t, result); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if got := len(output.responses(t)); got != tasks {
+		t.Errorf("Expected %v responses, got %v", tasks, got)
+	}
+	decisions := logs.String()
+	if strings.Contains(decisions, "-> 9 consumers") {
+		t.Errorf("Expected at most 8 consumers, got\n%v", decisions)
+	}
+}
+
+func TestAdaptiveFixedBounds(t *testing.T) {
+	// With MinConsumers == MaxConsumers the pool never changes
+	var output syncBuffer
+	var logs syncBuffer
+	config := Config{
+		Encoder:  json.NewEncoder(&output),
+		Decoder:  json.NewDecoder(strings.NewReader(addRequests(2000) + "{\"command\": \"DONE\"}\n")),
+		Mode:     "a",
+		FeedImpl: testFeed,
+		Scaling: ScalingConfig{
+			MinConsumers: 3,
+			MaxConsumers: 3,
+			Interval:     time.Millisecond,
+			Logger:       log.New(&logs, "", 0),
+		},
+	}
+	if err := waitResult(t, runAsync(config)); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if got := bytes.Count(output.Bytes(), []byte("\n")); got != 2000 {
+		t.Errorf("Expected 2000 responses, got %v", got)
+	}
+	if logs.buffer.Len() != 0 {
+		t.Errorf("Expected no scaling decisions, got\n%v", string(logs.Bytes()))
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"proj1/record"
+	"sort"
+	"strings"
+)
+
+// maxSearchSteps bounds the search for a serialization of the operations on
+// one post, beyond it the responses are reported as unexplained
+const maxSearchSteps = 1 << 20
+
+// Violation is a request whose response no valid serialization explains
+type Violation struct {
+	Entry  *record.Entry
+	Reason string
+}
+
+// Verify runs the server on the input of the configuration ("p" mode unless
+// another one is given) while recording it, and checks the run with Check
+func Verify(config Config) ([]Violation, error) {
+	if config.Mode == "" {
+		config.Mode = "p"
+	}
+	recorder := record.NewRecorder(nil, true)
+	config.Recorder = recorder
+	if err := Run(config); err != nil {
+		return nil, err
+	}
+	return Check(recorder.Entries()), nil
+}
+
+// Check proves that the requests of a recording were executed correctly: it
+// replays the order of their linearization points through a sequential
+// reference feed and, for the responses the replay disagrees with, searches
+// for any order of the feed operations that respects their real-time order
+// (an operation that returned before another one started comes first) and
+// explains every response. Operations on different posts commute, so the
+// search is done post by post, with every FEED observing each post at some
+// point of its interval. It returns the requests that were never answered
+// and the ones whose response no order explains, in arrival order.
+func Check(entries []*record.Entry) []Violation {
+	var violations []Violation
+	for _, entry := range entries {
+		if !entry.Finished && entry.Request != nil && validRequest(task{Message: entry.Request}) {
+			violations = append(violations, Violation{entry, "never answered"})
+		}
+	}
+
+	// Replay the recorded order through the reference feed and keep the
+	// posts on which the replay disagrees with a response
+	executed := feedOperations(entries)
+	reference := make(map[float64]string)
+	suspects := make(map[float64][]*record.Entry)
+	for _, entry := range executed {
+		for _, timestamp := range disagreements(reference, entry) {
+			suspects[timestamp] = append(suspects[timestamp], entry)
+		}
+		if !sortedFeed(entry) {
+			violations = append(violations, Violation{entry, "the feed is not ordered by decreasing timestamp"})
+		}
+	}
+
+	// The responses are explained if the operations on the post can be
+	// serialized some other way
+	unexplained := make(map[*record.Entry][]unserializedPost)
+	for timestamp, disagreeing := range suspects {
+		if explained, complete := serializable(executed, timestamp); !explained {
+			for _, entry := range disagreeing {
+				unexplained[entry] = append(unexplained[entry], unserializedPost{timestamp, complete})
+			}
+		}
+	}
+	for entry, posts := range unexplained {
+		violations = append(violations, Violation{entry, unexplainedReason(posts)})
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Entry.Arrival < violations[j].Entry.Arrival
+	})
+	return violations
+}
+
+// unserializedPost is a post whose operations could not be serialized
+type unserializedPost struct {
+	timestamp float64
+	complete  bool // Whether the search was exhaustive
+}
+
+// unexplainedReason describes the posts whose operations cannot be serialized
+func unexplainedReason(unserialized []unserializedPost) string {
+	sort.Slice(unserialized, func(i, j int) bool {
+		return unserialized[i].timestamp > unserialized[j].timestamp
+	})
+	var posts, undecided []string
+	for _, post := range unserialized {
+		if post.complete {
+			posts = append(posts, fmt.Sprint(post.timestamp))
+		} else {
+			undecided = append(undecided, fmt.Sprint(post.timestamp))
+		}
+	}
+	var reasons []string
+	if len(posts) > 0 {
+		reasons = append(reasons, "no serialization explains the response for the posts at "+strings.Join(posts, ", "))
+	}
+	if len(undecided) > 0 {
+		reasons = append(reasons, "too many concurrent operations to serialize the posts at "+strings.Join(undecided, ", "))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// feedOperations returns the entries that were answered after running
+// against the feed, in the order of their linearization points
+func feedOperations(entries []*record.Entry) []*record.Entry {
+	var executed []*record.Entry
+	for _, entry := range record.Linearization(entries) {
+		// Errors such as TIMEOUT mean the operation did not change the feed
+		if entry.Finished && entry.Response != nil && entry.Response["error"] == nil {
+			executed = append(executed, entry)
+		}
+	}
+	return executed
+}
+
+// disagreements applies an operation to the reference feed and returns the
+// timestamps of the posts on which its response disagrees with it
+func disagreements(reference map[float64]string, entry *record.Entry) []float64 {
+	timestamp, _ := entry.Request["timestamp"].(float64)
+	success := entry.Response["success"]
+	switch entry.Request["command"] {
+	case "ADD":
+		body, _ := entry.Request["body"].(string)
+		reference[timestamp] = body
+		if success != true {
+			return []float64{timestamp}
+		}
+	case "REMOVE":
+		_, present := reference[timestamp]
+		delete(reference, timestamp)
+		if success != present {
+			return []float64{timestamp}
+		}
+	case "CONTAINS":
+		if _, present := reference[timestamp]; success != present {
+			return []float64{timestamp}
+		}
+	case "FEED":
+		var differing []float64
+		shown := feedPosts(entry)
+		for timestamp, body := range shown {
+			if expected, present := reference[timestamp]; !present || expected != body {
+				differing = append(differing, timestamp)
+			}
+		}
+		for timestamp := range reference {
+			if _, ok := shown[timestamp]; !ok {
+				differing = append(differing, timestamp)
+			}
+		}
+		return differing
+	}
+	return nil
+}
+
+// feedPosts returns the body of every post of a FEED response by timestamp
+func feedPosts(entry *record.Entry) map[float64]string {
+	posts := make(map[float64]string)
+	feed, _ := entry.Response["feed"].([]interface{})
+	for _, element := range feed {
+		post, _ := element.(map[string]interface{})
+		timestamp, _ := post["timestamp"].(float64)
+		body, _ := post["body"].(string)
+		posts[timestamp] = body
+	}
+	return posts
+}
+
+// sortedFeed checks that a FEED response lists the most recent post first
+func sortedFeed(entry *record.Entry) bool {
+	feed, _ := entry.Response["feed"].([]interface{})
+	for i := 1; i < len(feed); i++ {
+		previous, _ := feed[i-1].(map[string]interface{})
+		current, _ := feed[i].(map[string]interface{})
+		if previous["timestamp"].(float64) <= current["timestamp"].(float64) {
+			return false
+		}
+	}
+	return true
+}
+
+// postState is the state of one post in the reference feed
+type postState struct {
+	present bool
+	body    string
+}
+
+// postOperation is the effect of a request on one post
+type postOperation struct {
+	entry    *record.Entry
+	command  string
+	body     string    // Body added, or shown by a FEED
+	expected bool      // Response of REMOVE and CONTAINS, presence in a FEED
+	interval [2]uint64 // Invoked and linearized
+}
+
+// apply runs an operation on the state of the post and tells whether the
+// response of the operation agrees with it
+func (operation postOperation) apply(state postState) (postState, bool) {
+	switch operation.command {
+	case "ADD":
+		return postState{true, operation.body}, operation.expected
+	case "REMOVE":
+		return postState{}, operation.expected == state.present
+	case "CONTAINS":
+		return state, operation.expected == state.present
+	}
+	// A FEED shows the post with its body or not at all
+	return state, operation.expected == state.present && (!state.present || operation.body == state.body)
+}
+
+// postOperations returns the operations of the executed entries on the post
+// at a timestamp, sorted by invocation
+func postOperations(executed []*record.Entry, timestamp float64) []postOperation {
+	var operations []postOperation
+	for _, entry := range executed {
+		operation := postOperation{entry: entry, interval: [2]uint64{entry.Invoked, entry.Linearized}}
+		operation.command, _ = entry.Request["command"].(string)
+		switch operation.command {
+		case "ADD", "REMOVE", "CONTAINS":
+			if entry.Request["timestamp"] != timestamp {
+				continue
+			}
+			operation.body, _ = entry.Request["body"].(string)
+			operation.expected = entry.Response["success"] == true
+		case "FEED":
+			operation.body, operation.expected = feedPosts(entry)[timestamp]
+		default:
+			continue
+		}
+		operations = append(operations, operation)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].interval[0] < operations[j].interval[0]
+	})
+	return operations
+}
+
+// serializable searches for an order of the operations on a post that
+// respects their real-time order and agrees with every response, starting
+// from a post that is not in the feed. It returns whether one was found and
+// whether the search completed within maxSearchSteps.
+func serializable(executed []*record.Entry, timestamp float64) (bool, bool) {
+	operations := postOperations(executed, timestamp)
+	done := make([]bool, len(operations))
+	failed := make(map[string]bool) // Sets of serialized operations and states already explored
+	steps := 0
+	var search func(state postState, count int) bool
+	search = func(state postState, count int) bool {
+		if count == len(operations) {
+			return true
+		}
+		steps++
+		if steps > maxSearchSteps {
+			return false
+		}
+		key := searchKey(done, state)
+		if failed[key] {
+			return false
+		}
+		// An operation can come next if it started before every pending
+		// operation returned
+		firstReturn := ^uint64(0)
+		for i, operation := range operations {
+			if !done[i] && operation.interval[1] < firstReturn {
+				firstReturn = operation.interval[1]
+			}
+		}
+		for i, operation := range operations {
+			if operation.interval[0] > firstReturn {
+				break
+			}
+			if done[i] {
+				continue
+			}
+			if next, ok := operation.apply(state); ok {
+				done[i] = true
+				if search(next, count+1) {
+					return true
+				}
+				done[i] = false
+			}
+		}
+		failed[key] = true
+		return false
+	}
+	found := search(postState{}, 0)
+	return found, steps <= maxSearchSteps
+}
+
+// searchKey identifies a set of serialized operations and the state they
+// left the post in
+func searchKey(done []bool, state postState) string {
+	var key strings.Builder
+	bits := byte(0)
+	for i, serialized := range done {
+		if serialized {
+			bits |= 1 << uint(i%8)
+		}
+		if i%8 == 7 || i == len(done)-1 {
+			key.WriteByte(bits)
+			bits = 0
+		}
+	}
+	if state.present {
+		key.WriteString("+" + state.body)
+	}
+	return key.String()
+}
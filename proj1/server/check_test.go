@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"proj1/record"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	var builder strings.Builder
+	builder.WriteString(orderedRequests(200))
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&builder, "{\"command\": \"ADD\", \"id\": %v, \"body\": \"%v\", \"timestamp\": %v}\n", 1000+2*i, i, i%10)
+		fmt.Fprintf(&builder, "{\"command\": \"FEED\", \"id\": %v}\n", 1001+2*i)
+	}
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		config := Config{
+			Encoder:        json.NewEncoder(&syncBuffer{}),
+			Decoder:        json.NewDecoder(strings.NewReader(builder.String())),
+			Mode:           mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 4,
+		}
+		violations, err := Verify(config)
+		if err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+		for _, violation := range violations {
+			t.Errorf("%v: %v answered %v: %v", mode, violation.Entry.Request, violation.Entry.Response, violation.Reason)
+		}
+	}
+}
+
+// checkEntry creates the entry of a request executed between two points of
+// the feed clock
+func checkEntry(t *testing.T, arrival, invoked, linearized uint64, request, response string) *record.Entry {
+	entry := &record.Entry{Arrival: arrival, Invoked: invoked, Linearized: linearized, Finished: response != ""}
+	if err := json.Unmarshal([]byte(request), &entry.Request); err != nil {
+		t.Fatal(err)
+	}
+	if response != "" {
+		if err := json.Unmarshal([]byte(response), &entry.Response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return entry
+}
+
+func TestCheck(t *testing.T) {
+	const (
+		add      = `{"command": "ADD", "id": 1, "body": "a", "timestamp": 1}`
+		contains = `{"command": "CONTAINS", "id": 2, "timestamp": 1}`
+		remove   = `{"command": "REMOVE", "id": 3, "timestamp": 1}`
+		feed     = `{"command": "FEED", "id": 4}`
+		found    = `{"id": 2, "success": true}`
+		missing  = `{"id": 2, "success": false}`
+	)
+	var tests = []struct {
+		name      string
+		entries   func(t *testing.T) []*record.Entry
+		violating []uint64 // Arrival of the reported requests
+	}{
+		{"sequential", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 3, 4, contains, found),
+				checkEntry(t, 3, 5, 6, feed, `{"id": 4, "feed": [{"body": "a", "timestamp": 1}]}`),
+			}
+		}, nil},
+		{"concurrent contains before the add", func(t *testing.T) []*record.Entry {
+			// The CONTAINS returned after the ADD but can be serialized first
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 3, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 2, 4, contains, missing),
+			}
+		}, nil},
+		{"contains after the add", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 3, 4, contains, missing),
+			}
+		}, []uint64{2}},
+		{"remove of a missing post", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, remove, `{"id": 3, "success": true}`),
+			}
+		}, []uint64{1}},
+		{"feed missing a post", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 3, 4, feed, `{"id": 4, "feed": []}`),
+			}
+		}, []uint64{2}},
+		{"feed out of order", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 3, 4, strings.Replace(add, "1}", "2}", 1), `{"id": 1, "success": true}`),
+				checkEntry(t, 3, 5, 6, feed, `{"id": 4, "feed": [{"body": "a", "timestamp": 1}, {"body": "a", "timestamp": 2}]}`),
+			}
+		}, []uint64{3}},
+		{"never answered", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 0, 0, contains, ""),
+				checkEntry(t, 3, 0, 0, `{"command": "LIKE", "id": 5}`, ""),
+			}
+		}, []uint64{2}},
+		{"timed out", func(t *testing.T) []*record.Entry {
+			return []*record.Entry{
+				checkEntry(t, 1, 1, 2, add, `{"id": 1, "success": true}`),
+				checkEntry(t, 2, 3, 4, feed, `{"id": 4, "error": "TIMEOUT"}`),
+			}
+		}, nil},
+	}
+	for _, test := range tests {
+		violations := Check(test.entries(t))
+		var violating []uint64
+		for _, violation := range violations {
+			if violation.Reason == "" {
+				t.Errorf("%v: expected the reason of %+v", test.name, violation.Entry)
+			}
+			violating = append(violating, violation.Entry.Arrival)
+		}
+		if fmt.Sprint(violating) != fmt.Sprint(test.violating) {
+			t.Errorf("%v: expected the requests %v to be reported, got %+v", test.name, test.violating, violations)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"proj1/queue"
+	"time"
+)
+
+// withDeadline sets the deadline of a request received at the given time from
+// its optional "timeout_ms" (relative to the reception) and "deadline_ms"
+// (Unix time in milliseconds) fields. The earliest of the two applies.
+func withDeadline(request task, received time.Time) task {
+	if timeout, ok := request.Message["timeout_ms"].(float64); ok {
+		request.Deadline = received.Add(time.Duration(timeout * float64(time.Millisecond)))
+	}
+	if deadline, ok := request.Message["deadline_ms"].(float64); ok {
+		absolute := time.Unix(0, int64(deadline*float64(time.Millisecond)))
+		if request.Deadline.IsZero() || absolute.Before(request.Deadline) {
+			request.Deadline = absolute
+		}
+	}
+	return request
+}
+
+// expired checks whether the client has given up on a request
+func expired(request task) bool {
+	return !request.Deadline.IsZero() && !time.Now().Before(request.Deadline)
+}
+
+// queueWait returns how long a request waited between being queued and
+// being picked up (zero for the versions without a queue)
+func queueWait(request task) time.Duration {
+	if request.Enqueued.IsZero() {
+		return 0
+	}
+	return time.Since(request.Enqueued)
+}
+
+// reportQueueWait passes the queue wait of a request to the OnQueueWait hook
+func reportQueueWait(config Config, request task, wait time.Duration) {
+	if config.OnQueueWait != nil {
+		config.OnQueueWait(request.Message["id"], wait)
+	}
+}
+
+// timeoutResponse answers a request whose deadline passed with a TIMEOUT
+// error and the time it spent in the queue
+func timeoutResponse(request task, wait time.Duration) queue.Request {
+	response := errorMessage(request, ErrorTimeout)
+	response["queue_wait_ms"] = float64(wait) / float64(time.Millisecond)
+	return queue.Request{Message: response}
+}
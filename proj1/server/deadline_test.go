@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeadlineExpiresInQueue(t *testing.T) {
+	for _, mode := range []string{"p", "ws", "a"} {
+		t.Run(mode, func(t *testing.T) {
+			input, inputWriter := io.Pipe()
+			output := newGatedWriter()
+			var mutex sync.Mutex
+			waits := make(map[interface{}]time.Duration)
+			config := Config{
+				Encoder:        json.NewEncoder(output),
+				Decoder:        json.NewDecoder(input),
+				Mode:           mode,
+				FeedImpl:       testFeed,
+				ConsumersCount: 1,
+				OnQueueWait: func(id interface{}, wait time.Duration) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					waits[id] = wait
+				},
+			}
+			result := runAsync(config)
+
+			// The single consumer blocks on the first response while the rest is queued
+			io.WriteString(inputWriter, "{\"command\": \"ADD\", \"id\": 0, \"body\": \"0\", \"timestamp\": 0}\n")
+			time.Sleep(50 * time.Millisecond)
+			past := float64(time.Now().Add(-time.Second).UnixNano()) / float64(time.Millisecond)
+			requests := []string{
+				"{\"command\": \"CONTAINS\", \"id\": 1, \"timestamp\": 0, \"timeout_ms\": 20}",
+				"{\"command\": \"FEED\", \"id\": 2, \"timeout_ms\": 20}",
+				"{\"command\": \"CONTAINS\", \"id\": 3, \"timestamp\": 0, \"timeout_ms\": 60000}",
+				"{\"command\": \"CONTAINS\", \"id\": 4, \"timestamp\": 0}",
+				fmt.Sprintf("{\"command\": \"CONTAINS\", \"id\": 5, \"timestamp\": 0, \"timeout_ms\": 60000, \"deadline_ms\": %f}", past),
+				"{\"command\": \"DONE\"}",
+			}
+			go io.WriteString(inputWriter, strings.Join(requests, "\n")+"\n")
+			time.Sleep(100 * time.Millisecond)
+			close(output.open)
+
+			if err := waitResult(t, result); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+			timedOut := map[float64]bool{1: true, 2: true, 5: true}
+			responses := output.responses(t)
+			if len(responses) != 6 {
+				t.Fatalf("Expected 6 responses, got %v", len(responses))
+			}
+			for _, response := range responses {
+				id := response["id"].(float64)
+				if timedOut[id] {
+					if response["error"] != ErrorTimeout || response["success"] != false {
+						t.Errorf("Expected a %v error for request %v, got %v", ErrorTimeout, id, response)
+					}
+					if wait, ok := response["queue_wait_ms"].(float64); !ok || wait < 50 {
+						t.Errorf("Expected the queue wait of request %v, got %v", id, response)
+					}
+				} else if _, ok := response["error"]; ok {
+					t.Errorf("Expected request %v to be executed, got %v", id, response)
+				}
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(waits) != 6 || waits[4.0] < 50*time.Millisecond {
+				t.Errorf("Expected the queue wait of every request, got %v", waits)
+			}
+		})
+	}
+}
+
+func TestDeadlinePassed(t *testing.T) {
+	past := float64(time.Now().Add(-time.Second).UnixNano()) / float64(time.Millisecond)
+	input := fmt.Sprintf("{\"command\": \"ADD\", \"id\": 1, \"body\": \"1\", \"timestamp\": 1, \"deadline_ms\": %f}\n"+
+		"{\"command\": \"CONTAINS\", \"id\": 2, \"timestamp\": 1, \"timeout_ms\": 60000}\n", past)
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		var output syncBuffer
+		config := Config{
+			Encoder:        json.NewEncoder(&output),
+			Decoder:        json.NewDecoder(strings.NewReader(input)),
+			Mode:           mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 1,
+		}
+		if err := Run(config); err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+		expected := "{\"error\":\"TIMEOUT\",\"id\":1,\"queue_wait_ms\":"
+		if !strings.HasPrefix(string(output.Bytes()), expected) {
+			t.Errorf("%v: expected the ADD to time out, got %v", mode, string(output.Bytes()))
+		}
+		// The expired ADD was not executed
+		if !strings.Contains(string(output.Bytes()), "{\"id\":2,\"success\":false}") {
+			t.Errorf("%v: expected the CONTAINS to find nothing, got %v", mode, string(output.Bytes()))
+		}
+	}
+}
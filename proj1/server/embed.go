@@ -0,0 +1,396 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"proj1/queue"
+	"proj1/trace"
+	"sync"
+	"time"
+)
+
+// Errors returned by the methods of a Server
+var (
+	ErrNoInput        = errors.New("server: no Reader or Decoder to read the requests from")
+	ErrStarted        = errors.New("server: already started")
+	ErrNotStarted     = errors.New("server: not started")
+	ErrServerClosed   = errors.New("server: shut down")
+	ErrStreamInput    = errors.New("server: requests are read from the configured input, they cannot be submitted")
+	ErrInvalidRequest = errors.New("server: invalid request")
+	ErrNoPriorities   = errors.New("server: the ws version cannot serve the requests by priority, use the p or a version")
+)
+
+// Request is a request submitted to a Server. Only the fields used by the
+// command are read.
+type Request struct {
+	Command        string        // ADD, REMOVE, CONTAINS, FEED, STATS or QUOTA
+	Body           string        // Body of the post to ADD
+	Timestamp      float64       // Timestamp of the post (not used by FEED)
+	Client         string        // Client of the rate limits, the one QUOTA reports ("" = anonymous, or every client for QUOTA)
+	IdempotencyKey string        // Key making retries of ADD and REMOVE safe ("" = none)
+	Priority       string        // Priority level: high, normal, low or 0 to 2 ("" = the default of the command)
+	Timeout        time.Duration // Answer with a TIMEOUT error if the request is not executed in time (0 = only the deadline of the context)
+}
+
+// Response is the response to a request executed by a Server
+type Response struct {
+	Success bool                   // Result of ADD, REMOVE and CONTAINS
+	Feed    []Post                 // Posts of FEED, the most recent first
+	Stats   map[string]interface{} // Metrics returned by STATS
+	Quota   map[string]interface{} // Rate limit usage returned by QUOTA
+}
+
+// Post is a post of the feed
+type Post struct {
+	Body      string
+	Timestamp float64
+}
+
+// ResponseError is the error returned for a request the server answered
+// with an error code instead of executing it
+type ResponseError struct {
+	Code       string        // ErrorOverloaded, ErrorTimeout or ErrorRateLimited
+	RetryAfter time.Duration // When a RATE_LIMITED request can be retried
+}
+
+func (err *ResponseError) Error() string {
+	return fmt.Sprintf("server: request not executed: %v", err.Code)
+}
+
+// Server is a twitter server that can be embedded in another program. A
+// server configured with a Reader or a Decoder serves the requests read from
+// them like Run. Otherwise requests are submitted in-process with Submit and
+// their responses are returned to the caller, the Encoder and Writer of the
+// configuration are not used.
+type Server struct {
+	config  Config
+	signals chan os.Signal              // Shutdown signals of the version
+	input   chan map[string]interface{} // Submitted requests (nil = read from the configuration)
+	closing chan struct{}               // Closed once the server stops accepting requests
+	done    chan struct{}               // Closed once the version returned
+	err     error                       // Error the version returned
+	mutex   sync.Mutex                  // Guards the fields below
+	started bool
+	drained bool                                    // Shutdown was requested
+	sent    int                                     // Signals sent to the version
+	nextID  float64                                 // Id of the last submitted request
+	routes  map[float64]chan map[string]interface{} // Waiting Submit calls by request id
+}
+
+// NewServer creates a server of the configuration, it starts with Start
+func NewServer(config Config) *Server {
+	return &Server{
+		config:  config,
+		signals: make(chan os.Signal, 2),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		routes:  make(map[float64]chan map[string]interface{}),
+	}
+}
+
+// Start creates the feed and starts serving requests in the background. The
+// server shuts down like with Shutdown once ctx is done, without a deadline.
+// Shutdown signals of the configuration are forwarded to the server.
+func (server *Server) Start(ctx context.Context) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.started {
+		return ErrStarted
+	}
+	config := server.config
+	if config.Mode == "ws" && config.Priorities.Enabled {
+		// Every consumer serves its own deque in order
+		return ErrNoPriorities
+	}
+	if config.Decoder == nil && config.Reader == nil {
+		server.input = make(chan map[string]interface{})
+		config.Decoder = submissions{server}
+		config.Encoder = responseRouter{server}
+		config.Writer = nil
+	}
+	config = withProtocol(config)
+	var output *outputStage
+	if config.Writer != nil {
+		output = newOutputStage(config.Writer, config.Protocol, config.Output)
+		config.Writer, config.Encoder = output, output
+	} else if server.input == nil {
+		config.Encoder = &lockedEncoder{encoder: config.Encoder}
+	}
+	if config.Recorder != nil && config.Tracer == nil {
+		// The spans tell which consumer executed each request
+		config.Tracer = trace.NewTracer(nil, false)
+	}
+	// Get the twitter feed and the queue selected by the configuration
+	feed, err := newFeed(config)
+	if err != nil {
+		return err
+	}
+	newQueue, err := queue.Lookup(config.QueueImpl)
+	if err != nil {
+		return err
+	}
+	signals := config.Shutdown
+	config.Shutdown = server.signals
+	server.started = true
+
+	go func() {
+		server.err = runVersion(config, feed, newQueue)
+		// Write the responses still buffered before the server is done
+		if err := output.close(); server.err == nil {
+			server.err = err
+		}
+		close(server.done)
+	}()
+	go func() {
+		for {
+			select {
+			case signal := <-signals:
+				server.signal(signal)
+			case <-ctx.Done():
+				server.drain()
+				// Keep forwarding the signals, they can still force the shutdown
+				ctx = context.Background()
+			case <-server.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Submit executes a request and returns its response, or a ResponseError if
+// the server answered with an error code. The deadline of ctx is also the
+// deadline of the request: once ctx is done, Submit returns its error and the
+// request is not executed if it is still queued. Submit returns
+// ErrInvalidRequest for an unknown command and ErrServerClosed once the
+// server is shutting down.
+func (server *Server) Submit(ctx context.Context, request Request) (Response, error) {
+	message, err := request.Message(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	server.mutex.Lock()
+	if !server.started || server.input == nil {
+		server.mutex.Unlock()
+		if server.input == nil && server.started {
+			return Response{}, ErrStreamInput
+		}
+		return Response{}, ErrNotStarted
+	}
+	server.nextID++
+	id := server.nextID
+	reply := make(chan map[string]interface{}, 1)
+	server.routes[id] = reply
+	server.mutex.Unlock()
+	message["id"] = id
+
+	select {
+	case server.input <- message:
+	case <-server.closing:
+		server.forget(id)
+		return Response{}, ErrServerClosed
+	case <-ctx.Done():
+		server.forget(id)
+		return Response{}, ctx.Err()
+	}
+	select {
+	case response := <-reply:
+		return ResponseOf(response)
+	case <-ctx.Done():
+		server.forget(id)
+		return Response{}, ctx.Err()
+	case <-server.done:
+		// The response may have been routed as the server stopped
+		select {
+		case response := <-reply:
+			return ResponseOf(response)
+		default:
+			server.forget(id)
+			return Response{}, ErrServerClosed
+		}
+	}
+}
+
+// Shutdown stops accepting requests and waits until the accepted ones are
+// answered. If ctx is done first, the shutdown is forced, the requests still
+// queued are abandoned and the error of ctx is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mutex.Lock()
+	started := server.started
+	server.mutex.Unlock()
+	if !started {
+		return ErrNotStarted
+	}
+	server.drain()
+	select {
+	case <-server.done:
+	case <-ctx.Done():
+		server.force()
+		<-server.done
+		return ctx.Err()
+	}
+	if server.err == ErrInterrupted {
+		// Requested by the caller
+		return nil
+	}
+	return server.err
+}
+
+// Wait blocks until the server stopped and returns the error it stopped with
+// (see Run)
+func (server *Server) Wait() error {
+	server.mutex.Lock()
+	started := server.started
+	server.mutex.Unlock()
+	if !started {
+		return ErrNotStarted
+	}
+	<-server.done
+	return server.err
+}
+
+// drain stops accepting requests: the submissions end, or the version is
+// interrupted if it reads its input from the configuration
+func (server *Server) drain() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.drained {
+		return
+	}
+	server.drained = true
+	close(server.closing)
+	if server.input == nil {
+		server.sendLocked(os.Interrupt)
+	}
+}
+
+// force sends the version the signals that force its shutdown
+func (server *Server) force() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for server.sent < cap(server.signals) {
+		server.sendLocked(os.Interrupt)
+	}
+}
+
+// signal forwards a shutdown signal of the configuration
+func (server *Server) signal(signal os.Signal) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.sendLocked(signal)
+}
+
+// sendLocked sends a signal to the version unless its shutdown is already
+// forced, it must be called with the mutex held
+func (server *Server) sendLocked(signal os.Signal) {
+	if server.sent < cap(server.signals) {
+		server.signals <- signal
+		server.sent++
+	}
+}
+
+// forget removes the route of a request that is no longer waited for
+func (server *Server) forget(id float64) {
+	server.mutex.Lock()
+	delete(server.routes, id)
+	server.mutex.Unlock()
+}
+
+// Message converts a request to the message the versions execute, with the
+// deadline of ctx
+func (request Request) Message(ctx context.Context) (map[string]interface{}, error) {
+	message := map[string]interface{}{"command": request.Command, "id": 0.0}
+	switch request.Command {
+	case "ADD":
+		message["body"] = request.Body
+		message["timestamp"] = request.Timestamp
+	case "REMOVE", "CONTAINS":
+		message["timestamp"] = request.Timestamp
+	case "FEED", "STATS", "QUOTA":
+	default:
+		return nil, ErrInvalidRequest
+	}
+	if request.Client != "" {
+		message["client"] = request.Client
+	}
+	if request.IdempotencyKey != "" {
+		message["idempotency_key"] = request.IdempotencyKey
+	}
+	if request.Priority != "" {
+		message["priority"] = request.Priority
+	}
+	if request.Timeout > 0 {
+		message["timeout_ms"] = float64(request.Timeout) / float64(time.Millisecond)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		message["deadline_ms"] = float64(deadline.UnixNano()) / float64(time.Millisecond)
+	}
+	return message, nil
+}
+
+// ResponseOf converts the message answering a request to its response, or to
+// a ResponseError if the server answered with an error code
+func ResponseOf(message map[string]interface{}) (Response, error) {
+	if code, ok := message["error"].(string); ok {
+		err := &ResponseError{Code: code}
+		if retryAfter, ok := message["retry_after_ms"].(float64); ok {
+			err.RetryAfter = time.Duration(retryAfter * float64(time.Millisecond))
+		}
+		return Response{}, err
+	}
+	var response Response
+	response.Success, _ = message["success"].(bool)
+	response.Stats, _ = message["stats"].(map[string]interface{})
+	response.Quota, _ = message["quota"].(map[string]interface{})
+	if posts, ok := message["feed"].([]interface{}); ok {
+		response.Feed = make([]Post, 0, len(posts))
+		for _, element := range posts {
+			post, _ := element.(map[string]interface{})
+			body, _ := post["body"].(string)
+			timestamp, _ := post["timestamp"].(float64)
+			response.Feed = append(response.Feed, Post{body, timestamp})
+		}
+	}
+	return response, nil
+}
+
+// submissions is the Decoder of the submitted requests, it ends once the
+// server stops accepting them
+type submissions struct {
+	server *Server
+}
+
+func (input submissions) Decode(v interface{}) error {
+	select {
+	case message := <-input.server.input:
+		*v.(*map[string]interface{}) = message
+		return nil
+	case <-input.server.closing:
+		return io.EOF
+	}
+}
+
+// responseRouter is the Encoder returning the responses to the Submit calls
+// waiting for them
+type responseRouter struct {
+	server *Server
+}
+
+func (router responseRouter) Encode(v interface{}) error {
+	response, err := responseMessage(v)
+	if err != nil {
+		return err
+	}
+	id, _ := response["id"].(float64)
+	router.server.mutex.Lock()
+	reply := router.server.routes[id]
+	delete(router.server.routes, id)
+	router.server.mutex.Unlock()
+	if reply != nil {
+		reply <- response
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerSubmit(t *testing.T) {
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		server := NewServer(Config{Mode: mode, ConsumersCount: 4, Metrics: NewMetrics(), FeedImpl: testFeed})
+		ctx := context.Background()
+		if err := server.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Start(ctx); err != ErrStarted {
+			t.Errorf("%v: expected the second start to fail, got %v", mode, err)
+		}
+
+		var tests = []struct {
+			request  Request
+			expected Response
+		}{
+			{Request{Command: "ADD", Body: "a", Timestamp: 1}, Response{Success: true}},
+			{Request{Command: "ADD", Body: "b", Timestamp: 2}, Response{Success: true}},
+			{Request{Command: "CONTAINS", Timestamp: 1}, Response{Success: true}},
+			{Request{Command: "FEED"}, Response{Feed: []Post{{"b", 2}, {"a", 1}}}},
+			{Request{Command: "REMOVE", Timestamp: 1, IdempotencyKey: "remove"}, Response{Success: true}},
+			{Request{Command: "REMOVE", Timestamp: 1}, Response{Success: false}},
+			{Request{Command: "CONTAINS", Timestamp: 1}, Response{Success: false}},
+		}
+		for _, test := range tests {
+			response, err := server.Submit(ctx, test.request)
+			if err != nil || response.Success != test.expected.Success || len(response.Feed) != len(test.expected.Feed) {
+				t.Errorf("%v: expected %+v for %+v, got %+v (%v)", mode, test.expected, test.request, response, err)
+				continue
+			}
+			for i, post := range test.expected.Feed {
+				if response.Feed[i] != post {
+					t.Errorf("%v: expected %+v, got %+v", mode, test.expected.Feed, response.Feed)
+				}
+			}
+		}
+		if response, err := server.Submit(ctx, Request{Command: "STATS"}); err != nil || response.Stats["requests"] == nil {
+			t.Errorf("%v: expected the metrics, got %+v (%v)", mode, response, err)
+		}
+		if _, err := server.Submit(ctx, Request{Command: "LIKE"}); err != ErrInvalidRequest {
+			t.Errorf("%v: expected an invalid request, got %v", mode, err)
+		}
+
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+		if _, err := server.Submit(ctx, Request{Command: "FEED"}); err != ErrServerClosed {
+			t.Errorf("%v: expected the server to be closed, got %v", mode, err)
+		}
+	}
+}
+
+func TestServerConcurrentSubmit(t *testing.T) {
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		server := NewServer(Config{Mode: mode, ConsumersCount: 4, FeedImpl: testFeed})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := server.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		clients, posts := 8, 100
+		var group sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			group.Add(1)
+			go func(i int) {
+				defer group.Done()
+				for j := 0; j < posts; j++ {
+					timestamp := float64(i*posts + j)
+					if response, err := server.Submit(ctx, Request{Command: "ADD", Body: "post", Timestamp: timestamp}); err != nil || !response.Success {
+						t.Errorf("%v: unexpected response %+v (%v)", mode, response, err)
+					}
+				}
+			}(i)
+		}
+		group.Wait()
+		if response, err := server.Submit(ctx, Request{Command: "FEED"}); err != nil || len(response.Feed) != clients*posts {
+			t.Errorf("%v: expected %v posts, got %v (%v)", mode, clients*posts, len(response.Feed), err)
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+		cancel()
+	}
+}
+
+func TestServerDeadlines(t *testing.T) {
+	server := NewServer(Config{Mode: "p", ConsumersCount: 1})
+	if _, err := server.Submit(context.Background(), Request{Command: "FEED"}); err != ErrNotStarted {
+		t.Errorf("Expected the server not to be started, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	if _, err := server.Submit(expired, Request{Command: "FEED"}); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if _, err := server.Submit(context.Background(), Request{Command: "ADD", Body: "a", Timestamp: 1, Timeout: time.Nanosecond}); err == nil || err.(*ResponseError).Code != ErrorTimeout {
+		t.Errorf("Expected a TIMEOUT, got %v", err)
+	}
+
+	// Cancelling the context of Start shuts the server down
+	cancel()
+	if err := server.Wait(); err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if _, err := server.Submit(context.Background(), Request{Command: "FEED"}); err != ErrServerClosed {
+		t.Errorf("Expected the server to be closed, got %v", err)
+	}
+}
+
+func TestServerForcedShutdown(t *testing.T) {
+	server := NewServer(Config{Mode: "p", ConsumersCount: 1})
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Every Submit returns once the shutdown is forced, answered or not
+	var group sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			_, err := server.Submit(context.Background(), Request{Command: "ADD", Body: "a", Timestamp: float64(i)})
+			if err != nil && err != ErrServerClosed {
+				t.Errorf("Unexpected error %v", err)
+			}
+		}(i)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.Shutdown(cancelled); err != context.Canceled {
+		t.Errorf("Expected the shutdown to be forced, got %v", err)
+	}
+	group.Wait()
+}
+
+func TestServerStreamInput(t *testing.T) {
+	var output syncBuffer
+	server := NewServer(Config{
+		Encoder: json.NewEncoder(&output),
+		Decoder: json.NewDecoder(strings.NewReader(addRequests(10))),
+		Mode:    "s",
+	})
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Submit(context.Background(), Request{Command: "FEED"}); err != ErrStreamInput {
+		t.Errorf("Expected requests to be read from the input, got %v", err)
+	}
+	if err := server.Wait(); err != nil || strings.Count(string(output.Bytes()), "\n") != 10 {
+		t.Errorf("Expected 10 responses, got %q (%v)", output.Bytes(), err)
+	}
+	if err := NewServer(Config{FeedImpl: "tree"}).Start(context.Background()); err == nil {
+		t.Errorf("Expected an unknown implementation error")
+	}
+	if err := Run(Config{Mode: "s"}); err != ErrNoInput {
+		t.Errorf("Expected Run to need an input, got %v", err)
+	}
+}
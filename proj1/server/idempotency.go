@@ -0,0 +1,142 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Default bounds of an IdempotencyCache
+const (
+	DefaultIdempotencyKeys = 10000
+	DefaultIdempotencyTTL  = 5 * time.Minute
+)
+
+// IdempotencyCache remembers the responses to the recent ADD and REMOVE
+// requests carrying an "idempotency_key" field, so that a client can retry
+// them safely: a request with the key of an earlier one is not executed
+// again and gets the response of the earlier one, with its own id. Keys are
+// not scoped to a client, they should be unique (e.g. random UUIDs). Every
+// method can be called on a nil *IdempotencyCache, which ignores the keys.
+type IdempotencyCache struct {
+	capacity int           // Maximum number of remembered keys
+	ttl      time.Duration // How long a key is remembered after its first request
+	mutex    sync.Mutex    // Guards the fields below
+	calls    map[string]*idempotentCall
+	order    []*idempotentCall // The calls by creation, so also by expiry
+}
+
+// idempotentCall is the execution of the first request with a key
+type idempotentCall struct {
+	key      string
+	expires  time.Time
+	done     chan struct{}          // Closed once the response is set
+	response map[string]interface{} // Response of the first request
+}
+
+// NewIdempotencyCache creates a cache of at most capacity keys, each one
+// remembered for ttl (0 = the defaults), set it as Config.Idempotency
+func NewIdempotencyCache(capacity int, ttl time.Duration) *IdempotencyCache {
+	if capacity <= 0 {
+		capacity = DefaultIdempotencyKeys
+	}
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &IdempotencyCache{capacity: capacity, ttl: ttl, calls: make(map[string]*idempotentCall)}
+}
+
+// Len returns the number of remembered keys
+func (cache *IdempotencyCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.calls)
+}
+
+// idempotencyKey returns the key of a request, if it is a write with one
+func idempotencyKey(request task) (string, bool) {
+	key, ok := request.Message["idempotency_key"].(string)
+	return key, ok && writeCommands[request.Message["command"].(string)]
+}
+
+// claim returns the call of the key of a request and whether the request is
+// the first one with the key, in which case it must execute and finish it
+func (cache *IdempotencyCache) claim(key string, now time.Time) (*idempotentCall, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for len(cache.order) > 0 && !now.Before(cache.order[0].expires) {
+		cache.forgetOldest()
+	}
+	if call, ok := cache.calls[key]; ok {
+		return call, false
+	}
+	// Make room for the new key
+	for len(cache.order) > 0 && len(cache.calls) >= cache.capacity {
+		cache.forgetOldest()
+	}
+	call := &idempotentCall{key: key, expires: now.Add(cache.ttl), done: make(chan struct{})}
+	cache.calls[key] = call
+	cache.order = append(cache.order, call)
+	return call, true
+}
+
+// forgetOldest removes the oldest call, it must be called with the mutex held
+func (cache *IdempotencyCache) forgetOldest() {
+	cache.forget(cache.order[0])
+	cache.order[0] = nil
+	cache.order = cache.order[1:]
+}
+
+// forget removes the key of a call unless a newer call has it, it must be
+// called with the mutex held
+func (cache *IdempotencyCache) forget(call *idempotentCall) {
+	if cache.calls[call.key] == call {
+		delete(cache.calls, call.key)
+	}
+}
+
+// finish sets the response of a call and wakes up its duplicates. Responses
+// with an error code mean the request was not executed, so the key is
+// forgotten and a retry executes again.
+func (cache *IdempotencyCache) finish(call *idempotentCall, response map[string]interface{}) {
+	if call == nil {
+		return
+	}
+	call.response = response
+	if _, failed := response["error"]; failed {
+		cache.mutex.Lock()
+		cache.forget(call)
+		cache.mutex.Unlock()
+	}
+	close(call.done)
+}
+
+// deduplicate returns the response of the first request with the key of a
+// request, waiting for it if it is still executing. Otherwise the request
+// must be executed and the returned call finished with its response (nil if
+// the request has no key).
+func deduplicate(config Config, request task) (*idempotentCall, map[string]interface{}) {
+	key, ok := idempotencyKey(request)
+	if config.Idempotency == nil || !ok {
+		return nil, nil
+	}
+	for {
+		call, first := config.Idempotency.claim(key, time.Now())
+		if first {
+			return call, nil
+		}
+		<-call.done
+		if _, failed := call.response["error"]; failed {
+			// The first request was not executed, claim the key again
+			continue
+		}
+		response := make(map[string]interface{}, len(call.response))
+		for field, value := range call.response {
+			response[field] = value
+		}
+		response["id"] = request.Message["id"]
+		return nil, response
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"proj1/feed"
+	"proj1/queue"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	input := `{"command": "ADD", "id": 1, "body": "a", "timestamp": 1, "idempotency_key": "add"}
+{"command": "REMOVE", "id": 2, "timestamp": 1, "idempotency_key": "remove"}
+{"command": "REMOVE", "id": 3, "timestamp": 1, "idempotency_key": "remove"}
+{"command": "ADD", "id": 4, "body": "b", "timestamp": 1, "idempotency_key": "add"}
+{"command": "CONTAINS", "id": 5, "timestamp": 1}
+{"command": "REMOVE", "id": 6, "timestamp": 1}
+{"command": "ADD", "id": 7, "body": "c", "timestamp": 2, "idempotency_key": 7}
+{"command": "CONTAINS", "id": 8, "timestamp": 2, "idempotency_key": "contains"}
+`
+	var output bytes.Buffer
+	cache := NewIdempotencyCache(0, 0)
+	config := Config{Encoder: json.NewEncoder(&output), Decoder: json.NewDecoder(strings.NewReader(input)), Mode: "s", Idempotency: cache}
+	if err := Run(config); err != nil {
+		t.Fatal(err)
+	}
+	// The retried REMOVE succeeds and the retried ADD is not executed again
+	expected := `{"id":1,"success":true}
+{"id":2,"success":true}
+{"id":3,"success":true}
+{"id":4,"success":true}
+{"id":5,"success":false}
+{"id":6,"success":false}
+{"id":8,"success":false}
+`
+	if output.String() != expected {
+		t.Errorf("Expected\n%v, got\n%v", expected, output.String())
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected only the keys of the writes to be remembered, got %v", cache.Len())
+	}
+}
+
+func TestIdempotencyConcurrentDuplicates(t *testing.T) {
+	f := feed.NewFeed()
+	f.Add("a", 1)
+	config := Config{Idempotency: NewIdempotencyCache(0, 0)}
+	var group sync.WaitGroup
+	responses := make([]queue.Request, 16)
+	for i := range responses {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			message := map[string]interface{}{"command": "REMOVE", "id": float64(i), "timestamp": 1.0, "idempotency_key": "remove"}
+			responses[i] = executeRequest(config, f, task{Message: message})
+		}(i)
+	}
+	group.Wait()
+	for i, response := range responses {
+		if response.Message["id"] != float64(i) || response.Message["success"] != true {
+			t.Errorf("Expected every copy to get the response of the first one, got %v", response.Message)
+		}
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	cache := NewIdempotencyCache(2, time.Minute)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		call, first := cache.claim(fmt.Sprint(i), now)
+		if !first {
+			t.Fatalf("Expected key %v to be new", i)
+		}
+		cache.finish(call, map[string]interface{}{"success": true})
+	}
+	// The oldest key was forgotten over the capacity
+	if _, first := cache.claim("0", now); !first || cache.Len() != 2 {
+		t.Errorf("Expected the oldest key to be forgotten, %v keys remain", cache.Len())
+	}
+	if _, first := cache.claim("2", now); first {
+		t.Errorf("Expected the recent key to be remembered")
+	}
+	if _, first := cache.claim("2", now.Add(time.Minute)); !first {
+		t.Errorf("Expected the key to expire")
+	}
+
+	// Requests that were not executed can be retried
+	call, _ := cache.claim("timeout", now)
+	cache.finish(call, map[string]interface{}{"success": false, "error": ErrorTimeout})
+	if _, first := cache.claim("timeout", now); !first {
+		t.Errorf("Expected the key of a request that timed out to be forgotten")
+	}
+}
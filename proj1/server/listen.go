@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"proj1/trace"
+	"sync"
+	"time"
+)
+
+// clientWriteTimeout is how long a write to a client may block before the
+// client is disconnected, so a client that stops reading its responses only
+// loses its own connection
+var clientWriteTimeout = 10 * time.Second
+
+// Serve runs the server on the requests of every client connected to the
+// listener instead of a single input stream. Each connection sends requests
+// in the protocol of the configuration and receives the responses to its own
+// requests. The DONE command closes the connection of the client once its
+// requests have been answered, it does not stop the server. Serve returns
+// when a shutdown signal stops the server or the listener fails.
+//
+// The Reader, Decoder, Writer and Encoder of the configuration are replaced.
+// Each connection writes its responses from its own goroutine, so the Output
+// settings are not used. Requests without a "client" field are attributed to
+// the address of their connection for the rate limits.
+func Serve(config Config, listener net.Listener) error {
+	input, inputWriter := io.Pipe()
+	config.Protocol = protocolOf(config)
+	mux := &connMux{
+		input:    inputWriter,
+		protocol: config.Protocol,
+		tracer:   config.Tracer,
+		routes:   make(map[float64]route),
+		conns:    make(map[*clientConn]bool),
+	}
+	config.Reader = input
+	config.Decoder = config.Protocol.NewDecoder(input)
+	config.Writer = nil
+	config.Encoder = mux
+
+	go mux.accept(listener)
+	err := Run(config)
+	// Stop accepting clients and unblock the clients still sending requests
+	listener.Close()
+	input.Close()
+	mux.closeAll()
+	return err
+}
+
+// route is where the response to a request goes back to
+type route struct {
+	conn *clientConn
+	id   float64 // The id the client gave the request
+}
+
+// clientConn is the connection of one client
+type clientConn struct {
+	conn      net.Conn
+	name      string
+	wake      chan struct{} // Wakes up the writer of the connection, capacity 1
+	mutex     sync.Mutex    // Guards the fields below
+	pending   int           // Requests that will still be answered
+	done      bool          // The client sent DONE or stopped sending requests
+	stopped   bool          // The server stopped, the requests still pending are not answered
+	failed    bool          // A write failed, the responses are dropped
+	responses [][]byte      // Encoded responses waiting for the writer
+}
+
+// signal wakes up the writer of the connection
+func (client *clientConn) signal() {
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+}
+
+// connMux merges the requests of every connection into the input of the
+// server and routes the responses back to the connection of their request.
+// The requests are renumbered so the ids of different clients cannot clash.
+type connMux struct {
+	input    *io.PipeWriter // Input of the server, concurrent writes are sequenced
+	protocol Protocol       // Format of the requests and responses
+	tracer   *trace.Tracer  // Logs the connections
+	writers  sync.WaitGroup // Writers of the connections
+	mutex    sync.Mutex     // Guards the fields below
+	nextID   float64
+	routes   map[float64]route // Route of every request waiting for its response, by renumbered id
+	conns    map[*clientConn]bool
+	closed   bool
+}
+
+// accept serves every connection until the listener fails, which ends the
+// input of the server
+func (mux *connMux) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			mux.input.CloseWithError(err)
+			return
+		}
+		client := &clientConn{conn: conn, name: conn.RemoteAddr().String(), wake: make(chan struct{}, 1)}
+		mux.mutex.Lock()
+		if mux.closed {
+			mux.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		mux.conns[client] = true
+		mux.writers.Add(1)
+		mux.mutex.Unlock()
+		mux.tracer.Log(map[string]interface{}{"event": "connect", "client": client.name})
+		go mux.read(client)
+		go mux.write(client)
+	}
+}
+
+// read forwards the requests of a client to the server until DONE, the end
+// of its input or a malformed request
+func (mux *connMux) read(client *clientConn) {
+	decoder := mux.protocol.NewDecoder(client.conn)
+	for {
+		var message map[string]interface{}
+		if err := decoder.Decode(&message); err != nil || message["command"] == "DONE" {
+			break
+		}
+		if _, ok := message["client"]; !ok {
+			message["client"] = client.name
+		}
+		if !mux.register(client, message) {
+			continue
+		}
+		frame, err := mux.protocol.AppendFrame(nil, message)
+		if err != nil {
+			continue
+		}
+		if _, err := mux.input.Write(frame); err != nil {
+			break
+		}
+	}
+	client.mutex.Lock()
+	client.done = true
+	client.mutex.Unlock()
+	client.signal()
+}
+
+// register renumbers a request that will be answered and remembers where its
+// response goes. It returns false for the requests that would be dropped
+// without a response, which are not forwarded.
+func (mux *connMux) register(client *clientConn, message map[string]interface{}) bool {
+	command := message["command"]
+	if command != "STATS" && command != "QUOTA" && !validRequest(task{Message: message}) {
+		return false
+	}
+	id, ok := message["id"].(float64)
+	if !ok {
+		// STATS and QUOTA without an id cannot be routed back
+		return false
+	}
+	client.mutex.Lock()
+	client.pending++
+	client.mutex.Unlock()
+	mux.mutex.Lock()
+	mux.nextID++
+	mux.routes[mux.nextID] = route{client, id}
+	message["id"] = mux.nextID
+	mux.mutex.Unlock()
+	return true
+}
+
+// Encode receives the responses of the server and queues each one, with the
+// id its client gave the request, for the writer of the client's connection
+func (mux *connMux) Encode(v interface{}) error {
+	response, err := responseMessage(v)
+	if err != nil {
+		return err
+	}
+	id, _ := response["id"].(float64)
+	mux.mutex.Lock()
+	route, ok := mux.routes[id]
+	delete(mux.routes, id)
+	mux.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	// The server keeps using its response, e.g. to record it
+	routed := make(map[string]interface{}, len(response))
+	for field, value := range response {
+		routed[field] = value
+	}
+	routed["id"] = route.id
+	frame, err := mux.protocol.AppendFrame(nil, routed)
+
+	client := route.conn
+	client.mutex.Lock()
+	if err == nil && !client.failed {
+		client.responses = append(client.responses, frame)
+	}
+	client.pending--
+	client.mutex.Unlock()
+	client.signal()
+	return err
+}
+
+// write sends the responses of a client in batches until every request of
+// the client was answered. A client that does not read its responses within
+// clientWriteTimeout is disconnected.
+func (mux *connMux) write(client *clientConn) {
+	defer mux.writers.Done()
+	writer := bufio.NewWriter(client.conn)
+	for range client.wake {
+		client.mutex.Lock()
+		responses := client.responses
+		client.responses = nil
+		finished := (client.done && client.pending == 0) || client.stopped
+		client.mutex.Unlock()
+
+		if len(responses) > 0 {
+			client.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			var err error
+			for _, frame := range responses {
+				if _, err = writer.Write(frame); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				mux.fail(client, err)
+			}
+		}
+		if finished {
+			break
+		}
+	}
+	mux.disconnect(client)
+}
+
+// fail drops the responses of a client whose connection failed, and closes
+// the connection so its requests stop too
+func (mux *connMux) fail(client *clientConn, err error) {
+	client.mutex.Lock()
+	client.failed = true
+	client.responses = nil
+	client.mutex.Unlock()
+	client.conn.Close()
+	mux.tracer.Log(map[string]interface{}{"event": "write error", "client": client.name, "error": err.Error()})
+}
+
+// disconnect closes the connection of a client that has been answered
+func (mux *connMux) disconnect(client *clientConn) {
+	mux.mutex.Lock()
+	delete(mux.conns, client)
+	mux.mutex.Unlock()
+	client.conn.Close()
+	mux.tracer.Log(map[string]interface{}{"event": "disconnect", "client": client.name})
+}
+
+// closeAll stops the clients once the server stopped. Their writers send the
+// responses already queued, then close the connections.
+func (mux *connMux) closeAll() {
+	mux.mutex.Lock()
+	mux.closed = true
+	for client := range mux.conns {
+		// Unblock the reader of the connection
+		client.conn.SetReadDeadline(time.Now())
+		client.mutex.Lock()
+		client.stopped = true
+		client.mutex.Unlock()
+		client.signal()
+	}
+	mux.mutex.Unlock()
+	mux.writers.Wait()
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"proj1/trace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	for _, mode := range []string{"s", "p", "pipeline"} {
+		t.Run(mode, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			signals := make(chan os.Signal, 1)
+			config := Config{Mode: mode, ConsumersCount: 4, Shutdown: signals, FeedImpl: testFeed}
+			result := make(chan error, 1)
+			go func() {
+				result <- Serve(config, listener)
+			}()
+
+			// Every client uses the same ids and timestamps for its own posts
+			clients := 4
+			tasks := 50
+			var wg sync.WaitGroup
+			for c := 0; c < clients; c++ {
+				wg.Add(1)
+				go func(c int) {
+					defer wg.Done()
+					conn, err := net.Dial("tcp", listener.Addr().String())
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer conn.Close()
+					var requests strings.Builder
+					for i := 0; i < tasks; i++ {
+						fmt.Fprintf(&requests, "{\"command\": \"CONTAINS\", \"id\": %v, \"timestamp\": %v}\n", i, 1000*c+i)
+					}
+					// Requests without a response are not waited for
+					requests.WriteString("{\"command\": \"ADD\", \"id\": 99}\n{\"command\": \"DONE\"}\n")
+					go io.WriteString(conn, requests.String())
+
+					// The connection is closed once every request was answered
+					seen := make(map[float64]bool)
+					decoder := json.NewDecoder(conn)
+					for {
+						var response map[string]interface{}
+						if err := decoder.Decode(&response); err == io.EOF {
+							break
+						} else if err != nil {
+							t.Errorf("Client %v: %v", c, err)
+							return
+						}
+						id := response["id"].(float64)
+						if seen[id] || id < 0 || id >= float64(tasks) {
+							t.Errorf("Client %v: unexpected response %v", c, response)
+						}
+						seen[id] = true
+					}
+					if len(seen) != tasks {
+						t.Errorf("Client %v: expected %v responses, got %v", c, tasks, len(seen))
+					}
+				}(c)
+			}
+			wg.Wait()
+
+			signals <- os.Interrupt
+			if err := waitResult(t, result); err != ErrInterrupted {
+				t.Errorf("Expected %v, got %v", ErrInterrupted, err)
+			}
+			if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+				t.Errorf("Expected the listener to be closed")
+			}
+		})
+	}
+}
+
+func TestServeSlowClient(t *testing.T) {
+	defer func(timeout time.Duration) { clientWriteTimeout = timeout }(clientWriteTimeout)
+	clientWriteTimeout = 100 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+	writeError := "\"event\":\"write error\""
+	events := newLogWatcher(writeError)
+	tracer := trace.NewTracer(events, false)
+	tracer.LogRequests = false
+	go func() {
+		result <- Serve(Config{Mode: "p", ConsumersCount: 2, Shutdown: signals, FeedImpl: testFeed, Tracer: tracer}, listener)
+	}()
+
+	// A client that asks for far more than the socket buffers hold and never
+	// reads its responses
+	slow, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	var requests strings.Builder
+	body := strings.Repeat("x", 10000)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&requests, "{\"command\": \"ADD\", \"id\": %v, \"timestamp\": %v, \"body\": %q}\n", i, i, body)
+	}
+	for i := 100; i < 200; i++ {
+		fmt.Fprintf(&requests, "{\"command\": \"FEED\", \"id\": %v}\n", i)
+	}
+	go io.WriteString(slow, requests.String())
+
+	// The other clients are still answered
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(conn)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(conn, "{\"command\": \"CONTAINS\", \"id\": %v, \"timestamp\": 1000000}\n", i)
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err != nil || response["id"] != float64(i) {
+			t.Fatalf("Expected the response to request %v, got %v (%v)", i, response, err)
+		}
+	}
+
+	// The slow client is disconnected once a write to it times out, reading
+	// before that would let the write go through
+	events.wait(t, writeError)
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, slow); err != nil {
+		t.Errorf("Expected the slow client to be disconnected, got %v", err)
+	}
+	signals <- os.Interrupt
+	if err := waitResult(t, result); err != ErrInterrupted {
+		t.Errorf("Expected %v, got %v", ErrInterrupted, err)
+	}
+}
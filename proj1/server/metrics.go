@@ -0,0 +1,312 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricCommands are the commands counted on their own, any other command
+// is counted as "other"
+var metricCommands = [...]string{"ADD", "REMOVE", "CONTAINS", "FEED", "other"}
+
+// metricResults are the outcomes of a request, the error codes in lower case
+// or whether the request succeeded
+var metricResults = [...]string{"success", "failure", "invalid", "timeout", "rate_limited", "overloaded"}
+
+// latencyBuckets are the upper bounds (in seconds) of the latency histograms
+var latencyBuckets = [...]float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// histogram counts durations in the latencyBuckets
+type histogram struct {
+	counts [len(latencyBuckets) + 1]int64 // Observations per bucket, the last one is +Inf, atomic
+	sum    int64                          // Sum of the observations in nanoseconds, atomic
+}
+
+// observe adds a duration to the histogram
+func (h *histogram) observe(d time.Duration) {
+	bucket := sort.SearchFloat64s(latencyBuckets[:], d.Seconds())
+	atomic.AddInt64(&h.counts[bucket], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// snapshot returns the cumulative bucket counts, the count and the sum
+func (h *histogram) snapshot() ([]int64, int64, time.Duration) {
+	cumulative := make([]int64, len(h.counts))
+	var count int64
+	for i := range h.counts {
+		count += atomic.LoadInt64(&h.counts[i])
+		cumulative[i] = count
+	}
+	return cumulative, count, time.Duration(atomic.LoadInt64(&h.sum))
+}
+
+// quantile estimates a quantile as the upper bound of its bucket
+func (h *histogram) quantile(q float64) time.Duration {
+	cumulative, count, _ := h.snapshot()
+	if count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(count)))
+	for i, bound := range latencyBuckets {
+		if cumulative[i] >= rank {
+			return time.Duration(bound * float64(time.Second))
+		}
+	}
+	// Past the last bound, report the last bound
+	return time.Duration(latencyBuckets[len(latencyBuckets)-1] * float64(time.Second))
+}
+
+// consumerTimes is the time a consumer spent processing requests and waiting
+// for them, in nanoseconds
+type consumerTimes struct {
+	busy int64 // atomic
+	idle int64 // atomic
+}
+
+// Metrics instruments a running server. It is served in the Prometheus text
+// format over HTTP and answers the STATS command. Every method can be called
+// on a nil *Metrics, which records nothing.
+type Metrics struct {
+	requests   [len(metricCommands)]int64                     // Requests read by command, atomic
+	responses  [len(metricCommands)][len(metricResults)]int64 // Outcomes by command and result, atomic
+	queueDepth int64                                          // Requests currently queued, atomic
+	queueWait  histogram                                      // Time spent in the queue
+	execution  [len(metricCommands)]histogram                 // Time spent executing by command
+	mutex      sync.Mutex                                     // Guards consumers
+	consumers  map[int]*consumerTimes
+}
+
+// NewMetrics creates the metrics of a server, set it as Config.Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{consumers: make(map[int]*consumerTimes)}
+}
+
+// commandIndex returns the index of a command in metricCommands
+func commandIndex(command interface{}) int {
+	for i, name := range metricCommands[:len(metricCommands)-1] {
+		if command == name {
+			return i
+		}
+	}
+	return len(metricCommands) - 1
+}
+
+// Indices of the results that are not error codes in metricResults
+const (
+	resultSuccess = 0
+	resultFailure = 1
+	resultInvalid = 2
+)
+
+// resultIndex returns the index of the outcome of a response in metricResults
+func resultIndex(response map[string]interface{}) int {
+	if code, ok := response["error"].(string); ok {
+		result := strings.ToLower(code)
+		for i, name := range metricResults {
+			if name == result {
+				return i
+			}
+		}
+		return resultFailure
+	} else if response["success"] == false {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// requestRead counts a request read from the input
+func (metrics *Metrics) requestRead(command interface{}) {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.requests[commandIndex(command)], 1)
+	}
+}
+
+// responded counts the outcome of a request from its response
+func (metrics *Metrics) responded(command interface{}, response map[string]interface{}) {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.responses[commandIndex(command)][resultIndex(response)], 1)
+	}
+}
+
+// dropped counts a request dropped without a response
+func (metrics *Metrics) dropped(command interface{}) {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.responses[commandIndex(command)][resultInvalid], 1)
+	}
+}
+
+// setQueueDepth records the current queue depth
+func (metrics *Metrics) setQueueDepth(depth int64) {
+	if metrics != nil {
+		atomic.StoreInt64(&metrics.queueDepth, depth)
+	}
+}
+
+// executed records the queue wait and the execution time of a request
+func (metrics *Metrics) executed(command interface{}, wait time.Duration, execution time.Duration) {
+	if metrics != nil {
+		metrics.queueWait.observe(wait)
+		metrics.execution[commandIndex(command)].observe(execution)
+	}
+}
+
+// consumer returns the times of consumer i, nil if there are no metrics
+func (metrics *Metrics) consumer(i int) *consumerTimes {
+	if metrics == nil {
+		return nil
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	times, ok := metrics.consumers[i]
+	if !ok {
+		times = &consumerTimes{}
+		metrics.consumers[i] = times
+	}
+	return times
+}
+
+// addBusy adds the time since start to the busy time of a consumer
+func (times *consumerTimes) addBusy(start time.Time) {
+	if times != nil {
+		atomic.AddInt64(&times.busy, int64(time.Since(start)))
+	}
+}
+
+// addIdle adds the time since start to the idle time of a consumer
+func (times *consumerTimes) addIdle(start time.Time) {
+	if times != nil {
+		atomic.AddInt64(&times.idle, int64(time.Since(start)))
+	}
+}
+
+// consumerIDs returns the indices of the consumers in order
+func (metrics *Metrics) consumerIDs() ([]int, map[int]*consumerTimes) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	ids := make([]int, 0, len(metrics.consumers))
+	consumers := make(map[int]*consumerTimes, len(metrics.consumers))
+	for i, times := range metrics.consumers {
+		ids = append(ids, i)
+		consumers[i] = times
+	}
+	sort.Ints(ids)
+	return ids, consumers
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (metrics *Metrics) WritePrometheus(w io.Writer) {
+	if metrics == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP twitter_requests_total Requests read from the input by command.")
+	fmt.Fprintln(w, "# TYPE twitter_requests_total counter")
+	for i, command := range metricCommands {
+		fmt.Fprintf(w, "twitter_requests_total{command=%q} %v\n", command, atomic.LoadInt64(&metrics.requests[i]))
+	}
+	fmt.Fprintln(w, "# HELP twitter_responses_total Outcomes of the requests by command and result.")
+	fmt.Fprintln(w, "# TYPE twitter_responses_total counter")
+	for i, command := range metricCommands {
+		for j, result := range metricResults {
+			fmt.Fprintf(w, "twitter_responses_total{command=%q,result=%q} %v\n", command, result, atomic.LoadInt64(&metrics.responses[i][j]))
+		}
+	}
+	fmt.Fprintln(w, "# HELP twitter_queue_depth Requests currently queued.")
+	fmt.Fprintln(w, "# TYPE twitter_queue_depth gauge")
+	fmt.Fprintf(w, "twitter_queue_depth %v\n", atomic.LoadInt64(&metrics.queueDepth))
+	fmt.Fprintln(w, "# HELP twitter_queue_wait_seconds Time requests spent in the queue.")
+	fmt.Fprintln(w, "# TYPE twitter_queue_wait_seconds histogram")
+	writeHistogram(w, "twitter_queue_wait_seconds", "", &metrics.queueWait)
+	fmt.Fprintln(w, "# HELP twitter_execution_seconds Time spent executing requests by command.")
+	fmt.Fprintln(w, "# TYPE twitter_execution_seconds histogram")
+	for i, command := range metricCommands {
+		writeHistogram(w, "twitter_execution_seconds", fmt.Sprintf("command=%q,", command), &metrics.execution[i])
+	}
+	ids, consumers := metrics.consumerIDs()
+	fmt.Fprintln(w, "# HELP twitter_consumer_busy_seconds_total Time each consumer spent processing requests.")
+	fmt.Fprintln(w, "# TYPE twitter_consumer_busy_seconds_total counter")
+	for _, i := range ids {
+		fmt.Fprintf(w, "twitter_consumer_busy_seconds_total{consumer=\"%v\"} %v\n", i, time.Duration(atomic.LoadInt64(&consumers[i].busy)).Seconds())
+	}
+	fmt.Fprintln(w, "# HELP twitter_consumer_idle_seconds_total Time each consumer spent waiting for requests.")
+	fmt.Fprintln(w, "# TYPE twitter_consumer_idle_seconds_total counter")
+	for _, i := range ids {
+		fmt.Fprintf(w, "twitter_consumer_idle_seconds_total{consumer=\"%v\"} %v\n", i, time.Duration(atomic.LoadInt64(&consumers[i].idle)).Seconds())
+	}
+}
+
+// writeHistogram writes the series of one histogram, labels is either empty
+// or a list of labels ending with a comma
+func writeHistogram(w io.Writer, name string, labels string, h *histogram) {
+	cumulative, count, sum := h.snapshot()
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%v_bucket{%vle=\"%v\"} %v\n", name, labels, bound, cumulative[i])
+	}
+	fmt.Fprintf(w, "%v_bucket{%vle=\"+Inf\"} %v\n", name, labels, count)
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%v_sum%v %v\n", name, labels, sum.Seconds())
+	fmt.Fprintf(w, "%v_count%v %v\n", name, labels, count)
+}
+
+// latencySummary summarizes a histogram for the STATS command
+func latencySummary(h *histogram) map[string]interface{} {
+	_, count, sum := h.snapshot()
+	summary := map[string]interface{}{"count": count}
+	if count > 0 {
+		summary["mean_ms"] = float64(sum) / float64(count) / float64(time.Millisecond)
+		summary["p50_ms"] = float64(h.quantile(0.5)) / float64(time.Millisecond)
+		summary["p99_ms"] = float64(h.quantile(0.99)) / float64(time.Millisecond)
+	}
+	return summary
+}
+
+// stats returns the metrics as the body of the STATS response
+func (metrics *Metrics) stats() map[string]interface{} {
+	if metrics == nil {
+		return map[string]interface{}{}
+	}
+	requests := make(map[string]interface{})
+	responses := make(map[string]interface{})
+	execution := make(map[string]interface{})
+	for i, command := range metricCommands {
+		requests[command] = atomic.LoadInt64(&metrics.requests[i])
+		results := make(map[string]interface{})
+		for j, result := range metricResults {
+			results[result] = atomic.LoadInt64(&metrics.responses[i][j])
+		}
+		responses[command] = results
+		execution[command] = latencySummary(&metrics.execution[i])
+	}
+	ids, consumers := metrics.consumerIDs()
+	consumerStats := make([]interface{}, 0, len(ids))
+	for _, i := range ids {
+		consumerStats = append(consumerStats, map[string]interface{}{
+			"consumer": i,
+			"busy_ms":  float64(atomic.LoadInt64(&consumers[i].busy)) / float64(time.Millisecond),
+			"idle_ms":  float64(atomic.LoadInt64(&consumers[i].idle)) / float64(time.Millisecond),
+		})
+	}
+	return map[string]interface{}{
+		"requests":    requests,
+		"responses":   responses,
+		"queue_depth": atomic.LoadInt64(&metrics.queueDepth),
+		"queue_wait":  latencySummary(&metrics.queueWait),
+		"execution":   execution,
+		"consumers":   consumerStats,
+	}
+}
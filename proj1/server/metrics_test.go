@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for i := 0; i < 98; i++ {
+		h.observe(20 * time.Microsecond)
+	}
+	h.observe(3 * time.Millisecond)
+	h.observe(time.Minute)
+	cumulative, count, sum := h.snapshot()
+	if count != 100 || cumulative[0] != 0 || cumulative[1] != 98 || cumulative[len(cumulative)-2] != 99 {
+		t.Errorf("Unexpected buckets %v (count %v)", cumulative, count)
+	}
+	if expected := 98*20*time.Microsecond + 3*time.Millisecond + time.Minute; sum != expected {
+		t.Errorf("Expected the sum %v, got %v", expected, sum)
+	}
+	if q := h.quantile(0.5); q != 50*time.Microsecond {
+		t.Errorf("Expected the median in the 50µs bucket, got %v", q)
+	}
+	if q := h.quantile(0.99); q != 5*time.Millisecond {
+		t.Errorf("Expected the 99th percentile in the 5ms bucket, got %v", q)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	input := strings.Join([]string{
+		"{\"command\": \"ADD\", \"id\": 1, \"body\": \"1\", \"timestamp\": 1}",
+		"{\"command\": \"ADD\", \"id\": 2, \"body\": \"2\", \"timestamp\": 2}",
+		"{\"command\": \"REMOVE\", \"id\": 3, \"timestamp\": 5}",
+		"{\"command\": \"ADD\", \"id\": 4}",
+		"{\"command\": \"FEED\", \"id\": 5, \"timeout_ms\": 0}",
+		"{\"command\": \"STATS\", \"id\": 6}",
+	}, "\n")
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		var output syncBuffer
+		metrics := NewMetrics()
+		config := Config{
+			Encoder:        json.NewEncoder(&output),
+			Decoder:        json.NewDecoder(strings.NewReader(input)),
+			Mode:           mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 2,
+			Metrics:        metrics,
+		}
+		if err := Run(config); err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+
+		recorder := httptest.NewRecorder()
+		metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		exposition := recorder.Body.String()
+		for _, line := range []string{
+			"twitter_requests_total{command=\"ADD\"} 3",
+			"twitter_requests_total{command=\"other\"} 1",
+			"twitter_responses_total{command=\"ADD\",result=\"success\"} 2",
+			"twitter_responses_total{command=\"ADD\",result=\"invalid\"} 1",
+			"twitter_responses_total{command=\"REMOVE\",result=\"failure\"} 1",
+			"twitter_responses_total{command=\"FEED\",result=\"timeout\"} 1",
+			"twitter_queue_wait_seconds_count 4",
+			"twitter_execution_seconds_count{command=\"ADD\"} 2",
+			"# TYPE twitter_execution_seconds histogram",
+		} {
+			if !strings.Contains(exposition, line+"\n") {
+				t.Errorf("%v: expected %q in\n%v", mode, line, exposition)
+			}
+		}
+		if mode != "s" && mode != "pipeline" && !strings.Contains(exposition, "twitter_consumer_busy_seconds_total{consumer=\"0\"}") {
+			t.Errorf("%v: expected the busy time of the consumers in\n%v", mode, exposition)
+		}
+
+		// The STATS command is answered as soon as it is read
+		var stats map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+		for decoder.More() {
+			var response map[string]interface{}
+			if err := decoder.Decode(&response); err != nil {
+				t.Fatalf("%v: malformed output: %v", mode, err)
+			}
+			if response["id"] == 6.0 {
+				stats, _ = response["stats"].(map[string]interface{})
+			}
+		}
+		requests, _ := stats["requests"].(map[string]interface{})
+		if requests["ADD"] != 3.0 || requests["REMOVE"] != 1.0 {
+			t.Errorf("%v: expected the request counts in the STATS response, got %v", mode, stats)
+		}
+		for _, key := range []string{"responses", "queue_depth", "queue_wait", "execution", "consumers"} {
+			if _, ok := stats[key]; !ok {
+				t.Errorf("%v: expected %v in the STATS response, got %v", mode, key, stats)
+			}
+		}
+	}
+}
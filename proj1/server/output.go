@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Default buffer size of the output stage
+const DefaultOutputBuffer = 64 * 1024
+
+// OutputConfig configures the output stage, the goroutine that writes the
+// responses to Config.Writer. The consumers encode their responses and hand
+// them over without locks, and the stage writes them in batches.
+type OutputConfig struct {
+	BufferSize int // Bytes buffered before they are written (default DefaultOutputBuffer)
+	// Longest time a response stays buffered (0 = it is written as soon as
+	// no other response is waiting)
+	FlushInterval time.Duration
+}
+
+// frameNode is a frame in a frameQueue
+type frameNode struct {
+	frame []byte
+	next  unsafe.Pointer // *frameNode
+}
+
+// frameQueue is a lock-free queue of encoded responses with any number of
+// producers and a single consumer
+type frameQueue struct {
+	head *frameNode     // Last frame popped, only used by the consumer
+	tail unsafe.Pointer // *frameNode, last frame pushed
+}
+
+func newFrameQueue() *frameQueue {
+	stub := &frameNode{}
+	return &frameQueue{head: stub, tail: unsafe.Pointer(stub)}
+}
+
+// push adds a frame, it can be called concurrently
+func (queue *frameQueue) push(frame []byte) {
+	node := &frameNode{frame: frame}
+	previous := (*frameNode)(atomic.SwapPointer(&queue.tail, unsafe.Pointer(node)))
+	atomic.StorePointer(&previous.next, unsafe.Pointer(node))
+}
+
+// pop removes the oldest frame. It returns false if the queue is empty or
+// the oldest push has not linked its frame yet.
+func (queue *frameQueue) pop() ([]byte, bool) {
+	next := (*frameNode)(atomic.LoadPointer(&queue.head.next))
+	if next == nil {
+		return nil, false
+	}
+	queue.head = next
+	frame := next.frame
+	next.frame = nil
+	return frame, true
+}
+
+// outputStage is the Encoder and the Writer of the versions when the
+// configuration has a Writer. Only whole frames are passed to the Writer, so
+// it can split its input into responses (see connMux).
+type outputStage struct {
+	protocol Protocol
+	settings OutputConfig
+	frames   *frameQueue
+	wake     chan struct{} // Holds one pending wake-up of the writer goroutine
+	closing  chan struct{} // Closed by close
+	stopped  chan struct{} // Closed once the writer goroutine flushed everything
+	closed   int32         // Set to 1 by close, atomic
+	sending  int64         // Calls of send that may still queue a frame, atomic
+	mutex    sync.Mutex    // Guards the buffer once the writer goroutine stopped
+	buffer   *bufio.Writer
+	err      error // First write error
+}
+
+// newOutputStage starts the writer goroutine of w
+func newOutputStage(w io.Writer, protocol Protocol, settings OutputConfig) *outputStage {
+	if settings.BufferSize <= 0 {
+		settings.BufferSize = DefaultOutputBuffer
+	}
+	stage := &outputStage{
+		protocol: protocol,
+		settings: settings,
+		frames:   newFrameQueue(),
+		wake:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		buffer:   bufio.NewWriterSize(w, settings.BufferSize),
+	}
+	go stage.run()
+	return stage
+}
+
+// Encode encodes a response on the caller's goroutine and hands it to the
+// writer goroutine
+func (stage *outputStage) Encode(v interface{}) error {
+	response, err := responseMessage(v)
+	if err != nil {
+		return err
+	}
+	frame, err := stage.protocol.AppendFrame(nil, response)
+	if err != nil {
+		return err
+	}
+	stage.send(frame)
+	return nil
+}
+
+// Write hands whole frames encoded by the caller to the writer goroutine
+func (stage *outputStage) Write(p []byte) (int, error) {
+	stage.send(append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// send queues a frame and wakes up the writer goroutine. Once the stage is
+// closed, the responses of consumers abandoned by a forced shutdown are
+// written directly.
+func (stage *outputStage) send(frame []byte) {
+	// Announce the frame before checking closed, close waits for it to be
+	// queued if it did not see the stage closed
+	atomic.AddInt64(&stage.sending, 1)
+	if atomic.LoadInt32(&stage.closed) == 1 {
+		atomic.AddInt64(&stage.sending, -1)
+		stage.mutex.Lock()
+		stage.write(frame)
+		stage.flush()
+		stage.mutex.Unlock()
+		return
+	}
+	stage.frames.push(frame)
+	atomic.AddInt64(&stage.sending, -1)
+	select {
+	case stage.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the queued frames until the stage is closed
+func (stage *outputStage) run() {
+	defer close(stage.stopped)
+	var tick <-chan time.Time
+	if stage.settings.FlushInterval > 0 {
+		ticker := time.NewTicker(stage.settings.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stage.wake:
+			stage.drain()
+			if tick == nil {
+				// No other response is waiting
+				stage.flush()
+			}
+		case <-tick:
+			stage.flush()
+		case <-stage.closing:
+			stage.drain()
+			stage.flush()
+			return
+		}
+	}
+}
+
+// drain buffers every queued frame
+func (stage *outputStage) drain() {
+	for {
+		frame, ok := stage.frames.pop()
+		if !ok {
+			return
+		}
+		stage.write(frame)
+	}
+}
+
+// write buffers a frame without splitting it between two writes
+func (stage *outputStage) write(frame []byte) {
+	if len(frame) > stage.buffer.Available() && stage.buffer.Buffered() > 0 {
+		stage.flush()
+	}
+	// A frame larger than the buffer is written directly in one piece
+	if _, err := stage.buffer.Write(frame); err != nil && stage.err == nil {
+		stage.err = err
+	}
+}
+
+// flush writes the buffered frames
+func (stage *outputStage) flush() {
+	if err := stage.buffer.Flush(); err != nil && stage.err == nil {
+		stage.err = err
+	}
+}
+
+// close writes the queued responses and returns the first write error. It
+// must be called once the versions stopped encoding responses.
+func (stage *outputStage) close() error {
+	if stage == nil {
+		return nil
+	}
+	stage.mutex.Lock()
+	// The frames queued before are drained by the writer goroutine, the
+	// later ones are written directly
+	atomic.StoreInt32(&stage.closed, 1)
+	for atomic.LoadInt64(&stage.sending) != 0 {
+		runtime.Gosched()
+	}
+	close(stage.closing)
+	<-stage.stopped
+	err := stage.err
+	stage.mutex.Unlock()
+	return err
+}
+
+// responseMessage returns the response passed to Encode by writeResponse
+func responseMessage(v interface{}) (map[string]interface{}, error) {
+	switch response := v.(type) {
+	case map[string]interface{}:
+		return response, nil
+	case *map[string]interface{}:
+		return *response, nil
+	}
+	return nil, fmt.Errorf("server: unexpected response %T", v)
+}
+
+// lockedEncoder serializes the responses encoded by the consumers when the
+// configuration only has an Encoder
+type lockedEncoder struct {
+	mutex   sync.Mutex
+	encoder Encoder
+}
+
+func (locked *lockedEncoder) Encode(v interface{}) error {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.encoder.Encode(v)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunkWriter keeps every write separately
+type chunkWriter struct {
+	mutex  sync.Mutex
+	chunks [][]byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.chunks = append(w.chunks, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// written returns the writes so far
+func (w *chunkWriter) written() [][]byte {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([][]byte(nil), w.chunks...)
+}
+
+func TestFrameQueue(t *testing.T) {
+	queue := newFrameQueue()
+	producers, frames := 8, 1000
+	var group sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < frames; j++ {
+				queue.push([]byte(fmt.Sprintf("%v %v", i, j)))
+			}
+		}(i)
+	}
+	finished := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(finished)
+	}()
+
+	// Every frame is popped once, in order for each producer
+	next := make([]int, producers)
+	popped := 0
+	for popped < producers*frames {
+		frame, ok := queue.pop()
+		if !ok {
+			select {
+			case <-finished:
+				// Every push returned, so every frame is linked
+				if frame, ok = queue.pop(); !ok {
+					t.Fatalf("Expected %v frames, got %v", producers*frames, popped)
+				}
+			default:
+				continue
+			}
+		}
+		var i, j int
+		fmt.Sscanf(string(frame), "%d %d", &i, &j)
+		if j != next[i] {
+			t.Fatalf("Expected frame %v of producer %v, got %v", next[i], i, j)
+		}
+		next[i]++
+		popped++
+	}
+}
+
+func TestOutputStageBatches(t *testing.T) {
+	for _, name := range []string{"json", "binary"} {
+		protocol, _ := LookupProtocol(name)
+		tasks := 2000
+		input := addRequests(tasks) + "{\"command\": \"FEED\", \"id\": 5000}\n"
+		if name == "binary" {
+			input = string(toBinary(t, input))
+		}
+		writer := &chunkWriter{}
+		config := Config{
+			Reader:         strings.NewReader(input),
+			Writer:         writer,
+			Protocol:       protocol,
+			Mode:           "p",
+			FeedImpl:       testFeed,
+			ConsumersCount: 8,
+			// Only full buffers are written before the end
+			Output: OutputConfig{BufferSize: 1024, FlushInterval: time.Hour},
+		}
+		if err := Run(config); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every write holds whole responses, the FEED alone is larger than
+		// the buffer
+		responses := 0
+		chunks := writer.written()
+		for _, chunk := range chunks {
+			reader := bufio.NewReader(bytes.NewReader(chunk))
+			for {
+				frame, err := protocol.ReadFrame(reader)
+				if frame != nil {
+					if _, err := protocol.Unmarshal(frame); err != nil {
+						t.Fatalf("%v: malformed response %q: %v", name, frame, err)
+					}
+					responses++
+				}
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("%v: a write ended in the middle of a response: %v", name, err)
+				}
+			}
+		}
+		if responses != tasks+1 {
+			t.Errorf("%v: expected %v responses, got %v", name, tasks+1, responses)
+		}
+		if len(chunks) > tasks/10 {
+			t.Errorf("%v: expected the responses to be written in batches, got %v writes", name, len(chunks))
+		}
+	}
+}
+
+func TestOutputStageFlushes(t *testing.T) {
+	protocol, _ := LookupProtocol("json")
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond} {
+		writer := &chunkWriter{}
+		stage := newOutputStage(writer, protocol, OutputConfig{FlushInterval: interval})
+		stage.Encode(&map[string]interface{}{"id": 1.0, "success": true})
+		// The response does not wait for the buffer to fill up
+		deadline := time.Now().Add(5 * time.Second)
+		for len(writer.written()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if chunks := writer.written(); len(chunks) != 1 || string(chunks[0]) != "{\"id\":1,\"success\":true}\n" {
+			t.Errorf("%v: expected the response to be flushed, got %q", interval, chunks)
+		}
+		if err := stage.close(); err != nil {
+			t.Fatal(err)
+		}
+		// Late responses are still written whole
+		stage.Encode(&map[string]interface{}{"id": 2.0, "success": false})
+		if chunks := writer.written(); len(chunks) != 2 || string(chunks[1]) != "{\"id\":2,\"success\":false}\n" {
+			t.Errorf("%v: expected the late response to be written, got %q", interval, chunks)
+		}
+	}
+}
+
+func TestOutputStageShutdown(t *testing.T) {
+	// Buffered responses are written when a signal stops the server
+	input, inputWriter := io.Pipe()
+	var output syncBuffer
+	signals := make(chan os.Signal, 1)
+	config := Config{
+		Reader:         input,
+		Writer:         &output,
+		Mode:           "p",
+		FeedImpl:       testFeed,
+		ConsumersCount: 4,
+		Shutdown:       signals,
+		Output:         OutputConfig{FlushInterval: time.Hour},
+		Metrics:        NewMetrics(),
+	}
+	result := runAsync(config)
+	tasks := 100
+	fmt.Fprint(inputWriter, addRequests(tasks))
+	// Every request is read before the signal
+	deadline := time.Now().Add(5 * time.Second)
+	for config.Metrics.stats()["requests"].(map[string]interface{})["ADD"] != int64(tasks) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	signals <- os.Interrupt
+	if err := waitResult(t, result); err != ErrInterrupted {
+		t.Fatalf("Expected an interruption, got %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+	responses := 0
+	for decoder.More() {
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatalf("Malformed output: %v", err)
+		}
+		responses++
+	}
+	if responses != tasks {
+		t.Errorf("Expected %v responses, got %v", tasks, responses)
+	}
+	inputWriter.Close()
+}
+
+func TestOutputStageCloseRace(t *testing.T) {
+	// Responses encoded while the stage closes are either drained or written
+	// directly, none is lost
+	protocol, _ := LookupProtocol("json")
+	for round := 0; round < 50; round++ {
+		var output syncBuffer
+		stage := newOutputStage(&output, protocol, OutputConfig{})
+		senders, responses := 4, 200
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < responses; j++ {
+					stage.Encode(&map[string]interface{}{"id": float64(i*responses + j)})
+				}
+			}(i)
+		}
+		time.Sleep(time.Duration(round%5) * 100 * time.Microsecond)
+		if err := stage.close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		if lines := bytes.Count(output.Bytes(), []byte("\n")); lines != senders*responses {
+			t.Fatalf("Expected %v responses, got %v", senders*responses, lines)
+		}
+	}
+}
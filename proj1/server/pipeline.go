@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"proj1/feed"
+	"proj1/queue"
+	"proj1/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// StageConfig configures one stage of the pipeline version
+type StageConfig struct {
+	Workers int // Number of goroutines running the stage (at least 1)
+	Buffer  int // Capacity of the channel feeding the stage
+}
+
+// PipelineConfig configures the pipeline version, where every request goes
+// through a decode, validate, execute and encode stage connected by channels
+type PipelineConfig struct {
+	Decode   StageConfig // Parses the input lines (needs Config.Reader to run in parallel)
+	Validate StageConfig // Drops unknown commands and requests with missing fields, applies the rate limits
+	Execute  StageConfig // Runs the requests against the feed (Workers defaults to ConsumersCount)
+	Encode   StageConfig // Marshals the responses (needs Config.Writer to run in parallel)
+	Stats    io.Writer   // Receives the per-stage utilization when the server shuts down
+}
+
+// ParsePipelineConfig parses stage settings of the form
+// "decode=2/64,execute=8/128", where each stage is given as
+// name=workers[/buffer]. Stages that are not listed keep the zero value.
+func ParsePipelineConfig(spec string) (PipelineConfig, error) {
+	var config PipelineConfig
+	stages := map[string]*StageConfig{
+		"decode":   &config.Decode,
+		"validate": &config.Validate,
+		"execute":  &config.Execute,
+		"encode":   &config.Encode,
+	}
+	for _, field := range strings.Split(spec, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		stage, ok := stages[strings.TrimSpace(parts[0])]
+		if !ok || len(parts) != 2 {
+			return config, fmt.Errorf("invalid pipeline stage %q", field)
+		}
+		values := strings.SplitN(parts[1], "/", 2)
+		workers, err := strconv.Atoi(values[0])
+		if err != nil || workers < 1 {
+			return config, fmt.Errorf("invalid number of workers in %q", field)
+		}
+		stage.Workers = workers
+		if len(values) == 2 {
+			buffer, err := strconv.Atoi(values[1])
+			if err != nil || buffer < 0 {
+				return config, fmt.Errorf("invalid buffer size in %q", field)
+			}
+			stage.Buffer = buffer
+		}
+	}
+	return config, nil
+}
+
+// pipelineItem is a request on its way through the stages
+type pipelineItem struct {
+	line     []byte        // Raw input line (decode stage input)
+	request  task          // Decoded request (decode stage output)
+	response queue.Request // Response of the request (execute stage output)
+	encoded  []byte        // Marshaled response (encode stage output)
+}
+
+// stageStats tracks how busy the workers of one stage are
+type stageStats struct {
+	name    string
+	workers int
+	buffer  int
+	items   int64 // Items that went through the stage
+	busy    int64 // Nanoseconds spent processing items, summed over the workers
+}
+
+// runStage starts the workers of a stage. Each item read from in is passed
+// to process with the index of the worker and forwarded to out if process
+// returns true. out is closed once in is closed and every worker has finished.
+func runStage(stats *stageStats, in <-chan *pipelineItem, out chan<- *pipelineItem, process func(worker int, item *pipelineItem) bool) {
+	group := sync.WaitGroup{}
+	for i := 0; i < stats.workers; i++ {
+		group.Add(1)
+		go func(worker int) {
+			defer group.Done()
+			for item := range in {
+				start := time.Now()
+				forward := process(worker, item)
+				atomic.AddInt64(&stats.busy, int64(time.Since(start)))
+				atomic.AddInt64(&stats.items, 1)
+				if forward && out != nil {
+					out <- item
+				}
+			}
+		}(i)
+	}
+	go func() {
+		group.Wait()
+		if out != nil {
+			close(out)
+		}
+	}()
+}
+
+// newStageStats applies the defaults to a stage configuration
+func newStageStats(name string, stage StageConfig, defaultWorkers int) *stageStats {
+	workers := stage.Workers
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &stageStats{name: name, workers: workers, buffer: stage.Buffer}
+}
+
+// pipelineServer runs the server as a pipeline of stages connected by
+// channels. Requests are executed as soon as they are decoded, so like the
+// parallel version there is no ordering between concurrent requests.
+func pipelineServer(config Config, feed feed.Feed, source *messageSource) error {
+	start := time.Now()
+	settings := config.Pipeline
+	if config.Reader == nil {
+		// The Decoder cannot be shared, decoding happens in the reader
+		settings.Decode.Workers = 1
+	}
+	if config.Writer == nil {
+		// The Encoder cannot be shared
+		settings.Encode.Workers = 1
+	}
+	stats := []*stageStats{
+		newStageStats("decode", settings.Decode, 1),
+		newStageStats("validate", settings.Validate, 1),
+		newStageStats("execute", settings.Execute, config.ConsumersCount),
+		newStageStats("encode", settings.Encode, 1),
+	}
+	decodeStats, validateStats, executeStats, encodeStats := stats[0], stats[1], stats[2], stats[3]
+
+	lines := make(chan *pipelineItem, decodeStats.buffer)
+	decodedItems := make(chan *pipelineItem, validateStats.buffer)
+	validItems := make(chan *pipelineItem, executeStats.buffer)
+	executedItems := make(chan *pipelineItem, encodeStats.buffer)
+
+	// The first decoding error stops the input like in the other versions,
+	// the requests read before it still go through the stages
+	var decodeErr error
+	var errOnce sync.Once
+	malformed := make(chan struct{})
+	runStage(decodeStats, lines, decodedItems, func(worker int, item *pipelineItem) bool {
+		if item.line != nil {
+			message, err := config.Protocol.Unmarshal(item.line)
+			if err != nil {
+				errOnce.Do(func() {
+					decodeErr = err
+					close(malformed)
+				})
+				return false
+			}
+			item.request.Message = message
+			item.request.Record.Decoded(message)
+		}
+		item.request.Span = config.Tracer.Start(item.request.Message)
+		// The channels to the execute stage are the queue of the pipeline
+		item.request = withDeadline(item.request, time.Now())
+		item.request.Enqueued = time.Now()
+		item.request.Span.Mark(trace.PhaseEnqueue)
+		return true
+	})
+	runStage(validateStats, decodedItems, validItems, func(worker int, item *pipelineItem) bool {
+		// Requests over their rate limit and admin commands skip the execute stage
+		if response := admitRequest(config, source.limiter, item.request); response != nil {
+			item.response.Message = response
+			return true
+		}
+		if !validRequest(item.request) {
+			config.Metrics.dropped(item.request.Message["command"])
+			finishRequest(config, item.request, resultInvalid, nil)
+			return false
+		}
+		return true
+	})
+	runStage(executeStats, validItems, executedItems, func(worker int, item *pipelineItem) bool {
+		if item.response.Message == nil {
+			item.request.Span.Take(worker)
+			item.response = executeRequest(config, feed, item.request)
+		}
+		return true
+	})
+	encoded := make(chan *pipelineItem, encodeStats.workers)
+	runStage(encodeStats, executedItems, encoded, func(worker int, item *pipelineItem) bool {
+		if config.Writer == nil {
+			// Without a raw writer the Encoder both marshals and writes
+			writeResponse(config, item.request, item.response.Message)
+			return false
+		}
+		item.request.Span.Mark(trace.PhaseEncode)
+		var err error
+		item.encoded, err = config.Protocol.AppendFrame(nil, item.response.Message)
+		return err == nil
+	})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for item := range encoded {
+			config.Writer.Write(item.encoded)
+			item.request.Span.Mark(trace.PhaseEncoded)
+			finishRequest(config, item.request, resultIndex(item.response.Message), item.response.Message)
+		}
+	}()
+
+	err := readLines(config, source, lines, malformed)
+	<-written
+	if err == nil {
+		err = decodeErr
+	}
+	if settings.Stats != nil {
+		writeStageStats(settings.Stats, stats, time.Since(start))
+	}
+	return err
+}
+
+// readLines feeds the decode stage with the input lines until the DONE
+// command, the end of the input, a shutdown signal or a line the decode stage
+// could not decode (malformed is closed), and then closes it
+func readLines(config Config, source *messageSource, lines chan<- *pipelineItem, malformed <-chan struct{}) error {
+	defer close(lines)
+	// Reading cannot be cancelled, so it runs on its own goroutine and the
+	// items are forwarded from here until a shutdown signal arrives
+	read := make(chan *pipelineItem)
+	failed := make(chan error, 1)
+	go func() {
+		defer close(read)
+		failed <- scanLines(config, source, read)
+	}()
+	for {
+		select {
+		case item, ok := <-read:
+			if !ok {
+				return endOfInput(<-failed)
+			}
+			lines <- item
+		case <-source.interrupted:
+			return ErrInterrupted
+		case <-malformed:
+			// The caller returns the decoding error
+			return nil
+		}
+	}
+}
+
+// scanLines reads the input line by line (frame by frame with the binary
+// protocol), or request by request with the Decoder when there is no raw
+// Reader, and stops at the DONE command
+func scanLines(config Config, source *messageSource, read chan<- *pipelineItem) error {
+	send := func(item *pipelineItem) bool {
+		select {
+		case read <- item:
+			return true
+		case <-source.stopped:
+			return false
+		}
+	}
+	if config.Reader == nil {
+		for {
+			var message map[string]interface{}
+			if err := config.Decoder.Decode(&message); err != nil {
+				return err
+			}
+			if message["command"] == "DONE" {
+				return nil
+			}
+			if !send(&pipelineItem{request: task{Message: message, Record: config.Recorder.Arrive(message)}}) {
+				return nil
+			}
+		}
+	}
+	reader := bufio.NewReader(config.Reader)
+	for {
+		line, err := config.Protocol.ReadFrame(reader)
+		if line != nil {
+			if config.Protocol.IsDone(line) {
+				return nil
+			}
+			// The lines are decoded out of order, the arrival is recorded now
+			if !send(&pipelineItem{line: line, request: task{Record: config.Recorder.Arrive(nil)}}) {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeStageStats writes the number of items and the utilization of every
+// stage, i.e. the share of the run time its workers spent processing items
+func writeStageStats(w io.Writer, stats []*stageStats, elapsed time.Duration) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "stage\tworkers\tbuffer\titems\tbusy\tutilization")
+	for _, stage := range stats {
+		busy := time.Duration(atomic.LoadInt64(&stage.busy))
+		utilization := 0.0
+		if elapsed > 0 {
+			utilization = 100 * float64(busy) / (float64(elapsed) * float64(stage.workers))
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%.1f%%\n", stage.name, stage.workers, stage.buffer,
+			atomic.LoadInt64(&stage.items), busy.Round(time.Microsecond), utilization)
+	}
+	table.Flush()
+}
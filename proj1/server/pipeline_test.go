@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParsePipelineConfig(t *testing.T) {
+	var tests = []struct {
+		spec     string
+		expected PipelineConfig
+		valid    bool
+	}{
+		{"", PipelineConfig{}, true},
+		{"decode=2", PipelineConfig{Decode: StageConfig{2, 0}}, true},
+		{"decode=2/16,execute=8/128", PipelineConfig{Decode: StageConfig{2, 16}, Execute: StageConfig{8, 128}}, true},
+		{"validate=1/0, encode=4/8", PipelineConfig{Validate: StageConfig{1, 0}, Encode: StageConfig{4, 8}}, true},
+		{"parse=2", PipelineConfig{}, false},
+		{"decode", PipelineConfig{}, false},
+		{"decode=0", PipelineConfig{}, false},
+		{"decode=2/x", PipelineConfig{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			config, err := ParsePipelineConfig(test.spec)
+			if (err == nil) != test.valid {
+				t.Fatalf("Expected valid=%v, got error %v", test.valid, err)
+			}
+			if test.valid && config != test.expected {
+				t.Errorf("Expected %+v, got %+v", test.expected, config)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var tests = []struct {
+		name  string
+		stage StageConfig
+		raw   bool // Use the raw Reader and Writer
+	}{
+		{"Decoder", StageConfig{1, 0}, false},
+		{"Unbuffered", StageConfig{4, 0}, true},
+		{"Buffered", StageConfig{4, 64}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tasks := 1000
+			input := addRequests(tasks) +
+				"{\"command\": \"UNKNOWN\", \"id\": -1}\n" +
+				"{\"command\": \"REMOVE\", \"id\": -2}\n" +
+				"{\"command\": \"DONE\"}\n" + addRequests(10)
+			var output syncBuffer
+			var stats bytes.Buffer
+			config := Config{
+				Mode:           "pipeline",
+				FeedImpl:       testFeed,
+				ConsumersCount: 4,
+				Pipeline: PipelineConfig{
+					Decode:   test.stage,
+					Validate: test.stage,
+					Execute:  test.stage,
+					Encode:   test.stage,
+					Stats:    &stats,
+				},
+			}
+			if test.raw {
+				config.Reader = strings.NewReader(input)
+				config.Writer = &output
+			} else {
+				config.Decoder = json.NewDecoder(strings.NewReader(input))
+				config.Encoder = json.NewEncoder(&output)
+			}
+			if err := waitResult(t, runAsync(config)); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+
+			seen := make(map[float64]bool)
+			decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+			for decoder.More() {
+				var response map[string]interface{}
+				if err := decoder.Decode(&response); err != nil {
+					t.Fatal(err)
+				}
+				seen[response["id"].(float64)] = true
+			}
+			// The invalid requests are dropped by the validation stage
+			if len(seen) != tasks {
+				t.Errorf("Expected %v responses, got %v", tasks, len(seen))
+			}
+			for _, stage := range []string{"decode", "validate", "execute", "encode"} {
+				if !strings.Contains(stats.String(), stage) {
+					t.Errorf("Expected utilization stats for the %v stage, got\n%v", stage, stats.String())
+				}
+			}
+		})
+	}
+}
+
+// Like the other versions, the pipeline stops reading at a malformed request
+// instead of waiting for the rest of the input
+func TestPipelineDecodeError(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	var output syncBuffer
+	config := Config{Mode: "pipeline", FeedImpl: testFeed, ConsumersCount: 2, Reader: reader, Writer: &output}
+	result := runAsync(config)
+	io.WriteString(writer, addRequests(10)+"{\"command\": \"ADD\", \"id\": \n")
+	if err := waitResult(t, result); err == nil {
+		t.Errorf("Expected the decoding error")
+	}
+	if responses := bytes.Count(output.Bytes(), []byte("\n")); responses != 10 {
+		t.Errorf("Expected the 10 requests before the malformed one to be answered, got %s", output.Bytes())
+	}
+}
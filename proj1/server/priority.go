@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"proj1/queue"
+	"strconv"
+	"strings"
+)
+
+// PriorityConfig configures the priority queue of the parallel and adaptive
+// versions. A request is served by the level of its "priority" field (0 to 2
+// or "high", "normal", "low") or else by the default level of its command.
+type PriorityConfig struct {
+	Enabled  bool           // Replace the FIFO queue with the priority queue
+	Commands map[string]int // Default level of each command, overriding the built-in ones
+	MaxSkips int            // Times a waiting level can be passed over before it is served (default 8)
+}
+
+// defaultPriorities lets the cheap lookups overtake the FEED dumps
+var defaultPriorities = map[string]int{
+	"CONTAINS": queue.PriorityHigh,
+	"ADD":      queue.PriorityNormal,
+	"REMOVE":   queue.PriorityNormal,
+	"FEED":     queue.PriorityLow,
+}
+
+// priorityNames are the names accepted for the priority levels
+var priorityNames = map[string]int{
+	"high":   queue.PriorityHigh,
+	"normal": queue.PriorityNormal,
+	"low":    queue.PriorityLow,
+}
+
+// ParsePriorities parses default command priorities of the form
+// "CONTAINS=high,FEED=2", where each level is a name or a number from 0
+// (served first) to 2
+func ParsePriorities(spec string) (map[string]int, error) {
+	priorities := make(map[string]int)
+	for _, field := range strings.Split(spec, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		command := strings.ToUpper(strings.TrimSpace(parts[0]))
+		if _, ok := defaultPriorities[command]; !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid command priority %q", field)
+		}
+		level, ok := parsePriority(strings.TrimSpace(parts[1]))
+		if !ok {
+			return nil, fmt.Errorf("invalid priority level in %q", field)
+		}
+		priorities[command] = level
+	}
+	return priorities, nil
+}
+
+// parsePriority reads a priority level given as a name or a number
+func parsePriority(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case float64:
+		if value == float64(int(value)) && value >= queue.PriorityHigh && value < queue.PriorityLevels {
+			return int(value), true
+		}
+	case string:
+		if level, ok := priorityNames[strings.ToLower(value)]; ok {
+			return level, true
+		}
+		if level, err := strconv.Atoi(value); err == nil && level >= queue.PriorityHigh && level < queue.PriorityLevels {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// priorityOf returns the level of a request, from its "priority" field if it
+// is valid or else from the default of its command
+func priorityOf(config Config, request task) int {
+	if level, ok := parsePriority(request.Message["priority"]); ok {
+		return level
+	}
+	command, _ := request.Message["command"].(string)
+	if level, ok := config.Priorities.Commands[command]; ok {
+		return level
+	}
+	if level, ok := defaultPriorities[command]; ok {
+		return level
+	}
+	return queue.PriorityNormal
+}
+
+// newTaskQueue creates the queue shared by the producer and the consumers,
+// a FIFO queue from newQueue or a queue.PriorityQueue of them
+func newTaskQueue(config Config, newQueue queue.Constructor) queue.Queue {
+	if !config.Priorities.Enabled {
+		return newQueue()
+	}
+	maxSkips := config.Priorities.MaxSkips
+	if maxSkips < 1 {
+		maxSkips = 8
+	}
+	return queue.NewPriorityQueueOf(maxSkips, newQueue)
+}
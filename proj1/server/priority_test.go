@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePriorities(t *testing.T) {
+	var tests = []struct {
+		spec     string
+		expected map[string]int
+		valid    bool
+	}{
+		{"", map[string]int{}, true},
+		{"CONTAINS=high,FEED=2", map[string]int{"CONTAINS": 0, "FEED": 2}, true},
+		{"add=Low, remove=normal", map[string]int{"ADD": 2, "REMOVE": 1}, true},
+		{"DONE=high", nil, false},
+		{"FEED=3", nil, false},
+		{"FEED", nil, false},
+	}
+	for _, test := range tests {
+		priorities, err := ParsePriorities(test.spec)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid = %v, got %v", test.spec, test.valid, err)
+		} else if test.valid && !reflect.DeepEqual(priorities, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.expected, priorities)
+		}
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	var tests = []struct {
+		name     string
+		config   PriorityConfig
+		expected string // Commands of the responses after the first one (F = FEED, C = CONTAINS)
+	}{
+		{"fifo", PriorityConfig{}, "FCFCFCFC"},
+		{"defaults", PriorityConfig{Enabled: true, MaxSkips: 100}, "CCCCFFFF"},
+		{"commands", PriorityConfig{Enabled: true, MaxSkips: 100, Commands: map[string]int{"FEED": 0, "CONTAINS": 2}}, "FFFFCCCC"},
+		{"starvation", PriorityConfig{Enabled: true, MaxSkips: 1}, "CFCFCFCF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, mode := range []string{"p", "a"} {
+				input, inputWriter := io.Pipe()
+				output := newGatedWriter()
+				// Every request is reported once queued and once dequeued
+				reports := make(chan int64, 2*9)
+				config := Config{
+					Encoder:        json.NewEncoder(output),
+					Decoder:        json.NewDecoder(input),
+					Mode:           mode,
+					FeedImpl:       testFeed,
+					ConsumersCount: 1,
+					Priorities:     test.config,
+					OnQueueDepth:   func(depth int64) { reports <- depth },
+				}
+				result := runAsync(config)
+
+				// The single consumer blocks on the first response while the rest is queued
+				io.WriteString(inputWriter, "{\"command\": \"ADD\", \"id\": 0, \"body\": \"0\", \"timestamp\": 0}\n")
+				<-output.blocked
+				var requests strings.Builder
+				for i := 1; i <= 8; i++ {
+					if i%2 == 1 {
+						fmt.Fprintf(&requests, "{\"command\": \"FEED\", \"id\": %v}\n", i)
+					} else {
+						fmt.Fprintf(&requests, "{\"command\": \"CONTAINS\", \"id\": %v, \"timestamp\": 0}\n", i)
+					}
+				}
+				go io.WriteString(inputWriter, requests.String()+"{\"command\": \"DONE\"}\n")
+				// The ADD was queued and dequeued, then wait for the 8 others
+				for i := 0; i < 2+8; i++ {
+					<-reports
+				}
+				close(output.open)
+
+				if err := waitResult(t, result); err != nil {
+					t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+				}
+				responses := output.responses(t)
+				var got strings.Builder
+				for _, response := range responses[1:] {
+					if _, ok := response["feed"]; ok {
+						got.WriteString("F")
+					} else {
+						got.WriteString("C")
+					}
+				}
+				if got.String() != test.expected {
+					t.Errorf("%v: expected the order %v, got %v", mode, test.expected, got.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPriorityField(t *testing.T) {
+	var tests = []struct {
+		message  map[string]interface{}
+		expected int
+	}{
+		{map[string]interface{}{"command": "FEED"}, 2},
+		{map[string]interface{}{"command": "FEED", "priority": 0.0}, 0},
+		{map[string]interface{}{"command": "CONTAINS", "priority": "low"}, 2},
+		{map[string]interface{}{"command": "CONTAINS", "priority": 7.0}, 0},
+		{map[string]interface{}{"command": "ADD", "priority": "urgent"}, 1},
+	}
+	for _, test := range tests {
+		config := Config{Priorities: PriorityConfig{Enabled: true}}
+		if got := priorityOf(config, task{Message: test.message}); got != test.expected {
+			t.Errorf("%v: expected priority %v, got %v", test.message, test.expected, got)
+		}
+	}
+}
+
+func TestStealingRejectsPriorities(t *testing.T) {
+	config := Config{
+		Encoder:    json.NewEncoder(&bytes.Buffer{}),
+		Decoder:    json.NewDecoder(strings.NewReader(addRequests(1))),
+		Mode:       "ws",
+		Priorities: PriorityConfig{Enabled: true},
+	}
+	if err := Run(config); err != ErrNoPriorities {
+		t.Errorf("Expected ErrNoPriorities, got %v", err)
+	}
+}
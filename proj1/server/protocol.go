@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"proj1/wire"
+)
+
+// Decoder reads messages from an input stream, like a *json.Decoder
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// Encoder writes messages to an output stream, like a *json.Encoder
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Protocol is the format of the requests and responses on the wire. The
+// Decoder and Encoder handle one stream, the other methods let several
+// goroutines split, decode and encode the raw frames of a stream in parallel.
+type Protocol interface {
+	NewDecoder(r io.Reader) Decoder
+	NewEncoder(w io.Writer) Encoder
+	// ReadFrame reads the raw form of the next message. The frame is nil
+	// when the input read holds no message, e.g. a blank line.
+	ReadFrame(reader *bufio.Reader) ([]byte, error)
+	Unmarshal(frame []byte) (map[string]interface{}, error)
+	// AppendFrame appends the raw form of a message to dst
+	AppendFrame(dst []byte, message map[string]interface{}) ([]byte, error)
+	IsDone(frame []byte) bool // Whether a frame is the DONE command
+}
+
+// The protocols of the server
+var (
+	JSON   Protocol = jsonProtocol{}   // Newline-delimited JSON, the default
+	Binary Protocol = binaryProtocol{} // Length-prefixed frames of package wire
+)
+
+// LookupProtocol returns the protocol with a name, "json" or "binary"
+func LookupProtocol(name string) (Protocol, error) {
+	switch name {
+	case "", "json":
+		return JSON, nil
+	case "binary":
+		return Binary, nil
+	}
+	return nil, fmt.Errorf("unknown protocol %q (available: json, binary)", name)
+}
+
+// protocolOf returns the protocol of the configuration
+func protocolOf(config Config) Protocol {
+	if config.Protocol == nil {
+		return JSON
+	}
+	return config.Protocol
+}
+
+// withProtocol fills in the protocol of the configuration and the Decoder
+// and Encoder of its raw streams when they are not given
+func withProtocol(config Config) Config {
+	config.Protocol = protocolOf(config)
+	if config.Decoder == nil && config.Reader != nil {
+		config.Decoder = config.Protocol.NewDecoder(config.Reader)
+	}
+	if config.Encoder == nil && config.Writer != nil {
+		config.Encoder = config.Protocol.NewEncoder(config.Writer)
+	}
+	return config
+}
+
+// jsonProtocol reads and writes one JSON object per line
+type jsonProtocol struct{}
+
+func (jsonProtocol) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+func (jsonProtocol) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+
+func (jsonProtocol) ReadFrame(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, err
+	}
+	return line, err
+}
+
+func (jsonProtocol) Unmarshal(frame []byte) (map[string]interface{}, error) {
+	var message map[string]interface{}
+	err := json.Unmarshal(frame, &message)
+	return message, err
+}
+
+func (jsonProtocol) AppendFrame(dst []byte, message map[string]interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, encoded...)
+	return append(dst, '\n'), nil
+}
+
+// IsDone only parses the lines mentioning DONE, every other line is left to
+// the decoding
+func (jsonProtocol) IsDone(frame []byte) bool {
+	if !bytes.Contains(frame, []byte("DONE")) {
+		return false
+	}
+	var message struct {
+		Command string `json:"command"`
+	}
+	return json.Unmarshal(frame, &message) == nil && message.Command == "DONE"
+}
+
+// binaryProtocol reads and writes the length-prefixed frames of package wire
+type binaryProtocol struct{}
+
+func (binaryProtocol) NewDecoder(r io.Reader) Decoder { return wire.NewDecoder(r) }
+func (binaryProtocol) NewEncoder(w io.Writer) Encoder { return wire.NewEncoder(w) }
+
+func (binaryProtocol) ReadFrame(reader *bufio.Reader) ([]byte, error) {
+	return wire.ReadFrame(reader)
+}
+
+func (binaryProtocol) Unmarshal(frame []byte) (map[string]interface{}, error) {
+	return wire.Unmarshal(frame)
+}
+
+func (binaryProtocol) AppendFrame(dst []byte, message map[string]interface{}) ([]byte, error) {
+	return wire.AppendFrame(dst, message)
+}
+
+func (binaryProtocol) IsDone(frame []byte) bool {
+	return wire.IsDone(frame)
+}
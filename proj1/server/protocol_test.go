@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"proj1/wire"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// toBinary converts newline-delimited JSON requests to binary frames
+func toBinary(t *testing.T, input string) []byte {
+	var frames []byte
+	decoder := json.NewDecoder(strings.NewReader(input))
+	for {
+		var message map[string]interface{}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if frames, err = wire.AppendFrame(frames, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// decodeAll decodes every message of a stream
+func decodeAll(t *testing.T, decoder Decoder) []map[string]interface{} {
+	var messages []map[string]interface{}
+	for {
+		var message map[string]interface{}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return messages
+		} else if err != nil {
+			t.Fatalf("Malformed output: %v", err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestLookupProtocol(t *testing.T) {
+	var tests = []struct {
+		name     string
+		expected Protocol
+	}{
+		{"", JSON},
+		{"json", JSON},
+		{"binary", Binary},
+	}
+	for _, test := range tests {
+		if protocol, err := LookupProtocol(test.name); err != nil || protocol != test.expected {
+			t.Errorf("%q: expected %T, got %T (%v)", test.name, test.expected, protocol, err)
+		}
+	}
+	if _, err := LookupProtocol("xml"); err == nil {
+		t.Errorf("Expected an error for an unknown protocol")
+	}
+}
+
+// The binary protocol gives the same responses as JSON in every version
+func TestBinaryProtocol(t *testing.T) {
+	input := orderedRequests(100) + "{\"command\": \"FEED\", \"id\": 1000, \"client\": \"alice\"}\n{\"command\": \"CONTAINS\", \"id\": 1001}\n{\"command\": \"DONE\"}\n"
+	var expected bytes.Buffer
+	if err := Run(Config{Encoder: json.NewEncoder(&expected), Decoder: json.NewDecoder(strings.NewReader(input)), Mode: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	ordered := decodeAll(t, json.NewDecoder(&expected))
+
+	var output bytes.Buffer
+	config := Config{Reader: bytes.NewReader(toBinary(t, input)), Writer: &output, Protocol: Binary, Mode: "s"}
+	if err := Run(config); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if responses := decodeAll(t, wire.NewDecoder(&output)); !reflect.DeepEqual(responses, ordered) {
+		t.Errorf("Expected the responses of the JSON protocol, got %v", responses)
+	}
+
+	// The parallel versions only agree on the requests that do not race
+	tasks := 200
+	input = addRequests(tasks) + "{\"command\": \"DONE\"}\n"
+	var tests = []struct {
+		mode      string
+		producers int
+		pipeline  PipelineConfig
+	}{
+		{"s", 4, PipelineConfig{}},
+		{"p", 1, PipelineConfig{}},
+		{"ws", 1, PipelineConfig{}},
+		{"a", 1, PipelineConfig{}},
+		{"pipeline", 1, PipelineConfig{Decode: StageConfig{Workers: 4}, Encode: StageConfig{Workers: 2}}},
+	}
+	for _, test := range tests {
+		var output syncBuffer
+		config := Config{
+			Reader:         bytes.NewReader(toBinary(t, input)),
+			Writer:         &output,
+			Protocol:       Binary,
+			Mode:           test.mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 4,
+			ProducersCount: test.producers,
+			Pipeline:       test.pipeline,
+		}
+		if err := Run(config); err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", test.mode, err)
+		}
+		seen := make(map[float64]bool)
+		for _, response := range decodeAll(t, wire.NewDecoder(bytes.NewReader(output.Bytes()))) {
+			if response["success"] != true {
+				t.Errorf("%v: expected a success, got %v", test.mode, response)
+			}
+			seen[response["id"].(float64)] = true
+		}
+		if len(seen) != tasks {
+			t.Errorf("%v: expected %v responses, got %v", test.mode, tasks, len(seen))
+		}
+	}
+}
+
+func TestBinaryMalformedInput(t *testing.T) {
+	frames := append(toBinary(t, addRequests(2)), 3, wire.OpAdd)
+	for _, producers := range []int{1, 4} {
+		var output syncBuffer
+		config := Config{Reader: bytes.NewReader(frames), Writer: &output, Protocol: Binary, Mode: "s", ProducersCount: producers}
+		if err := Run(config); err != io.ErrUnexpectedEOF {
+			t.Errorf("P=%v: expected %v, got %v", producers, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestServeBinary(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- Serve(Config{Mode: "p", ConsumersCount: 2, Shutdown: signals, Protocol: Binary, FeedImpl: testFeed}, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(toBinary(t, addRequests(10)+"{\"command\": \"DONE\"}\n"))
+	responses := decodeAll(t, wire.NewDecoder(bufio.NewReader(conn)))
+	if len(responses) != 10 {
+		t.Errorf("Expected 10 responses, got %v", responses)
+	}
+
+	signals <- os.Interrupt
+	waitResult(t, result)
+}
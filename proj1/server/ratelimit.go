@@ -0,0 +1,312 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to
+// Burst tokens. Every request takes one token.
+type RateLimit struct {
+	Rate  float64 // Requests per second (0 = unlimited)
+	Burst int     // Requests that can be made at once (default the rate rounded up)
+}
+
+// RateLimitConfig limits how fast each client can send requests. A client is
+// identified by the optional "client" field of its requests. Every client has
+// one bucket per command, limited by the class of the command unless the
+// command has its own limit, and optionally one bucket for all its requests.
+type RateLimitConfig struct {
+	Writes   RateLimit            // Limit of the ADD and REMOVE commands
+	Reads    RateLimit            // Limit of the CONTAINS and FEED commands
+	Commands map[string]RateLimit // Limits of single commands, overriding their class
+	Client   RateLimit            // Limit of all the requests of a client
+}
+
+// anonymousClient identifies the requests without a "client" field
+const anonymousClient = "anonymous"
+
+// writeCommands are the commands limited by RateLimitConfig.Writes
+var writeCommands = map[string]bool{"ADD": true, "REMOVE": true}
+
+// ParseRateLimits parses limits of the form "writes=100/20,FEED=1,client=500",
+// where each limit is given as name=rate[/burst] with the rate in requests
+// per second. The names are writes, reads, client or a command.
+func ParseRateLimits(spec string) (RateLimitConfig, error) {
+	var config RateLimitConfig
+	for _, field := range strings.Split(spec, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return config, fmt.Errorf("invalid rate limit %q", field)
+		}
+		values := strings.SplitN(parts[1], "/", 2)
+		rate, err := strconv.ParseFloat(values[0], 64)
+		if err != nil || rate < 0 {
+			return config, fmt.Errorf("invalid rate in %q", field)
+		}
+		limit := RateLimit{Rate: rate}
+		if len(values) == 2 {
+			limit.Burst, err = strconv.Atoi(values[1])
+			if err != nil || limit.Burst < 1 {
+				return config, fmt.Errorf("invalid burst in %q", field)
+			}
+		}
+		name := strings.TrimSpace(parts[0])
+		switch name {
+		case "writes":
+			config.Writes = limit
+		case "reads":
+			config.Reads = limit
+		case "client":
+			config.Client = limit
+		default:
+			command := strings.ToUpper(name)
+			if !feedCommands[command] {
+				return config, fmt.Errorf("invalid rate limit %q", field)
+			}
+			if config.Commands == nil {
+				config.Commands = make(map[string]RateLimit)
+			}
+			config.Commands[command] = limit
+		}
+	}
+	return config, nil
+}
+
+// enabled checks whether any limit is set
+func (config RateLimitConfig) enabled() bool {
+	if config.Writes.Rate > 0 || config.Reads.Rate > 0 || config.Client.Rate > 0 {
+		return true
+	}
+	for _, limit := range config.Commands {
+		if limit.Rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// limitOf returns the limit of a command
+func (config RateLimitConfig) limitOf(command string) RateLimit {
+	if limit, ok := config.Commands[command]; ok {
+		return limit
+	} else if writeCommands[command] {
+		return config.Writes
+	}
+	return config.Reads
+}
+
+// tokenBucket holds the tokens left for one client and command
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+	used    time.Time // Last request admitted or limited against the bucket
+	allowed int64     // Requests that got a token
+	limited int64     // Requests rejected for lack of a token
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Burst < 1 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), updated: now, used: now}
+}
+
+// refill adds the tokens earned since the last update
+func (bucket *tokenBucket) refill(now time.Time) {
+	if bucket.limit.Rate <= 0 {
+		return
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * bucket.limit.Rate
+	if bucket.tokens > float64(bucket.limit.Burst) {
+		bucket.tokens = float64(bucket.limit.Burst)
+	}
+	bucket.updated = now
+}
+
+// retryAfter returns how long it takes until the bucket holds a token
+func (bucket *tokenBucket) retryAfter() time.Duration {
+	if bucket.limit.Rate <= 0 || bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.limit.Rate * float64(time.Second))
+}
+
+// bucketKey identifies a bucket, the bucket of all the requests of a client
+// has an empty command
+type bucketKey struct {
+	client  string
+	command string
+}
+
+// bucketIdleTimeout is how long a full bucket is kept without requests. A
+// full bucket behaves like a new one, so forgetting it only resets its QUOTA
+// counters and keeps clients that come and go from growing the map forever.
+var bucketIdleTimeout = time.Minute
+
+// rateLimiter admits the requests of every client against its buckets
+type rateLimiter struct {
+	config  RateLimitConfig
+	mutex   sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+	swept   time.Time // Last time the idle buckets were evicted
+}
+
+// newRateLimiter creates a limiter, or returns nil if no limit is set
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if !config.enabled() {
+		return nil
+	}
+	return &rateLimiter{config: config, buckets: make(map[bucketKey]*tokenBucket), swept: time.Now()}
+}
+
+// evict forgets the buckets that are full and were not used for
+// bucketIdleTimeout, at most once per bucketIdleTimeout. It must be called
+// with the mutex held.
+func (limiter *rateLimiter) evict(now time.Time) {
+	if now.Sub(limiter.swept) < bucketIdleTimeout {
+		return
+	}
+	limiter.swept = now
+	for key, bucket := range limiter.buckets {
+		bucket.refill(now)
+		if now.Sub(bucket.used) >= bucketIdleTimeout && bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// bucket returns the bucket of a key, creating it if needed. It must be
+// called with the mutex held.
+func (limiter *rateLimiter) bucket(key bucketKey, limit RateLimit, now time.Time) *tokenBucket {
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(limit, now)
+		limiter.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	return bucket
+}
+
+// admit takes a token for a request. If one of its buckets is empty, the
+// request is not admitted and admit returns how long to wait before retrying.
+// Requests that are not one of the feed commands are always admitted.
+func (limiter *rateLimiter) admit(request task) (bool, time.Duration) {
+	command, _ := request.Message["command"].(string)
+	if !feedCommands[command] {
+		return true, 0
+	}
+	client := clientOf(request)
+	now := time.Now()
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.evict(now)
+	buckets := []*tokenBucket{limiter.bucket(bucketKey{client, command}, limiter.config.limitOf(command), now)}
+	if limiter.config.Client.Rate > 0 {
+		buckets = append(buckets, limiter.bucket(bucketKey{client, ""}, limiter.config.Client, now))
+	}
+	// Check every bucket before taking the tokens so a rejected request
+	// does not use up any of them
+	var retryAfter time.Duration
+	for _, bucket := range buckets {
+		if wait := bucket.retryAfter(); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.used = now
+		if retryAfter > 0 {
+			bucket.limited++
+		} else {
+			bucket.allowed++
+			if bucket.limit.Rate > 0 {
+				bucket.tokens--
+			}
+		}
+	}
+	return retryAfter == 0, retryAfter
+}
+
+// usage returns the allowed and limited requests and the tokens left of
+// every bucket, by client and then by command ("*" for the client bucket).
+// Only the given client is included unless it is empty.
+func (limiter *rateLimiter) usage(only string) map[string]interface{} {
+	now := time.Now()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	clients := make(map[string]interface{})
+	for key, bucket := range limiter.buckets {
+		if only != "" && key.client != only {
+			continue
+		}
+		bucket.refill(now)
+		commands, ok := clients[key.client].(map[string]interface{})
+		if !ok {
+			commands = make(map[string]interface{})
+			clients[key.client] = commands
+		}
+		name := key.command
+		if name == "" {
+			name = "*"
+		}
+		entry := map[string]interface{}{"allowed": bucket.allowed, "limited": bucket.limited}
+		if bucket.limit.Rate > 0 {
+			entry["tokens"] = bucket.tokens
+			entry["rate"] = bucket.limit.Rate
+			entry["burst"] = bucket.limit.Burst
+		}
+		commands[name] = entry
+	}
+	return clients
+}
+
+// clientOf returns the client that sent a request
+func clientOf(request task) string {
+	if client, ok := request.Message["client"].(string); ok && client != "" {
+		return client
+	}
+	return anonymousClient
+}
+
+// admitRequest counts a request read from the input, applies the rate limits
+// and answers the QUOTA and STATS admin commands. It returns the response to
+// send instead of executing the request, or nil if the request should be
+// executed.
+func admitRequest(config Config, limiter *rateLimiter, request task) map[string]interface{} {
+	config.Metrics.requestRead(request.Message["command"])
+	if request.Message["command"] == "STATS" {
+		return map[string]interface{}{"id": request.Message["id"], "stats": config.Metrics.stats()}
+	}
+	if request.Message["command"] == "QUOTA" {
+		only, _ := request.Message["client"].(string)
+		quota := map[string]interface{}{}
+		if limiter != nil {
+			quota = limiter.usage(only)
+		}
+		return map[string]interface{}{"id": request.Message["id"], "quota": quota}
+	}
+	// Malformed requests are dropped later without using up a token
+	if limiter == nil || !validRequest(request) {
+		return nil
+	}
+	if ok, retryAfter := limiter.admit(request); !ok {
+		response := errorMessage(request, ErrorRateLimited)
+		response["retry_after_ms"] = math.Ceil(float64(retryAfter) / float64(time.Millisecond))
+		config.Metrics.responded(request.Message["command"], response)
+		return response
+	}
+	return nil
+}
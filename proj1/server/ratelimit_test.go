@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	var tests = []struct {
+		spec     string
+		expected RateLimitConfig
+		valid    bool
+	}{
+		{"", RateLimitConfig{}, true},
+		{"writes=100/20,reads=1000", RateLimitConfig{Writes: RateLimit{100, 20}, Reads: RateLimit{1000, 0}}, true},
+		{"feed=0.5, client=50/5", RateLimitConfig{Commands: map[string]RateLimit{"FEED": {0.5, 0}}, Client: RateLimit{50, 5}}, true},
+		{"writes", RateLimitConfig{}, false},
+		{"writes=-1", RateLimitConfig{}, false},
+		{"writes=10/0", RateLimitConfig{}, false},
+		{"DONE=10", RateLimitConfig{}, false},
+	}
+	for _, test := range tests {
+		config, err := ParseRateLimits(test.spec)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid = %v, got %v", test.spec, test.valid, err)
+		} else if test.valid && !reflect.DeepEqual(config, test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.spec, test.expected, config)
+		}
+	}
+}
+
+// fromClient returns a request of a command sent by a client
+func fromClient(client string, command string) task {
+	return task{Message: map[string]interface{}{"command": command, "client": client}}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfig{
+		Writes:   RateLimit{Rate: 10, Burst: 2},
+		Commands: map[string]RateLimit{"FEED": {Rate: 1}},
+		Client:   RateLimit{Rate: 100, Burst: 4},
+	})
+	var tests = []struct {
+		request  task
+		admitted bool
+	}{
+		{fromClient("a", "ADD"), true},
+		{fromClient("a", "REMOVE"), true}, // Every command has its own bucket
+		{fromClient("a", "ADD"), true},
+		{fromClient("a", "ADD"), false}, // The burst of the writes is used up
+		{fromClient("b", "ADD"), true},  // Clients do not share buckets
+		{fromClient("a", "CONTAINS"), true},
+		{fromClient("a", "FEED"), false}, // The client used up its burst of 4
+		{fromClient("a", "DONE"), true},  // Only the feed commands are limited
+		{fromClient("b", "FEED"), true},
+		{fromClient("b", "FEED"), false},
+	}
+	for i, test := range tests {
+		admitted, retryAfter := limiter.admit(test.request)
+		if admitted != test.admitted {
+			t.Errorf("Request %v: expected admitted = %v, got %v", i, test.admitted, admitted)
+		}
+		if !admitted && retryAfter <= 0 {
+			t.Errorf("Request %v: expected a retry-after hint, got %v", i, retryAfter)
+		}
+	}
+	// The writes bucket earns a token every 100ms
+	time.Sleep(110 * time.Millisecond)
+	if admitted, _ := limiter.admit(fromClient("a", "ADD")); !admitted {
+		t.Errorf("Expected the bucket to be refilled")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfig{Writes: RateLimit{Rate: 0.001, Burst: 1}, Reads: RateLimit{Rate: 1000}})
+	for i := 0; i < 100; i++ {
+		limiter.admit(fromClient(strconv.Itoa(i), "CONTAINS"))
+	}
+	limiter.admit(fromClient("writer", "ADD"))
+	if len(limiter.buckets) != 101 {
+		t.Fatalf("Expected 101 buckets, got %v", len(limiter.buckets))
+	}
+	// Too early to evict anything
+	limiter.evict(time.Now())
+	if len(limiter.buckets) != 101 {
+		t.Errorf("Expected the recent buckets to be kept, got %v", len(limiter.buckets))
+	}
+	// The reads buckets refilled, the writes bucket is still far from full
+	limiter.evict(time.Now().Add(2 * bucketIdleTimeout))
+	if _, ok := limiter.buckets[bucketKey{"writer", "ADD"}]; !ok || len(limiter.buckets) != 1 {
+		t.Errorf("Expected only the bucket of the writer to be kept, got %v", limiter.buckets)
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	input := strings.Join([]string{
+		// Malformed requests are dropped without using up a token
+		"{\"command\": \"ADD\", \"id\": 0, \"client\": \"alice\"}",
+		"{\"command\": \"ADD\", \"id\": 1, \"body\": \"1\", \"timestamp\": 1, \"client\": \"alice\"}",
+		"{\"command\": \"ADD\", \"id\": 2, \"body\": \"2\", \"timestamp\": 2, \"client\": \"alice\"}",
+		"{\"command\": \"ADD\", \"id\": 3, \"body\": \"3\", \"timestamp\": 3, \"client\": \"bob\"}",
+		"{\"command\": \"CONTAINS\", \"id\": 4, \"timestamp\": 2}",
+		"{\"command\": \"QUOTA\", \"id\": 5, \"client\": \"alice\"}",
+	}, "\n")
+	for _, mode := range []string{"s", "p", "pipeline"} {
+		var output syncBuffer
+		config := Config{
+			Encoder:        json.NewEncoder(&output),
+			Decoder:        json.NewDecoder(strings.NewReader(input)),
+			Mode:           mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 1,
+			RateLimits:     RateLimitConfig{Writes: RateLimit{Rate: 0.001, Burst: 1}},
+		}
+		if err := Run(config); err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+		responses := make(map[float64]map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+		for {
+			var response map[string]interface{}
+			if err := decoder.Decode(&response); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: malformed output: %v", mode, err)
+			}
+			responses[response["id"].(float64)] = response
+		}
+		if len(responses) != 5 {
+			t.Fatalf("%v: expected 5 responses, got %v", mode, responses)
+		}
+		if responses[1]["success"] != true || responses[3]["success"] != true {
+			t.Errorf("%v: expected the first write of every client to succeed, got %v", mode, responses)
+		}
+		if responses[2]["error"] != ErrorRateLimited || responses[2]["retry_after_ms"].(float64) <= 0 {
+			t.Errorf("%v: expected the second write of alice to be limited, got %v", mode, responses[2])
+		}
+		if responses[4]["success"] != false {
+			t.Errorf("%v: expected the limited ADD not to be executed, got %v", mode, responses[4])
+		}
+		expected := map[string]interface{}{"alice": map[string]interface{}{
+			"ADD": map[string]interface{}{"allowed": 1.0, "limited": 1.0, "rate": 0.001, "burst": 1.0},
+		}}
+		quota := responses[5]["quota"].(map[string]interface{})
+		if alice, ok := quota["alice"].(map[string]interface{}); ok {
+			// The tokens keep refilling, only check that they are reported
+			if add, ok := alice["ADD"].(map[string]interface{}); ok {
+				if _, ok := add["tokens"].(float64); !ok {
+					t.Errorf("%v: expected the tokens left, got %v", mode, add)
+				}
+				delete(add, "tokens")
+			}
+		}
+		if !reflect.DeepEqual(quota, expected) {
+			t.Errorf("%v: expected the quota %v, got %v", mode, expected, quota)
+		}
+	}
+}
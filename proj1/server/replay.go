@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"proj1/record"
+	"reflect"
+)
+
+// Difference is a recorded request whose replayed response differs from the
+// recorded one
+type Difference struct {
+	Entry    *record.Entry          // The recorded request and response
+	Replayed map[string]interface{} // The response of the replay
+	// The feed operation overlapped other operations, so the order of the
+	// replay may not be the order the operations took effect in
+	Concurrent bool
+}
+
+// Replay re-executes the requests of a recording that reached the feed one
+// at a time, in the order of their linearization points, against a fresh
+// feed of the implementations of the configuration. It returns the requests
+// whose response differs from the recording, in replay order. Requests
+// answered with an error such as TIMEOUT did not change the feed, so they are
+// neither replayed nor compared.
+func Replay(config Config, recording io.Reader) ([]Difference, error) {
+	entries, err := record.Read(recording)
+	if err != nil {
+		return nil, err
+	}
+	feed, err := newFeed(config)
+	if err != nil {
+		return nil, err
+	}
+	executed := feedOperations(entries)
+	var differences []Difference
+	for _, entry := range executed {
+		replayed := normalize(runRequest(feed, task{Message: entry.Request}, 0).Message)
+		if reflect.DeepEqual(replayed, entry.Response) {
+			continue
+		}
+		difference := Difference{Entry: entry, Replayed: replayed}
+		for _, other := range executed {
+			if other != entry && entry.Overlaps(other) {
+				difference.Concurrent = true
+				break
+			}
+		}
+		differences = append(differences, difference)
+	}
+	return differences, nil
+}
+
+// normalize converts a response to the values it holds once decoded from
+// JSON, as in a recording
+func normalize(response map[string]interface{}) map[string]interface{} {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return response
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return response
+	}
+	return normalized
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"proj1/record"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	posts := 100
+	input := orderedRequests(posts) + "{\"command\": \"FEED\", \"id\": 1000}\n{\"command\": \"LIKE\", \"id\": 1001}\n"
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		var output, recording syncBuffer
+		recorder := record.NewRecorder(&recording, false)
+		config := Config{
+			Encoder:        json.NewEncoder(&output),
+			Decoder:        json.NewDecoder(strings.NewReader(input)),
+			Mode:           mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 4,
+			Recorder:       recorder,
+		}
+		if err := Run(config); err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+		if err := recorder.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := record.Read(bytes.NewReader(recording.Bytes()))
+		if err != nil {
+			t.Fatalf("%v: malformed recording: %v", mode, err)
+		}
+		if len(entries) != 4*posts+2 {
+			t.Fatalf("%v: expected %v entries, got %v", mode, 4*posts+2, len(entries))
+		}
+		for i, entry := range entries {
+			if entry.Arrival != uint64(i+1) || entry.Request["id"] == nil {
+				t.Errorf("%v: expected request %v, got %+v", mode, i+1, entry)
+			}
+			if entry.Request["command"] == "LIKE" {
+				if entry.Response != nil || entry.Linearized != 0 {
+					t.Errorf("%v: expected the invalid request to be dropped, got %+v", mode, entry)
+				}
+				continue
+			}
+			if entry.Response["id"] != entry.Request["id"] || entry.Linearized == 0 {
+				t.Errorf("%v: expected the response and linearization of %+v", mode, entry)
+			}
+			if (mode == "s") != (entry.Consumer == -1) || entry.Consumer >= 4 {
+				t.Errorf("%v: unexpected consumer %v", mode, entry.Consumer)
+			}
+		}
+
+		// Only the order of concurrent operations can make the replay differ
+		differences, err := Replay(Config{}, bytes.NewReader(recording.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, difference := range differences {
+			if !difference.Concurrent {
+				t.Errorf("%v: %v was recorded as %v but replayed as %v", mode, difference.Entry.Request, difference.Entry.Response, difference.Replayed)
+			}
+		}
+	}
+}
+
+func TestReplayFlagsDifferences(t *testing.T) {
+	input := orderedRequests(10)
+	var recording bytes.Buffer
+	recorder := record.NewRecorder(&recording, false)
+	config := Config{Encoder: json.NewEncoder(&bytes.Buffer{}), Decoder: json.NewDecoder(strings.NewReader(input)), Mode: "s", Recorder: recorder}
+	if err := Run(config); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+
+	// Pretend the first CONTAINS of the fourth post did not find it
+	tampered := strings.Replace(recording.String(), "\"response\":{\"id\":13,\"success\":true}", "\"response\":{\"id\":13,\"success\":false}", 1)
+	if tampered == recording.String() {
+		t.Fatalf("Unexpected recording %v", recording.String())
+	}
+	differences, err := Replay(Config{}, strings.NewReader(tampered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(differences) != 1 || differences[0].Entry.Request["id"] != 13.0 || differences[0].Replayed["success"] != true || differences[0].Concurrent {
+		t.Errorf("Expected only request 13 to differ, got %+v", differences)
+	}
+	if _, err := Replay(Config{}, strings.NewReader("{")); err == nil {
+		t.Errorf("Expected an error for a malformed recording")
+	}
+}
+
+// A request that expired in the queue did not change the feed, so the replay
+// must not run it either
+func TestReplaySkipsTimeouts(t *testing.T) {
+	input := "{\"command\": \"ADD\", \"id\": 1, \"body\": \"expired\", \"timestamp\": 1, \"timeout_ms\": 0}\n" +
+		"{\"command\": \"CONTAINS\", \"id\": 2, \"timestamp\": 1}\n"
+	var output, recording bytes.Buffer
+	recorder := record.NewRecorder(&recording, false)
+	config := Config{Encoder: json.NewEncoder(&output), Decoder: json.NewDecoder(strings.NewReader(input)), Mode: "s", Recorder: recorder}
+	if err := Run(config); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+	if !strings.Contains(output.String(), ErrorTimeout) || !strings.Contains(output.String(), "{\"id\":2,\"success\":false}") {
+		t.Fatalf("Expected the ADD to time out and the CONTAINS to fail, got %v", output.String())
+	}
+
+	differences, err := Replay(Config{}, bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, difference := range differences {
+		t.Errorf("%v was recorded as %v but replayed as %v", difference.Entry.Request, difference.Entry.Response, difference.Replayed)
+	}
+}
@@ -1,87 +1,242 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"io"
+	"os"
 	"proj1/feed"
+	"proj1/lock"
 	"proj1/queue"
+	"proj1/record"
+	"proj1/trace"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 type Config struct {
-	Encoder *json.Encoder // Represents the buffer to encode Responses
-	Decoder *json.Decoder // Represents the buffer to decode Requests
-	Mode    string        // Represents whether the server should execute
+	Encoder Encoder // Represents the buffer to encode Responses
+	Decoder Decoder // Represents the buffer to decode Requests
+	Mode    string  // Represents whether the server should execute
 	// sequentially or in parallel
 	// If Mode == "s"  then run the sequential version
 	// If Mode == "p"  then run the parallel version
+	// If Mode == "ws" then run the parallel version with work stealing
+	// If Mode == "pipeline" then run the channel based pipeline version
+	// If Mode == "a" then run the parallel version with an adaptive number of consumers
 	// These are the only values for Version
 	ConsumersCount int // Represents the number of consumers to spawn
+	// How the work stealing version distributes requests to the consumers:
+	// "rr" (round-robin, the default) or "hash" (by timestamp)
+	Distribution   string
+	ProducersCount int // Number of goroutines decoding the input (0 or 1 = a single producer)
+	// Raw newline-delimited JSON input. It is required to decode with more
+	// than one producer, in which case it is read instead of the Decoder.
+	Reader io.Reader
+	// Raw output. When it is set, the responses are encoded by the consumers
+	// and written to it in batches by a single goroutine instead of using
+	// the Encoder.
+	Writer io.Writer
+	Output OutputConfig // Batching of the responses written to the Writer
+	// Format of the requests and responses (nil = JSON). The Decoder and
+	// Encoder are created from the Reader and Writer when they are not given.
+	Protocol Protocol
+	Pipeline PipelineConfig // Stages of the pipeline version
+	// Names of the registered implementations of the feed, the task queue of
+	// the p and a versions and the locks of the feed ("" = the default of
+	// each one, see feed.Names, queue.Names and lock.Names)
+	FeedImpl  string
+	QueueImpl string
+	LockImpl  string
+	Scaling   ScalingConfig // Consumer bounds of the adaptive version
+	// Token bucket limits of each client, checked as the requests are read
+	RateLimits RateLimitConfig
+	Metrics    *Metrics      // Optional instrumentation, also answers the STATS command
+	Tracer     *trace.Tracer // Optional structured logs and timestamps of every request
+	// Optional recording of every request for Replay
+	Recorder *record.Recorder
+	// Optional cache of the responses to the requests with an idempotency key
+	Idempotency *IdempotencyCache
+	// Priority queue of the parallel and adaptive versions (FIFO when
+	// disabled), the work stealing version cannot enable it
+	Priorities PriorityConfig
+	// Optional channel of shutdown signals (e.g. from signal.Notify). The first
+	// signal stops the producer from accepting input and lets the consumers
+	// drain the queue, a second signal forces the shutdown.
+	Shutdown        <-chan os.Signal
+	ShutdownTimeout time.Duration // Forces the shutdown if draining takes longer (0 = no deadline)
+	QueueCapacity   int           // Maximum number of queued requests of the p, ws and a versions (0 = unbounded)
+	RejectWhenFull  bool          // Answer with an OVERLOADED error instead of blocking the producer on a full queue
+	// Optional hook called with the queue depth every time it changes, it must
+	// be safe for concurrent use
+	OnQueueDepth func(depth int64)
+	// Optional hook called with the id of every valid request and the time
+	// it waited in the queue before being executed, it must be safe for
+	// concurrent use
+	OnQueueWait func(id interface{}, wait time.Duration)
 }
 
+// Error codes sent in the "error" field of requests that were not executed
+const (
+	ErrorOverloaded  = "OVERLOADED"   // The queue was full and RejectWhenFull is set
+	ErrorTimeout     = "TIMEOUT"      // The deadline of the request passed before it completed
+	ErrorRateLimited = "RATE_LIMITED" // The client sent the command faster than its rate limit
+)
+
+// SharedContext is the state shared by the producer and the consumers of
+// the parallel and adaptive versions. They terminate with this protocol:
+//
+//   - The producer enqueues every request and sets done with the mutex held,
+//     and wakes up the consumers after each change.
+//   - A consumer only dequeues with the mutex held, after seeing a non-empty
+//     queue, so it never gets the empty queue sentinel.
+//   - A consumer only exits with the mutex held, after seeing both done and
+//     an empty queue. As nothing is enqueued after done, every request
+//     enqueued before it has been dequeued by then.
+//   - A consumer only waits with the mutex held, after seeing neither done
+//     nor a request. The wake-up that follows the next change cannot be
+//     missed, Wait releases the mutex atomically.
 type SharedContext struct {
-	mutex       *sync.Mutex          // Mutex to use for locking
-	cond        *sync.Cond           // Condition variable to use for waiting
-	group       *sync.WaitGroup      // Wait group to use for waiting for consumers
-	done        bool                 // Flag to indicate if the producer has seen the DONE command
-	feed        *feed.Feed           // The twitter feed
-	queue       *queue.LockFreeQueue // The queue of requests
-	queuedTasks int64                // The number of tasks currently queued by the producer
+	mutex   *sync.Mutex     // Guards done and every operation on the queue
+	cond    *sync.Cond      // Consumers wait on it for a request or for done
+	notFull *sync.Cond      // Condition variable the producer waits on when the queue is full
+	group   *sync.WaitGroup // Wait group to use for waiting for consumers
+	done    bool            // Flag to indicate if the producer has stopped adding requests
+	feed    *feed.Feed      // The twitter feed
+	queue   queue.Queue     // The queue of requests
+}
+
+// task is a request with the metadata the server keeps while it goes
+// through a version. The queues carry it as the Value of a queue.Request.
+type task struct {
+	Message  map[string]interface{}
+	Enqueued time.Time     // When the producer added the request to a queue
+	Deadline time.Time     // When the client gives up on the request (zero = never)
+	Span     *trace.Span   // Phase timestamps of the request when tracing (nil otherwise)
+	Record   *record.Entry // Record of the request when recording (nil otherwise)
+}
+
+// queued returns the queue.Request that carries a task through a queue
+func (request *task) queued() *queue.Request {
+	return &queue.Request{Message: request.Message, Value: request}
+}
+
+// taskOf returns the task carried by a queue.Request
+func taskOf(request *queue.Request) *task {
+	return request.Value.(*task)
 }
 
 // Run starts up the twitter server based on the configuration
 // information provided and only returns when the server is fully
-// shutdown.
-func Run(config Config) {
-	// Get the twitter feed
-	feed := feed.NewFeed()
-	if config.Mode == "s" {
-		// Run the sequential version
-		sequentialServer(config, feed)
-	} else if config.Mode == "p" {
-		q := queue.NewLockFreeQueue()
-		// Run the parallel version
-		parallelServer(config, feed, q)
+// shutdown. It returns nil after a DONE command or the end of the input,
+// ErrInterrupted or ErrForcedShutdown after a shutdown signal and the
+// decoding error if the input is malformed.
+func Run(config Config) error {
+	if config.Decoder == nil && config.Reader == nil {
+		return ErrNoInput
 	}
+	server := NewServer(config)
+	if err := server.Start(context.Background()); err != nil {
+		return err
+	}
+	return server.Wait()
+}
+
+// runVersion runs the version of the configuration on the feed until the
+// input ends
+func runVersion(config Config, feed feed.Feed, newQueue queue.Constructor) error {
+	source := newMessageSource(config)
+	defer source.close()
+	config.Tracer.Log(map[string]interface{}{"event": "start", "mode": config.Mode, "consumers": config.ConsumersCount})
+	err := source.wait(func() error {
+		if config.Mode == "s" {
+			// Run the sequential version
+			return sequentialServer(config, feed, source)
+		} else if config.Mode == "p" {
+			q := newTaskQueue(config, newQueue)
+			// Run the parallel version
+			return parallelServer(config, feed, q, source)
+		} else if config.Mode == "ws" {
+			// Run the work stealing version
+			return stealingServer(config, feed, source)
+		} else if config.Mode == "a" {
+			q := newTaskQueue(config, newQueue)
+			// Run the adaptive version
+			return adaptiveServer(config, feed, q, source)
+		} else if config.Mode == "pipeline" {
+			// Run the pipeline version
+			return pipelineServer(config, feed, source)
+		}
+		return nil
+	})
+	stop := map[string]interface{}{"event": "stop"}
+	if err != nil {
+		stop["error"] = err.Error()
+	}
+	config.Tracer.Log(stop)
+	return err
+}
+
+// newFeed creates an empty feed of the implementations of the configuration
+func newFeed(config Config) (feed.Feed, error) {
+	newFeed, err := feed.Lookup(config.FeedImpl)
+	if err != nil {
+		return nil, err
+	}
+	newLock, err := lock.Lookup(config.LockImpl)
+	if err != nil {
+		return nil, err
+	}
+	return newFeed(newLock), nil
 }
 
 // sequentialServer runs the server in sequential mode
-func sequentialServer(config Config, feed feed.Feed) {
-	// Loop until we get a DONE command
-	for {
-		var message map[string]interface{}
+func sequentialServer(config Config, feed feed.Feed, source *messageSource) error {
+	// Process every request as soon as it is decoded until the DONE command
+	return readRequests(source, func(request task) {
+		processRequest(config, feed, request)
+	})
+}
 
+// readRequests decodes requests and hands each one to dispatch until the DONE
+// command, the end of the input, a decoding error or a shutdown signal. The
+// returned error tells which one it was (nil for DONE and the end of input).
+func readRequests(source *messageSource, dispatch func(request task)) error {
+	for {
 		// Decode the request
-		err := config.Decoder.Decode(&message)
+		message, err := source.next()
 		if err != nil {
-			return
-		} else {
-			// Exit after seeing the DONE command
-			if message["command"] == "DONE" {
-				break
-			}
-
-			// Wrap the request as a task
-			request := queue.Request{Message: message}
-			// Process the request
-			processRequest(config, feed, request)
+			return endOfInput(err)
+		}
+		// Stop after seeing the DONE command
+		if message["command"] == "DONE" {
+			return nil
 		}
+		// Wrap the request as a task
+		request := task{Message: message, Span: source.config.Tracer.Start(message), Record: source.config.Recorder.Arrive(message)}
+		request = withDeadline(request, time.Now())
+		// Answer the requests over their rate limit and the admin commands right away
+		if response := admitRequest(source.config, source.limiter, request); response != nil {
+			writeResponse(source.config, request, response)
+			continue
+		}
+		dispatch(request)
 	}
 }
 
 // parallelServer runs the server in parallel mode
-func parallelServer(config Config, feed feed.Feed, q *queue.LockFreeQueue) {
+func parallelServer(config Config, feed feed.Feed, q queue.Queue, source *messageSource) error {
 	// Shared context
 	group := sync.WaitGroup{}
 	mutex := sync.Mutex{}
 	cond := sync.NewCond(&mutex)
 	context := SharedContext{
-		mutex: &mutex,
-		cond:  cond,
-		group: &group,
-		done:  false,
-		feed:  &feed,
-		queue: q,
+		mutex:   &mutex,
+		cond:    cond,
+		notFull: sync.NewCond(&mutex),
+		group:   &group,
+		done:    false,
+		feed:    &feed,
+		queue:   q,
 	}
 
 	// Spawn the consumers
@@ -91,135 +246,250 @@ func parallelServer(config Config, feed feed.Feed, q *queue.LockFreeQueue) {
 	}
 
 	// producer to add requests to the queue
-	producer(config, &context)
+	err := producer(config, &context, source)
+	// Wait for the consumers to drain the queue
 	context.group.Wait()
-
+	return err
 }
 
-// consumer processes requests from the queue
+// consumer processes requests from the queue until it is drained after the
+// producer is done
 func consumer(config Config, context *SharedContext, i int) {
-	// Loop until the DONE command is received
+	defer context.group.Done()
+	times := config.Metrics.consumer(i)
 	for {
 		context.mutex.Lock()
-		// If the queue is empty but the producer has not seen the done command, wait
-		if context.queuedTasks == 0 && !context.done {
+		// Wait for a request or for the producer to be done
+		for context.queue.Len() == 0 && !context.done {
+			idle := time.Now()
 			context.cond.Wait()
-		} else if context.queuedTasks == 0 && context.done {
-			// If the queue is empty and the producer has seen the done command, exit
+			times.addIdle(idle)
+		}
+		if context.queue.Len() == 0 {
+			// The producer is done and the queue is drained
 			context.mutex.Unlock()
-			context.group.Done()
 			return
 		}
 
 		// Get the next request from the queue
-		request := context.queue.Dequeue()
+		request := taskOf(context.queue.Dequeue())
+		request.Span.Take(i)
+		// Wake up the producer if it is waiting for room in the queue
+		context.notFull.Signal()
 		context.mutex.Unlock()
+		reportQueueDepth(config, context)
 
 		// Process the request
+		busy := time.Now()
 		processRequest(config, *context.feed, *request)
-		atomic.AddInt64(&context.queuedTasks, int64(-1))
-
-		// If the producer has seen the done command and the queue is empty, exit
-		if context.done && context.queuedTasks <= 0 {
-			context.group.Done()
-			return
-		}
+		times.addBusy(busy)
 	}
 }
 
 // producer add requests to the queue
-func producer(config Config, context *SharedContext) {
-	// Loop until context.done is true
-	for {
-		// Message to decode into
-		var message map[string]interface{}
-		// Decode the request
-		err := config.Decoder.Decode(&message)
-		if err != nil {
+func producer(config Config, context *SharedContext, source *messageSource) error {
+	// Loop until the DONE command, the end of the input or a shutdown signal
+	err := readRequests(source, func(request task) {
+		queued := request.queued()
+		if config.Priorities.Enabled {
+			queued.Priority = priorityOf(config, request)
+		}
+		context.mutex.Lock()
+		// Apply backpressure when the queue is full
+		if !waitForRoom(config, context) {
+			context.mutex.Unlock()
+			respondError(config, request, ErrorOverloaded)
 			return
-		} else {
-			// If the command is DONE, set context.done to true
-			// And notify the consumers
-			// Add return for the producer
-			if message["command"] == "DONE" {
-				context.done = true
-				// Notify all consumers
-				context.cond.Broadcast()
-				return
-			} else {
-				// Wrap the request as a task
-				request := queue.Request{Message: message}
-				// Add the request to the queue
-				context.queue.Enqueue(&request)
-				// Increment the number of queued tasks
-				atomic.AddInt64(&context.queuedTasks, int64(1))
-				// Notify 1 consumer if there are any waiting
-				context.cond.Signal()
-			}
 		}
+		// Add the request to the queue
+		request.Enqueued = time.Now()
+		request.Span.Mark(trace.PhaseEnqueue)
+		context.queue.Enqueue(queued)
+		// Notify 1 consumer if there are any waiting
+		context.cond.Signal()
+		context.mutex.Unlock()
+		reportQueueDepth(config, context)
+	})
+	// Stop accepting input and let the consumers drain what is already queued
+	context.mutex.Lock()
+	context.done = true
+	// Notify all consumers
+	context.cond.Broadcast()
+	context.mutex.Unlock()
+	return err
+}
+
+// waitForRoom blocks the producer until the queue is below its capacity, it
+// must be called with the mutex held. It returns false without waiting if
+// the request should be rejected instead.
+func waitForRoom(config Config, context *SharedContext) bool {
+	if config.QueueCapacity <= 0 {
+		return true
 	}
+	for context.queue.Len() >= int64(config.QueueCapacity) {
+		if config.RejectWhenFull {
+			return false
+		}
+		context.notFull.Wait()
+	}
+	return true
+}
+
+// reportQueueDepth passes the current queue depth to the OnQueueDepth hook
+func reportQueueDepth(config Config, context *SharedContext) {
+	if config.OnQueueDepth == nil && config.Metrics == nil {
+		return
+	}
+	reportDepth(config, context.queue.Len())
+}
+
+// reportDepth records a queue depth in the metrics and passes it to the
+// OnQueueDepth hook
+func reportDepth(config Config, depth int64) {
+	config.Metrics.setQueueDepth(depth)
+	if config.OnQueueDepth != nil {
+		config.OnQueueDepth(depth)
+	}
+}
+
+// respondError answers a request that was not executed with an error code
+func respondError(config Config, request task, code string) {
+	response := errorMessage(request, code)
+	config.Metrics.responded(request.Message["command"], response)
+	writeResponse(config, request, response)
+}
+
+// writeResponse encodes the response to a request and finishes its span
+func writeResponse(config Config, request task, response map[string]interface{}) {
+	request.Span.Mark(trace.PhaseEncode)
+	config.Encoder.Encode(&response)
+	request.Span.Mark(trace.PhaseEncoded)
+	finishRequest(config, request, resultIndex(response), response)
+}
+
+// finishRequest finishes the span and the record of a request once it was
+// answered, or dropped without a response
+func finishRequest(config Config, request task, result int, response map[string]interface{}) {
+	consumer := -1
+	if request.Span != nil {
+		consumer = request.Span.Consumer
+	}
+	config.Tracer.Finish(request.Span, metricResults[result])
+	config.Recorder.Finish(request.Record, consumer, response)
+}
+
+// errorMessage is the response to a request that failed with an error code
+func errorMessage(request task, code string) map[string]interface{} {
+	return map[string]interface{}{"id": request.Message["id"], "success": false, "error": code}
 }
 
 // processRequest processes a single request
-func processRequest(config Config, feed feed.Feed, request queue.Request) {
-	// DONE is included but is checked in a different way
-	acceptedCommands := []string{"ADD", "REMOVE", "CONTAINS", "FEED"}
-	// Check if it is a valid command
-	if request.Message["command"] == nil {
+func processRequest(config Config, feed feed.Feed, request task) {
+	// Requests that are not valid are dropped without a response
+	if !validRequest(request) {
+		config.Metrics.dropped(request.Message["command"])
+		finishRequest(config, request, resultInvalid, nil)
 		return
-	} else {
-		command := request.Message["command"].(string)
-		if !contains(acceptedCommands, command) && command != "DONE" {
-			// This is an invalid command
-			return
-		} else if !contains(acceptedCommands, command) && command == "DONE" {
-			// Return since we recieved the DONE command
-			return
-		} else {
-			// Get the response as a message
-			var response queue.Request
-			// This is needed for initialization
-			response.Message = make(map[string]interface{})
-			response.Message["id"] = request.Message["id"].(float64)
-
-			var success bool
-
-			// Process the request
-			switch command {
-			case "ADD":
-				// Add the post to the feed
-				feed.Add(request.Message["body"].(string), request.Message["timestamp"].(float64))
-				success = true
-			case "REMOVE":
-				// Remove the post from the feed and check the success
-				success = feed.Remove(request.Message["timestamp"].(float64))
-			case "CONTAINS":
-				// Check if the post is in the feed
-				success = feed.Contains(request.Message["timestamp"].(float64))
-			case "FEED":
-				// Get the entire feed
-				response.Message["feed"] = feed.Show()
-			}
-
-			if command != "FEED" {
-				response.Message["success"] = success
-			}
-
-			// Encode the response
-			err := config.Encoder.Encode(&response.Message)
-			if err != nil {
-				return
-			}
+	}
+	// Get the response as a message
+	response := executeRequest(config, feed, request)
+	// Encode the response
+	writeResponse(config, request, response.Message)
+}
+
+// feedCommands are the commands run against the feed, the only ones that
+// are rate limited (DONE, STATS and QUOTA are not)
+var feedCommands = map[string]bool{"ADD": true, "REMOVE": true, "CONTAINS": true, "FEED": true}
+
+// validRequest checks that a request is a known command (DONE is checked in
+// a different way) and carries the fields the command needs
+func validRequest(request task) bool {
+	command, ok := request.Message["command"].(string)
+	if !ok || !feedCommands[command] {
+		return false
+	}
+	if _, ok := request.Message["id"].(float64); !ok {
+		return false
+	}
+	if command != "FEED" {
+		if _, ok := request.Message["timestamp"].(float64); !ok {
+			return false
+		}
+	}
+	if command == "ADD" {
+		if _, ok := request.Message["body"].(string); !ok {
+			return false
+		}
+	}
+	if key, ok := request.Message["idempotency_key"]; ok {
+		if _, ok := key.(string); !ok {
+			return false
 		}
 	}
+	return true
 }
 
-// contains checks if a string is in a slice of strings
-func contains(s []string, str string) bool {
-	for _, v := range s {
-		if v == str {
-			return true
+// executeRequest runs a valid request against the feed and returns its
+// response, or a TIMEOUT error if its deadline passed. Duplicates of a
+// request with an idempotency key are not run, they get its response.
+func executeRequest(config Config, feed feed.Feed, request task) queue.Request {
+	wait := queueWait(request)
+	reportQueueWait(config, request, wait)
+	call, duplicate := deduplicate(config, request)
+	if duplicate != nil {
+		config.Metrics.responded(request.Message["command"], duplicate)
+		return queue.Request{Message: duplicate}
+	}
+	start := time.Now()
+	request.Span.Mark(trace.PhaseExecute)
+	request.Record.Invoke()
+	response := runRequest(feed, request, wait)
+	request.Record.Linearize()
+	request.Span.Mark(trace.PhaseExecuted)
+	config.Metrics.executed(request.Message["command"], wait, time.Since(start))
+	config.Metrics.responded(request.Message["command"], response.Message)
+	config.Idempotency.finish(call, response.Message)
+	return response
+}
+
+// runRequest executes a valid request that waited in the queue for wait
+func runRequest(feed feed.Feed, request task, wait time.Duration) queue.Request {
+	// Requests that expired while queued are not executed
+	if expired(request) {
+		return timeoutResponse(request, wait)
+	}
+	command := request.Message["command"].(string)
+	// Get the response as a message
+	var response queue.Request
+	// This is needed for initialization
+	response.Message = make(map[string]interface{})
+	response.Message["id"] = request.Message["id"].(float64)
+
+	var success bool
+
+	// Process the request
+	switch command {
+	case "ADD":
+		// Add the post to the feed
+		feed.Add(request.Message["body"].(string), request.Message["timestamp"].(float64))
+		success = true
+	case "REMOVE":
+		// Remove the post from the feed and check the success
+		success = feed.Remove(request.Message["timestamp"].(float64))
+	case "CONTAINS":
+		// Check if the post is in the feed
+		success = feed.Contains(request.Message["timestamp"].(float64))
+	case "FEED":
+		// Get the entire feed, giving up if the deadline passes in the meantime
+		posts, ok := feed.ShowUntil(request.Deadline)
+		if !ok {
+			return timeoutResponse(request, wait)
 		}
+		response.Message["feed"] = posts
+	}
+
+	if command != "FEED" {
+		response.Message["success"] = success
 	}
-	return false
+	return response
 }
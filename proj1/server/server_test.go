@@ -0,0 +1,517 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"proj1/feed"
+	"proj1/lock"
+	"proj1/queue"
+	"proj1/trace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addRequests returns n ADD requests as newline-delimited JSON
+func addRequests(n int) string {
+	var builder strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&builder, "{\"command\": \"ADD\", \"id\": %v, \"body\": \"%v\", \"timestamp\": %v}\n", i, i, i)
+	}
+	return builder.String()
+}
+
+// syncBuffer is a bytes.Buffer that several consumers can write to at once
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+// Bytes returns the output, it must only be called once the server returned
+func (b *syncBuffer) Bytes() []byte {
+	return b.buffer.Bytes()
+}
+
+// gatedWriter blocks every write until open is closed
+type gatedWriter struct {
+	open      chan struct{}
+	blocked   chan struct{} // Closed once the first write waits for open
+	blockOnce sync.Once
+	mutex     sync.Mutex
+	buffer    bytes.Buffer
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{open: make(chan struct{}), blocked: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.blockOnce.Do(func() { close(w.blocked) })
+	<-w.open
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buffer.Write(p)
+}
+
+// responses decodes everything written so far
+func (w *gatedWriter) responses(t *testing.T) []map[string]interface{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var responses []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(w.buffer.Bytes()))
+	for {
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err == io.EOF {
+			return responses
+		} else if err != nil {
+			t.Fatalf("Malformed output: %v", err)
+		}
+		responses = append(responses, response)
+	}
+}
+
+// logWatcher is a log that closes the channel of each of its patterns once
+// it contains the pattern
+type logWatcher struct {
+	mutex    sync.Mutex
+	buffer   bytes.Buffer
+	patterns map[string]chan struct{}
+}
+
+func newLogWatcher(patterns ...string) *logWatcher {
+	watcher := &logWatcher{patterns: make(map[string]chan struct{})}
+	for _, pattern := range patterns {
+		watcher.patterns[pattern] = make(chan struct{})
+	}
+	return watcher
+}
+
+func (w *logWatcher) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buffer.Write(p)
+	for pattern, seen := range w.patterns {
+		if bytes.Contains(w.buffer.Bytes(), []byte(pattern)) {
+			close(seen)
+			delete(w.patterns, pattern)
+		}
+	}
+	return len(p), nil
+}
+
+// String returns the log so far
+func (w *logWatcher) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buffer.String()
+}
+
+// wait blocks until the log contains a pattern given to newLogWatcher
+func (w *logWatcher) wait(t *testing.T, pattern string) {
+	w.mutex.Lock()
+	seen, waiting := w.patterns[pattern]
+	w.mutex.Unlock()
+	if !waiting {
+		return
+	}
+	select {
+	case <-seen:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected %q in the log, got\n%v", pattern, w.String())
+	}
+}
+
+// runAsync starts the server and returns a channel with its result
+func runAsync(config Config) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- Run(config)
+	}()
+	return result
+}
+
+// waitResult waits for the server to return
+func waitResult(t *testing.T, result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("The server did not shut down")
+		return nil
+	}
+}
+
+// interruptEvent is logged once a shutdown signal interrupted the server
+const interruptEvent = "\"event\":\"interrupt\""
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	var tests = []struct {
+		mode     string
+		expected int // Responses written after the signal
+	}{
+		{"s", 1},  // Only the request in flight is finished
+		{"p", 20}, // Everything already queued is drained
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			// The input is never closed, only the signal can stop the server
+			input, inputWriter := io.Pipe()
+			defer inputWriter.Close()
+			output := newGatedWriter()
+			signals := make(chan os.Signal, 2)
+			events := newLogWatcher(interruptEvent)
+			tracer := trace.NewTracer(events, false)
+			tracer.LogRequests = false
+			// Every request is reported once queued and once dequeued
+			reports := make(chan int64, 2*20)
+			config := Config{
+				Encoder:        json.NewEncoder(output),
+				Decoder:        json.NewDecoder(input),
+				Mode:           test.mode,
+				FeedImpl:       testFeed,
+				ConsumersCount: 1,
+				Shutdown:       signals,
+				Tracer:         tracer,
+				OnQueueDepth:   func(depth int64) { reports <- depth },
+			}
+			result := runAsync(config)
+
+			go io.WriteString(inputWriter, addRequests(20))
+			// The first request blocks on the output, then the producer
+			// queues the others behind it
+			<-output.blocked
+			if test.mode != "s" {
+				for i := 0; i < 20+1; i++ {
+					<-reports
+				}
+			}
+			signals <- os.Interrupt
+			events.wait(t, interruptEvent)
+			close(output.open)
+
+			if err := waitResult(t, result); err != ErrInterrupted {
+				t.Fatalf("Expected %v, got %v", ErrInterrupted, err)
+			}
+			if got := len(output.responses(t)); got != test.expected {
+				t.Errorf("Expected %v drained responses, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestShutdownForced(t *testing.T) {
+	var tests = []struct {
+		name    string
+		signals int
+		timeout time.Duration
+	}{
+		{"SecondSignal", 2, 0},
+		{"Deadline", 1, 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input, inputWriter := io.Pipe()
+			defer inputWriter.Close()
+			// The output never opens so the consumers can never drain
+			output := newGatedWriter()
+			signals := make(chan os.Signal, 2)
+			config := Config{
+				Encoder:         json.NewEncoder(output),
+				Decoder:         json.NewDecoder(input),
+				Mode:            "p",
+				FeedImpl:        testFeed,
+				ConsumersCount:  2,
+				Shutdown:        signals,
+				ShutdownTimeout: test.timeout,
+			}
+			result := runAsync(config)
+
+			go io.WriteString(inputWriter, addRequests(10))
+			// A consumer holds a request the drain cannot finish
+			<-output.blocked
+			for i := 0; i < test.signals; i++ {
+				signals <- os.Interrupt
+			}
+
+			if err := waitResult(t, result); err != ErrForcedShutdown {
+				t.Fatalf("Expected %v, got %v", ErrForcedShutdown, err)
+			}
+		})
+	}
+}
+
+func TestEndOfInputStopsServer(t *testing.T) {
+	for _, mode := range []string{"s", "p"} {
+		t.Run(mode, func(t *testing.T) {
+			var output bytes.Buffer
+			config := Config{
+				Encoder:        json.NewEncoder(&output),
+				Decoder:        json.NewDecoder(strings.NewReader(addRequests(5))),
+				Mode:           mode,
+				FeedImpl:       testFeed,
+				ConsumersCount: 1,
+			}
+			if err := waitResult(t, runAsync(config)); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+			if got := strings.Count(output.String(), "\n"); got != 5 {
+				t.Errorf("Expected 5 responses, got %v", got)
+			}
+		})
+	}
+}
+
+// depthRecorder records the largest queue depth reported to OnQueueDepth
+type depthRecorder struct {
+	mutex sync.Mutex
+	max   int64
+}
+
+func (recorder *depthRecorder) observe(depth int64) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if depth > recorder.max {
+		recorder.max = depth
+	}
+}
+
+func TestBoundedQueue(t *testing.T) {
+	var tests = []struct {
+		name     string
+		mode     string
+		capacity int
+		reject   bool
+	}{
+		{"Block", "p", 2, false},
+		{"Reject", "p", 1, true},
+		{"StealingBlock", "ws", 2, false},
+		{"StealingReject", "ws", 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tasks := 10
+			output := newGatedWriter()
+			recorder := &depthRecorder{}
+			config := Config{
+				Encoder:        json.NewEncoder(output),
+				Decoder:        json.NewDecoder(strings.NewReader(addRequests(tasks))),
+				Mode:           test.mode,
+				FeedImpl:       testFeed,
+				ConsumersCount: 1,
+				QueueCapacity:  test.capacity,
+				RejectWhenFull: test.reject,
+				OnQueueDepth:   recorder.observe,
+			}
+			result := runAsync(config)
+			// Hold the consumer so the queue fills up
+			time.Sleep(50 * time.Millisecond)
+			close(output.open)
+			if err := waitResult(t, result); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+
+			if recorder.max > int64(test.capacity) || recorder.max == 0 {
+				t.Errorf("Expected queue depths up to the capacity %v, got %v", test.capacity, recorder.max)
+			}
+			responses := output.responses(t)
+			if len(responses) != tasks {
+				t.Fatalf("Expected %v responses, got %v", tasks, len(responses))
+			}
+			var rejected int
+			for _, response := range responses {
+				if response["error"] == ErrorOverloaded {
+					rejected++
+				}
+			}
+			if test.reject && rejected == 0 {
+				t.Errorf("Expected some requests to be rejected")
+			} else if !test.reject && rejected != 0 {
+				t.Errorf("Expected no rejected requests, got %v", rejected)
+			}
+		})
+	}
+}
+
+// orderedRequests returns requests whose responses depend on being executed
+// in input order: every post is added, found, removed and then missing
+func orderedRequests(n int) string {
+	var builder strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&builder, "{\"command\": \"ADD\", \"id\": %v, \"body\": \"%v\", \"timestamp\": %v}\n", 4*i, i, i)
+		fmt.Fprintf(&builder, "{\"command\": \"CONTAINS\", \"id\": %v, \"timestamp\": %v}\n", 4*i+1, i)
+		fmt.Fprintf(&builder, "{\"command\": \"REMOVE\", \"id\": %v, \"timestamp\": %v}\n", 4*i+2, i)
+		fmt.Fprintf(&builder, "{\"command\": \"CONTAINS\", \"id\": %v, \"timestamp\": %v}\n", 4*i+3, i)
+	}
+	return builder.String()
+}
+
+func TestParallelDecoding(t *testing.T) {
+	for _, producers := range []int{2, 4, 8} {
+		t.Run(fmt.Sprintf("P=%v", producers), func(t *testing.T) {
+			posts := 1000
+			input := orderedRequests(posts) + "{\"command\": \"DONE\"}\n" + addRequests(10)
+			var output bytes.Buffer
+			config := Config{
+				Encoder:        json.NewEncoder(&output),
+				Reader:         strings.NewReader(input),
+				Mode:           "s",
+				ProducersCount: producers,
+			}
+			if err := waitResult(t, runAsync(config)); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+
+			decoder := json.NewDecoder(&output)
+			for id := 0; id < 4*posts; id++ {
+				var response map[string]interface{}
+				if err := decoder.Decode(&response); err != nil {
+					t.Fatalf("Expected a response for id %v: %v", id, err)
+				}
+				expected := id%4 != 3
+				if response["id"] != float64(id) || response["success"] != expected {
+					t.Fatalf("Expected (id=%v, success=%v), got %v", id, expected, response)
+				}
+			}
+			if decoder.More() {
+				t.Errorf("Requests after DONE were executed")
+			}
+		})
+	}
+}
+
+func TestParallelDecodingMalformedInput(t *testing.T) {
+	input := addRequests(3) + "{\"command\": \n" + addRequests(3)
+	var output syncBuffer
+	config := Config{
+		Encoder:        json.NewEncoder(&output),
+		Reader:         strings.NewReader(input),
+		Mode:           "p",
+		FeedImpl:       testFeed,
+		ConsumersCount: 2,
+		ProducersCount: 2,
+	}
+	if err := waitResult(t, runAsync(config)); err == nil {
+		t.Fatalf("Expected a decoding error")
+	}
+	if got := bytes.Count(output.Bytes(), []byte("\n")); got != 3 {
+		t.Errorf("Expected the 3 requests before the malformed line to be answered, got %v", got)
+	}
+}
+
+func TestParallelDecodingInteractive(t *testing.T) {
+	// A client waiting for each response must not be held back by chunking
+	input, inputWriter := io.Pipe()
+	output, outputWriter := io.Pipe()
+	config := Config{
+		Encoder:        json.NewEncoder(outputWriter),
+		Reader:         input,
+		Mode:           "p",
+		FeedImpl:       testFeed,
+		ConsumersCount: 2,
+		ProducersCount: 4,
+	}
+	result := runAsync(config)
+	decoder := json.NewDecoder(output)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(inputWriter, "{\"command\": \"CONTAINS\", \"id\": %v, \"timestamp\": %v}\n", i, i)
+		var response map[string]interface{}
+		if err := decoder.Decode(&response); err != nil || response["id"] != float64(i) {
+			t.Fatalf("Expected the response for id %v, got %v (%v)", i, response, err)
+		}
+	}
+	io.WriteString(inputWriter, "{\"command\": \"DONE\"}\n")
+	if err := waitResult(t, result); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestWorkStealing(t *testing.T) {
+	for _, distribution := range []string{"rr", "hash"} {
+		t.Run(distribution, func(t *testing.T) {
+			tasks := 2000
+			var output syncBuffer
+			config := Config{
+				Encoder:        json.NewEncoder(&output),
+				Decoder:        json.NewDecoder(strings.NewReader(addRequests(tasks) + "{\"command\": \"DONE\"}\n")),
+				Mode:           "ws",
+				FeedImpl:       testFeed,
+				ConsumersCount: 4,
+				Distribution:   distribution,
+			}
+			if err := waitResult(t, runAsync(config)); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+
+			seen := make(map[float64]bool)
+			decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+			for decoder.More() {
+				var response map[string]interface{}
+				if err := decoder.Decode(&response); err != nil {
+					t.Fatal(err)
+				}
+				id := response["id"].(float64)
+				if seen[id] || response["success"] != true {
+					t.Errorf("Unexpected response %v", response)
+				}
+				seen[id] = true
+			}
+			if len(seen) != tasks {
+				t.Errorf("Expected %v responses, got %v", tasks, len(seen))
+			}
+		})
+	}
+}
+
+func TestImplementations(t *testing.T) {
+	tasks := 100
+	input := addRequests(tasks) + "{\"command\": \"FEED\", \"id\": 1000}\n{\"command\": \"DONE\"}\n"
+	for _, feedImpl := range feed.Names() {
+		if testFeed != "" && feedImpl != testFeed {
+			// Only the feed the race detector accepts, see testFeed
+			continue
+		}
+		for _, queueImpl := range queue.Names() {
+			for _, lockImpl := range lock.Names() {
+				name := feedImpl + "/" + queueImpl + "/" + lockImpl
+				var output syncBuffer
+				config := Config{
+					Encoder:        json.NewEncoder(&output),
+					Decoder:        json.NewDecoder(strings.NewReader(input)),
+					Mode:           "p",
+					ConsumersCount: 4,
+					FeedImpl:       feedImpl,
+					QueueImpl:      queueImpl,
+					LockImpl:       lockImpl,
+				}
+				if err := Run(config); err != nil {
+					t.Fatalf("%v: expected a clean shutdown, got %v", name, err)
+				}
+				// The FEED request may run before some of the ADD requests
+				// are executed, but every ADD is answered
+				lines := strings.Count(string(output.Bytes()), "\n")
+				if lines != tasks+1 || !strings.Contains(string(output.Bytes()), "\"feed\":[") {
+					t.Errorf("%v: expected %v responses with a feed, got %q", name, tasks+1, output.Bytes())
+				}
+			}
+		}
+	}
+
+	for _, config := range []Config{{FeedImpl: "tree"}, {QueueImpl: "stack"}, {LockImpl: "spinlock"}} {
+		config.Decoder = json.NewDecoder(strings.NewReader(input))
+		config.Encoder = json.NewEncoder(io.Discard)
+		config.Mode = "s"
+		if err := Run(config); err == nil || !strings.Contains(err.Error(), "unknown") {
+			t.Errorf("Expected an unknown implementation error for %+v, got %v", config, err)
+		}
+	}
+}
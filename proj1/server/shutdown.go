@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrInterrupted is returned by Run when a shutdown signal stopped the
+// server before the DONE command was seen. Every request that had already
+// been accepted was still processed and answered.
+var ErrInterrupted = errors.New("server: interrupted before DONE, queued requests were drained")
+
+// ErrForcedShutdown is returned by Run when a second shutdown signal or the
+// shutdown deadline cut the drain short. Requests still queued at that point
+// are abandoned.
+var ErrForcedShutdown = errors.New("server: forced shutdown, queued requests were abandoned")
+
+// watch waits for shutdown signals. The first one interrupts the producer and
+// starts the shutdown deadline, the second one (or the deadline) forces the
+// shutdown.
+func (source *messageSource) watch() {
+	select {
+	case <-source.config.Shutdown:
+	case <-source.stopped:
+		return
+	}
+	close(source.interrupted)
+	source.config.Tracer.Log(map[string]interface{}{"event": "interrupt"})
+
+	var deadline <-chan time.Time
+	if source.config.ShutdownTimeout > 0 {
+		timer := time.NewTimer(source.config.ShutdownTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case <-source.config.Shutdown:
+	case <-deadline:
+	case <-source.stopped:
+		return
+	}
+	close(source.forced)
+	source.config.Tracer.Log(map[string]interface{}{"event": "force"})
+}
+
+// wait runs serve and returns once it finishes, or earlier with
+// ErrForcedShutdown if the shutdown was forced in the meantime
+func (source *messageSource) wait(serve func() error) error {
+	if source.forced == nil {
+		return serve()
+	}
+	finished := make(chan error, 1)
+	go func() {
+		finished <- serve()
+	}()
+	select {
+	case err := <-finished:
+		return err
+	case <-source.forced:
+		// Prefer a drain that completed at the same moment
+		select {
+		case err := <-finished:
+			return err
+		default:
+			return ErrForcedShutdown
+		}
+	}
+}
+
+// endOfInput converts the error that stopped the producer into the error
+// returned by Run. Reaching the end of the input is not an error.
+func endOfInput(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
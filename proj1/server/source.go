@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"sync"
+)
+
+// chunkLines is the maximum number of input lines decoded as one chunk when
+// several producers decode the input
+const chunkLines = 256
+
+// decoded is a single result of decoding the request stream
+type decoded struct {
+	message map[string]interface{}
+	err     error
+}
+
+// messageSource hands decoded requests to the producer in input order. With
+// neither a Shutdown channel nor several producers it decodes directly on the
+// caller's goroutine. Otherwise the input is decoded ahead by background
+// goroutines so the producer can stop waiting on input as soon as a shutdown
+// signal arrives.
+type messageSource struct {
+	config      Config
+	messages    chan []decoded // Batches of requests decoded by the background goroutines
+	batch       []decoded      // The rest of the batch currently handed out by next
+	interrupted chan struct{}  // Closed on the first shutdown signal
+	forced      chan struct{}  // Closed on the second signal or when the deadline expires
+	stopped     chan struct{}  // Closed by close once the server no longer reads input
+	stopOnce    sync.Once
+	limiter     *rateLimiter // Rate limits of the clients (nil = unlimited)
+}
+
+// newMessageSource creates the source and starts the background decoding
+// and the signal watcher when they are needed
+func newMessageSource(config Config) *messageSource {
+	source := &messageSource{config: config, stopped: make(chan struct{}), limiter: newRateLimiter(config.RateLimits)}
+	// The channels are created before the goroutines using them start
+	if config.Shutdown != nil {
+		source.interrupted = make(chan struct{})
+		source.forced = make(chan struct{})
+	}
+	parallel := config.ProducersCount > 1 && config.Reader != nil
+	// The pipeline version has its own decoding stage
+	if config.Mode != "pipeline" && (config.Shutdown != nil || parallel) {
+		source.messages = make(chan []decoded, config.ProducersCount)
+		if parallel {
+			go source.decodeParallel()
+		} else {
+			go source.read()
+		}
+	}
+	if config.Shutdown != nil {
+		go source.watch()
+	}
+	return source
+}
+
+// next returns the next decoded request. The error is the decoding error,
+// or ErrInterrupted once a shutdown signal has been received.
+func (source *messageSource) next() (map[string]interface{}, error) {
+	if source.messages == nil {
+		var message map[string]interface{}
+		err := source.config.Decoder.Decode(&message)
+		return message, err
+	}
+	// Check for an interruption first so a steady input stream cannot hide it
+	select {
+	case <-source.interrupted:
+		return nil, ErrInterrupted
+	default:
+	}
+	if len(source.batch) == 0 {
+		select {
+		case source.batch = <-source.messages:
+		case <-source.interrupted:
+			return nil, ErrInterrupted
+		}
+	}
+	result := source.batch[0]
+	source.batch = source.batch[1:]
+	return result.message, result.err
+}
+
+// close stops the background decoding once the server is done with the input
+func (source *messageSource) close() {
+	source.stopOnce.Do(func() {
+		close(source.stopped)
+	})
+}
+
+// send passes a batch to next. It returns false if the server stopped
+// reading in the meantime.
+func (source *messageSource) send(batch []decoded) bool {
+	select {
+	case source.messages <- batch:
+		return true
+	case <-source.interrupted:
+	case <-source.stopped:
+	}
+	return false
+}
+
+// read decodes requests one by one until the input fails or the server stops
+// reading. A read blocked on the input cannot be cancelled, so this goroutine
+// may outlive Run until the input is closed.
+func (source *messageSource) read() {
+	for {
+		var message map[string]interface{}
+		err := source.config.Decoder.Decode(&message)
+		if !source.send([]decoded{{message, err}}) || err != nil {
+			return
+		}
+	}
+}
+
+// chunk is a group of consecutive input lines decoded by one producer
+type chunk struct {
+	seq   int       // Position of the chunk in the input
+	lines [][]byte  // Raw lines (or frames of the protocol), each holding one request
+	err   error     // Error that ended the input after these lines
+	batch []decoded // The decoded lines
+}
+
+// decodeParallel splits the input into chunks of lines, decodes the chunks
+// with ProducersCount goroutines and passes them on to next in input order,
+// so the requests are enqueued in exactly the order they were read
+func (source *messageSource) decodeParallel() {
+	raw := make(chan *chunk, source.config.ProducersCount)
+	parsed := make(chan *chunk, source.config.ProducersCount)
+
+	go source.split(raw)
+
+	group := sync.WaitGroup{}
+	for i := 0; i < source.config.ProducersCount; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for c := range raw {
+				c.batch = decodeChunk(source.config.Protocol, c)
+				select {
+				case parsed <- c:
+				case <-source.interrupted:
+					return
+				case <-source.stopped:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		group.Wait()
+		close(parsed)
+	}()
+
+	// Reorder the decoded chunks by their position in the input
+	pending := make(map[int]*chunk)
+	nextSeq := 0
+	for c := range parsed {
+		pending[c.seq] = c
+		for {
+			ready, ok := pending[nextSeq]
+			if !ok {
+				break
+			}
+			delete(pending, nextSeq)
+			nextSeq++
+			if !source.send(ready.batch) || ready.err != nil {
+				return
+			}
+		}
+	}
+}
+
+// split reads the input line by line, or frame by frame, and groups the
+// lines into chunks. A
+// chunk is handed out early when no more input is buffered, so requests from
+// an interactive client are not held back waiting for a full chunk.
+func (source *messageSource) split(raw chan<- *chunk) {
+	defer close(raw)
+	reader := bufio.NewReader(source.config.Reader)
+	current := &chunk{}
+	for seq := 0; ; {
+		frame, err := source.config.Protocol.ReadFrame(reader)
+		if frame != nil {
+			current.lines = append(current.lines, frame)
+		}
+		if err == nil && len(current.lines) < chunkLines && (len(current.lines) == 0 || reader.Buffered() > 0) {
+			continue
+		}
+		current.err = err
+		select {
+		case raw <- current:
+		case <-source.interrupted:
+			return
+		case <-source.stopped:
+			return
+		}
+		if err != nil {
+			return
+		}
+		seq++
+		current = &chunk{seq: seq}
+	}
+}
+
+// decodeChunk decodes the lines of a chunk. Decoding stops at the first
+// malformed line, which ends the input like an error from a Decoder.
+func decodeChunk(protocol Protocol, c *chunk) []decoded {
+	batch := make([]decoded, 0, len(c.lines)+1)
+	for _, line := range c.lines {
+		message, err := protocol.Unmarshal(line)
+		if err != nil {
+			c.err = err
+			break
+		}
+		batch = append(batch, decoded{message: message})
+	}
+	if c.err != nil {
+		batch = append(batch, decoded{err: c.err})
+	}
+	return batch
+}
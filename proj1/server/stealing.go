@@ -0,0 +1,185 @@
+package server
+
+import (
+	"math"
+	"proj1/feed"
+	"proj1/queue"
+	"proj1/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stealingContext is the state shared by the producer and the consumers of
+// the work stealing version. Every consumer owns a deque and a wake-up
+// channel instead of all of them waiting on a single mutex and condition
+// variable.
+type stealingContext struct {
+	deques []*queue.Deque  // The deque owned by each consumer
+	wake   []chan struct{} // Buffered wake-up channel of each consumer
+	quit   chan struct{}   // Closed once the producer stops adding requests
+	group  *sync.WaitGroup // Wait group to use for waiting for consumers
+	feed   feed.Feed       // The twitter feed
+	next   int             // Next consumer in round-robin order (producer only)
+	depth  int64           // Requests queued in all the deques, atomic
+	// Buffered channel the consumers signal after taking a request, the
+	// producer waits on it while the deques hold QueueCapacity requests
+	room chan struct{}
+}
+
+// stealingServer runs the server in parallel mode with work stealing
+func stealingServer(config Config, feed feed.Feed, source *messageSource) error {
+	consumers := config.ConsumersCount
+	if consumers < 1 {
+		consumers = 1
+	}
+	context := stealingContext{
+		deques: make([]*queue.Deque, consumers),
+		wake:   make([]chan struct{}, consumers),
+		quit:   make(chan struct{}),
+		group:  &sync.WaitGroup{},
+		feed:   feed,
+		room:   make(chan struct{}, 1),
+	}
+	for i := 0; i < consumers; i++ {
+		context.deques[i] = queue.NewDeque()
+		context.wake[i] = make(chan struct{}, 1)
+	}
+
+	// Spawn the consumers
+	for i := 0; i < consumers; i++ {
+		context.group.Add(1)
+		go stealingConsumer(config, &context, i)
+	}
+
+	// Distribute the requests until DONE, then let the consumers drain
+	err := readRequests(source, func(request task) {
+		// Apply backpressure when the deques are full
+		if !context.waitForRoom(config) {
+			respondError(config, request, ErrorOverloaded)
+			return
+		}
+		i := context.owner(config, request)
+		request.Enqueued = time.Now()
+		request.Span.Mark(trace.PhaseEnqueue)
+		reportDepth(config, atomic.AddInt64(&context.depth, 1))
+		context.deques[i].PushBack(request.queued())
+		context.notify(i)
+	})
+	close(context.quit)
+	context.group.Wait()
+	return err
+}
+
+// waitForRoom blocks the producer until the deques hold fewer requests than
+// the queue capacity. It returns false without waiting if the request should
+// be rejected instead.
+func (context *stealingContext) waitForRoom(config Config) bool {
+	if config.QueueCapacity <= 0 {
+		return true
+	}
+	for atomic.LoadInt64(&context.depth) >= int64(config.QueueCapacity) {
+		if config.RejectWhenFull {
+			return false
+		}
+		<-context.room
+	}
+	return true
+}
+
+// owner picks the consumer that receives a request. Hashing by timestamp
+// keeps all the requests for one post on the same consumer unless stolen.
+func (context *stealingContext) owner(config Config, request task) int {
+	if config.Distribution == "hash" {
+		if timestamp, ok := request.Message["timestamp"].(float64); ok {
+			bits := math.Float64bits(timestamp)
+			bits ^= bits >> 33
+			bits *= 0xff51afd7ed558ccd
+			bits ^= bits >> 33
+			return int(bits % uint64(len(context.deques)))
+		}
+	}
+	i := context.next
+	context.next = (context.next + 1) % len(context.deques)
+	return i
+}
+
+// notify wakes up consumer i if it is waiting. The channel holds one pending
+// wake-up so a notification sent while the consumer is busy is not lost.
+func (context *stealingContext) notify(i int) {
+	select {
+	case context.wake[i] <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the next task for consumer i and reports the new queue depth
+func (context *stealingContext) take(config Config, i int) (*task, bool) {
+	queued, ok := context.find(i)
+	if !ok {
+		return nil, false
+	}
+	reportDepth(config, atomic.AddInt64(&context.depth, -1))
+	// Wake up the producer if it is waiting for room
+	select {
+	case context.room <- struct{}{}:
+	default:
+	}
+	return taskOf(queued), true
+}
+
+// find takes a task for consumer i, first from its own deque and then by
+// stealing from the other consumers
+func (context *stealingContext) find(i int) (*queue.Request, bool) {
+	if queued, ok := context.deques[i].PopFront(); ok {
+		// Let a peer help with the rest of the backlog
+		if context.deques[i].Len() > 0 && len(context.deques) > 1 {
+			context.notify((i + 1) % len(context.deques))
+		}
+		return queued, true
+	}
+	for offset := 1; offset < len(context.deques); offset++ {
+		victim := (i + offset) % len(context.deques)
+		if queued, ok := context.deques[victim].StealBack(); ok {
+			// Pass the wake-up on while the victim is still backlogged
+			if context.deques[victim].Len() > 0 {
+				context.notify((i + 1) % len(context.deques))
+			}
+			return queued, true
+		}
+	}
+	return nil, false
+}
+
+// stealingConsumer processes requests from its own deque or stolen from its
+// peers, and sleeps when there is no work anywhere
+func stealingConsumer(config Config, context *stealingContext, i int) {
+	defer context.group.Done()
+	times := config.Metrics.consumer(i)
+	for {
+		if request, ok := context.take(config, i); ok {
+			request.Span.Take(i)
+			busy := time.Now()
+			processRequest(config, context.feed, *request)
+			times.addBusy(busy)
+			continue
+		}
+		idle := time.Now()
+		select {
+		case <-context.wake[i]:
+			times.addIdle(idle)
+			continue
+		case <-context.quit:
+		}
+		times.addIdle(idle)
+		// The producer has stopped so no new work can appear, finish
+		// whatever is left in any deque and exit
+		for request, ok := context.take(config, i); ok; request, ok = context.take(config, i) {
+			request.Span.Take(i)
+			busy := time.Now()
+			processRequest(config, context.feed, *request)
+			times.addBusy(busy)
+		}
+		return
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"proj1/queue"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stressIterations is the number of random runs of TestShutdownStress, run it
+// with -race to check the termination protocol
+const stressIterations = 2000
+
+// stressRun is one random run of the server
+type stressRun struct {
+	mode      string
+	queueImpl string
+	consumers int
+	capacity  int  // Queue capacity, the producer blocks when it is full
+	priority  bool // Use the priority queue
+	tasks     int  // Requests before DONE
+	done      string
+}
+
+// DONE timings of a stress run
+const (
+	doneLast   = "last"   // DONE is the last request
+	doneEarly  = "early"  // More requests follow DONE and must be ignored
+	doneNever  = "never"  // The input ends without DONE
+	doneStream = "stream" // The requests and DONE arrive one by one with random pauses
+)
+
+func randomStressRun(random *rand.Rand) stressRun {
+	modes := []string{"p", "a", "ws"}
+	queues := queue.Names()
+	timings := []string{doneLast, doneEarly, doneNever, doneStream}
+	run := stressRun{
+		mode:      modes[random.Intn(len(modes))],
+		queueImpl: queues[random.Intn(len(queues))],
+		consumers: 1 + random.Intn(8),
+		priority:  random.Intn(4) == 0,
+		tasks:     random.Intn(200),
+		done:      timings[random.Intn(len(timings))],
+	}
+	if run.mode == "ws" {
+		// Every consumer serves its own deque in order
+		run.priority = false
+	}
+	if random.Intn(3) == 0 {
+		run.capacity = 1 + random.Intn(8)
+	}
+	return run
+}
+
+// input writes the run.tasks ADDs that must be answered, then the DONE and
+// the requests after it that must be ignored, if any
+func (run stressRun) input(random *rand.Rand, w io.Writer) {
+	for i := 0; i < run.tasks; i++ {
+		fmt.Fprintf(w, "{\"command\": \"ADD\", \"id\": %v, \"body\": \"%v\", \"timestamp\": %v}\n", i, i, i)
+		if run.done == doneStream && random.Intn(8) == 0 {
+			time.Sleep(time.Duration(random.Intn(200)) * time.Microsecond)
+		}
+	}
+	switch run.done {
+	case doneEarly:
+		fmt.Fprintln(w, "{\"command\": \"DONE\"}")
+		for i := run.tasks; i < run.tasks+10; i++ {
+			fmt.Fprintf(w, "{\"command\": \"ADD\", \"id\": %v, \"body\": \"%v\", \"timestamp\": %v}\n", i, i, i)
+		}
+	case doneLast, doneStream:
+		fmt.Fprintln(w, "{\"command\": \"DONE\"}")
+	}
+}
+
+func TestShutdownStress(t *testing.T) {
+	iterations := stressIterations
+	if testing.Short() {
+		iterations /= 10
+	}
+	seed := time.Now().UnixNano()
+	t.Logf("Seed %v", seed)
+	random := rand.New(rand.NewSource(seed))
+	for iteration := 0; iteration < iterations; iteration++ {
+		run := randomStressRun(random)
+		var output syncBuffer
+		config := Config{
+			Encoder:        json.NewEncoder(&output),
+			Mode:           run.mode,
+			ConsumersCount: run.consumers,
+			QueueImpl:      run.queueImpl,
+			QueueCapacity:  run.capacity,
+			Priorities:     PriorityConfig{Enabled: run.priority},
+			// The list feed traverses its posts without locks, the coarse
+			// feed keeps the race detector on the termination protocol
+			FeedImpl: "coarse",
+			Scaling:  ScalingConfig{MinConsumers: 1, Interval: time.Millisecond, IdleTimeout: time.Millisecond},
+		}
+		if run.done == doneStream {
+			reader, writer := io.Pipe()
+			inputRandom := rand.New(rand.NewSource(random.Int63()))
+			go func() {
+				run.input(inputRandom, writer)
+				writer.Close()
+			}()
+			config.Decoder = json.NewDecoder(reader)
+		} else {
+			var input strings.Builder
+			run.input(random, &input)
+			config.Decoder = json.NewDecoder(strings.NewReader(input.String()))
+		}
+
+		if err := waitResult(t, runAsync(config)); err != nil {
+			t.Fatalf("%+v: expected a clean shutdown, got %v", run, err)
+		}
+		answered := make([]bool, run.tasks)
+		decoder := json.NewDecoder(strings.NewReader(string(output.Bytes())))
+		for decoder.More() {
+			var response map[string]interface{}
+			if err := decoder.Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			id := int(response["id"].(float64))
+			if id >= run.tasks || answered[id] || response["success"] != true {
+				t.Fatalf("%+v: unexpected response %v", run, response)
+			}
+			answered[id] = true
+		}
+		for id, ok := range answered {
+			if !ok {
+				t.Fatalf("%+v: request %v was not answered", run, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"proj1/trace"
+	"strings"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	tasks := 50
+	input := addRequests(tasks) + "{\"command\": \"ADD\", \"id\": 99}\n"
+	for _, mode := range []string{"s", "p", "ws", "a", "pipeline"} {
+		var output, logs syncBuffer
+		tracer := trace.NewTracer(&logs, true)
+		config := Config{
+			Encoder:        json.NewEncoder(&output),
+			Decoder:        json.NewDecoder(strings.NewReader(input)),
+			Mode:           mode,
+			FeedImpl:       testFeed,
+			ConsumersCount: 4,
+			Tracer:         tracer,
+		}
+		if err := Run(config); err != nil {
+			t.Fatalf("%v: expected a clean shutdown, got %v", mode, err)
+		}
+
+		// One line per request between the start and the stop of the server
+		lines := strings.Split(strings.TrimSpace(string(logs.Bytes())), "\n")
+		if len(lines) != tasks+3 {
+			t.Fatalf("%v: expected %v log lines, got %v", mode, tasks+3, len(lines))
+		}
+		seen := make(map[float64]bool)
+		for i, line := range lines {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%v: malformed log line %q: %v", mode, line, err)
+			}
+			switch {
+			case i == 0:
+				if entry["event"] != "start" || entry["mode"] != mode {
+					t.Errorf("%v: expected the start of the server first, got %v", mode, entry)
+				}
+			case i == len(lines)-1:
+				if entry["event"] != "stop" {
+					t.Errorf("%v: expected the stop of the server last, got %v", mode, entry)
+				}
+			case entry["id"] == 99.0:
+				if entry["result"] != "invalid" {
+					t.Errorf("%v: expected the invalid request to be logged as dropped, got %v", mode, entry)
+				}
+			default:
+				seen[entry["id"].(float64)] = true
+				phases := []string{"decode", "execute", "executed", "encode", "encoded"}
+				if mode != "s" {
+					phases = append(phases, "enqueue", "dequeue", "consumer")
+				}
+				for _, phase := range phases {
+					if _, ok := entry[phase]; !ok {
+						t.Errorf("%v: expected %v in %v", mode, phase, entry)
+					}
+				}
+			}
+		}
+		if len(seen) != tasks {
+			t.Errorf("%v: expected every request to be logged once, got %v", mode, len(seen))
+		}
+
+		var chrome bytes.Buffer
+		if err := tracer.WriteChrome(&chrome); err != nil {
+			t.Fatal(err)
+		}
+		var events struct {
+			TraceEvents []map[string]interface{} `json:"traceEvents"`
+		}
+		if err := json.Unmarshal(chrome.Bytes(), &events); err != nil {
+			t.Fatalf("%v: malformed trace: %v", mode, err)
+		}
+		executed := 0
+		for _, event := range events.TraceEvents {
+			if event["name"] == "ADD" {
+				executed++
+			}
+		}
+		if executed != tasks {
+			t.Errorf("%v: expected %v executions in the trace, got %v", mode, tasks, executed)
+		}
+	}
+}
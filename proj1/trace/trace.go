@@ -0,0 +1,222 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phase is a step in the life of a request
+type Phase int
+
+// The phases of a request in the order they happen. The versions without a
+// queue skip PhaseEnqueue and PhaseDequeue.
+const (
+	PhaseDecode   Phase = iota // The request was decoded
+	PhaseEnqueue               // The request was added to the queue
+	PhaseDequeue               // A consumer took the request from the queue
+	PhaseExecute               // The request started running against the feed
+	PhaseExecuted              // The request finished running against the feed
+	PhaseEncode                // The response started being encoded
+	PhaseEncoded               // The response was written
+	numPhases
+)
+
+// phaseNames are the names of the phases in the logs
+var phaseNames = [numPhases]string{"decode", "enqueue", "dequeue", "execute", "executed", "encode", "encoded"}
+
+// Span records when a request went through each phase. Every method can be
+// called on a nil *Span, which records nothing.
+type Span struct {
+	ID       uint64      // Sequence number of the request in the run
+	Request  interface{} // The "id" field of the request
+	Command  interface{} // The "command" field of the request
+	Consumer int         // Index of the consumer that handled the request (-1 = none)
+	Result   string      // Outcome of the request, set by Finish
+	times    [numPhases]time.Time
+}
+
+// Mark records that the request reached a phase now
+func (span *Span) Mark(phase Phase) {
+	if span != nil {
+		span.times[phase] = time.Now()
+	}
+}
+
+// Take records that consumer i took the request from the queue
+func (span *Span) Take(i int) {
+	if span != nil {
+		span.Consumer = i
+		span.times[PhaseDequeue] = time.Now()
+	}
+}
+
+// Tracer hands out the spans of a run, logs every finished span as one JSON
+// line and keeps them for WriteChrome. Every method can be called on a nil
+// *Tracer, which traces nothing.
+type Tracer struct {
+	start  time.Time
+	nextID uint64     // atomic
+	mutex  sync.Mutex // Guards the log and spans
+	log    io.Writer  // Receives the structured logs (nil = not logged)
+	keep   bool       // Keep the finished spans for WriteChrome
+	spans  []*Span
+	// LogRequests logs every finished span, set by NewTracer. Clearing it
+	// keeps only the server events in the log.
+	LogRequests bool
+}
+
+// NewTracer creates a tracer that logs to log if it is not nil and keeps the
+// spans for WriteChrome if keep is set
+func NewTracer(log io.Writer, keep bool) *Tracer {
+	return &Tracer{start: time.Now(), log: log, keep: keep, LogRequests: true}
+}
+
+// Start creates the span of a request that was just decoded
+func (tracer *Tracer) Start(message map[string]interface{}) *Span {
+	if tracer == nil {
+		return nil
+	}
+	span := &Span{
+		ID:       atomic.AddUint64(&tracer.nextID, 1),
+		Request:  message["id"],
+		Command:  message["command"],
+		Consumer: -1,
+	}
+	span.Mark(PhaseDecode)
+	return span
+}
+
+// Finish records the outcome of a request once it was answered or dropped
+func (tracer *Tracer) Finish(span *Span, result string) {
+	if tracer == nil || span == nil {
+		return
+	}
+	span.Result = result
+	if tracer.log != nil && tracer.LogRequests {
+		entry := map[string]interface{}{
+			"event":    "request",
+			"trace_id": span.ID,
+			"id":       span.Request,
+			"command":  span.Command,
+			"result":   result,
+		}
+		if span.Consumer >= 0 {
+			entry["consumer"] = span.Consumer
+		}
+		for phase, at := range span.times {
+			if !at.IsZero() {
+				entry[phaseNames[phase]] = at.Format(time.RFC3339Nano)
+			}
+		}
+		tracer.Log(entry)
+	}
+	if tracer.keep {
+		tracer.mutex.Lock()
+		tracer.spans = append(tracer.spans, span)
+		tracer.mutex.Unlock()
+	}
+}
+
+// Log writes a structured log entry as one JSON line with its time
+func (tracer *Tracer) Log(entry map[string]interface{}) {
+	if tracer == nil || tracer.log == nil {
+		return
+	}
+	if _, ok := entry["time"]; !ok {
+		entry["time"] = time.Now().Format(time.RFC3339Nano)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.log.Write(append(line, '\n'))
+}
+
+// chromeEvent is an event of the Chrome trace-event format
+type chromeEvent struct {
+	Name      string                 `json:"name"`
+	Category  string                 `json:"cat,omitempty"`
+	Phase     string                 `json:"ph"`
+	Timestamp float64                `json:"ts"`            // Microseconds since the start of the run
+	Duration  float64                `json:"dur,omitempty"` // Microseconds
+	Process   int                    `json:"pid"`
+	Thread    int                    `json:"tid"`
+	ID        uint64                 `json:"id,omitempty"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteChrome writes the finished spans in the Chrome trace-event JSON
+// format, which chrome://tracing and Perfetto can open. The producer is
+// thread 0 and consumer i is thread i+1. The time a request spent queued is
+// shown as an async event.
+func (tracer *Tracer) WriteChrome(w io.Writer) error {
+	events := []chromeEvent{}
+	if tracer != nil {
+		tracer.mutex.Lock()
+		spans := append([]*Span(nil), tracer.spans...)
+		tracer.mutex.Unlock()
+		events = tracer.chromeEvents(spans)
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{"traceEvents": events, "displayTimeUnit": "ns"})
+}
+
+// chromeEvents converts the spans to trace events
+func (tracer *Tracer) chromeEvents(spans []*Span) []chromeEvent {
+	micros := func(at time.Time) float64 {
+		return float64(at.Sub(tracer.start)) / float64(time.Microsecond)
+	}
+	threads := map[int]bool{0: true}
+	var events []chromeEvent
+	// complete adds an event from one phase to another on a thread
+	complete := func(span *Span, name string, thread int, from Phase, to Phase) {
+		start, end := span.times[from], span.times[to]
+		if start.IsZero() || end.IsZero() {
+			return
+		}
+		threads[thread] = true
+		events = append(events, chromeEvent{
+			Name:      name,
+			Category:  "request",
+			Phase:     "X",
+			Timestamp: micros(start),
+			Duration:  float64(end.Sub(start)) / float64(time.Microsecond),
+			Process:   1,
+			Thread:    thread,
+			Args:      map[string]interface{}{"trace_id": span.ID, "id": span.Request, "command": span.Command, "result": span.Result},
+		})
+	}
+	for _, span := range spans {
+		worker := span.Consumer + 1
+		name := "request"
+		if command, ok := span.Command.(string); ok {
+			name = command
+		}
+		// Decoding and queueing happen on the producer
+		if !span.times[PhaseEnqueue].IsZero() {
+			complete(span, "decode", 0, PhaseDecode, PhaseEnqueue)
+		}
+		if enqueued, dequeued := span.times[PhaseEnqueue], span.times[PhaseDequeue]; !enqueued.IsZero() && !dequeued.IsZero() {
+			async := chromeEvent{Name: "queued", Category: "queue", Process: 1, Thread: 0, ID: span.ID}
+			async.Phase, async.Timestamp = "b", micros(enqueued)
+			events = append(events, async)
+			async.Phase, async.Timestamp = "e", micros(dequeued)
+			events = append(events, async)
+		}
+		complete(span, name, worker, PhaseExecute, PhaseExecuted)
+		complete(span, "encode", worker, PhaseEncode, PhaseEncoded)
+	}
+	for thread := range threads {
+		name := "producer"
+		if thread > 0 {
+			name = "consumer " + strconv.Itoa(thread-1)
+		}
+		events = append(events, chromeEvent{Name: "thread_name", Phase: "M", Process: 1, Thread: thread, Args: map[string]interface{}{"name": name}})
+	}
+	return events
+}
@@ -0,0 +1,99 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start(map[string]interface{}{"id": 1.0})
+	span.Mark(PhaseEnqueue)
+	span.Take(0)
+	tracer.Finish(span, "success")
+	tracer.Log(map[string]interface{}{"event": "start"})
+	var output bytes.Buffer
+	if err := tracer.WriteChrome(&output); err != nil || !strings.Contains(output.String(), "\"traceEvents\":[]") {
+		t.Errorf("Expected an empty trace, got %v (%v)", output.String(), err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	var log bytes.Buffer
+	tracer := NewTracer(&log, false)
+	span := tracer.Start(map[string]interface{}{"id": 7.0, "command": "ADD"})
+	span.Mark(PhaseEnqueue)
+	span.Take(3)
+	span.Mark(PhaseExecute)
+	span.Mark(PhaseExecuted)
+	tracer.Finish(span, "success")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(log.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected one JSON line, got %q: %v", log.String(), err)
+	}
+	expected := map[string]interface{}{"event": "request", "trace_id": 1.0, "id": 7.0, "command": "ADD", "result": "success", "consumer": 3.0}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("Expected %v = %v, got %v", key, value, entry[key])
+		}
+	}
+	for _, phase := range []string{"time", "decode", "enqueue", "dequeue", "execute", "executed"} {
+		if _, ok := entry[phase].(string); !ok {
+			t.Errorf("Expected the %v timestamp, got %v", phase, entry)
+		}
+	}
+	if _, ok := entry["encode"]; ok {
+		t.Errorf("Expected no timestamp for a phase that did not happen, got %v", entry)
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	var log bytes.Buffer
+	tracer := NewTracer(&log, false)
+	tracer.LogRequests = false
+	tracer.Finish(tracer.Start(map[string]interface{}{"id": 1.0}), "success")
+	tracer.Log(map[string]interface{}{"event": "connect"})
+	if lines := strings.Count(log.String(), "\n"); lines != 1 || !strings.Contains(log.String(), "connect") {
+		t.Errorf("Expected only the server event in the log, got %q", log.String())
+	}
+}
+
+func TestWriteChrome(t *testing.T) {
+	tracer := NewTracer(nil, true)
+	for i := 0; i < 2; i++ {
+		span := tracer.Start(map[string]interface{}{"id": float64(i), "command": "FEED"})
+		span.Mark(PhaseEnqueue)
+		span.Take(i)
+		span.Mark(PhaseExecute)
+		span.Mark(PhaseExecuted)
+		span.Mark(PhaseEncode)
+		span.Mark(PhaseEncoded)
+		tracer.Finish(span, "success")
+	}
+	var output bytes.Buffer
+	if err := tracer.WriteChrome(&output); err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []chromeEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(output.Bytes(), &trace); err != nil {
+		t.Fatalf("Malformed trace: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, event := range trace.TraceEvents {
+		counts[event.Phase+" "+event.Name]++
+		if event.Name == "FEED" && event.Thread != int(event.Args["id"].(float64))+1 {
+			t.Errorf("Expected request %v on the thread of its consumer, got %v", event.Args["id"], event.Thread)
+		}
+	}
+	expected := map[string]int{"X decode": 2, "b queued": 2, "e queued": 2, "X FEED": 2, "X encode": 2, "M thread_name": 3}
+	for name, count := range expected {
+		if counts[name] != count {
+			t.Errorf("Expected %v %v events, got %v", count, name, counts)
+		}
+	}
+}
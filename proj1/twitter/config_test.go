@@ -0,0 +1,36 @@
+package main
+
+import (
+	parser "flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	// The flags main defines, on the command line of the test binary
+	outputBuffer := parser.Int("output-buffer", 0, "")
+	flushInterval := parser.Duration("flush-interval", 0, "")
+	mode := parser.String("mode", "", "")
+	reject := parser.Bool("reject", false, "")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	contents := `{"output-buffer": 1048576, "flush-interval": "2ms", "mode": "p", "reject": true}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if *outputBuffer != 1048576 || *flushInterval != 2*time.Millisecond || *mode != "p" || !*reject {
+		t.Errorf("Expected the values of the config file, got %v, %v, %q and %v", *outputBuffer, *flushInterval, *mode, *reject)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"consumers-count": 4}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err == nil {
+		t.Errorf("Expected an error for an unknown flag")
+	}
+}
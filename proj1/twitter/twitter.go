@@ -1,55 +1,418 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	parser "flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"proj1/feed"
+	"proj1/lock"
+	"proj1/queue"
+	"proj1/record"
 	"proj1/server"
+	"proj1/trace"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit status codes for a shutdown triggered by SIGINT/SIGTERM
+const (
+	exitInterrupted = 130 // Stopped by a signal after answering every accepted request
+	exitForced      = 137 // Stopped by a second signal or the shutdown deadline
 )
 
 func Usage() {
-	fmt.Println("Usage: twitter <number of consumers> \n <number of consumers> = the number of goroutines (i.e., consumers) to be part of the parallel version.")
+	fmt.Println("Usage: twitter [flags] [<number of consumers>] \n <number of consumers> = the number of goroutines (i.e., consumers) to be part of the parallel version, the same as -consumers.\n Without flags the version is sequential when no consumers are given and parallel otherwise.\nFlags:")
+	parser.CommandLine.SetOutput(os.Stdout)
+	parser.PrintDefaults()
 }
 
 func main() {
-	// Create the streaming encoder and decoder
-	// Encoder pushes to stdout
-	// Decoder pulls from stdin
-	encoder := json.NewEncoder(os.Stdout)
-	decoder := json.NewDecoder(os.Stdin)
-
+	mode := parser.String("mode", "", "version to run: s (sequential), p (shared queue), ws (work stealing), a (adaptive number of consumers) or pipeline (default s, or p when consumers are given)")
+	consumers := parser.Int("consumers", 0, "number of consumers of the parallel versions (the maximum for a)")
+	feedImpl := parser.String("feed-impl", feed.Default, "implementation of the feed: "+strings.Join(feed.Names(), ", "))
+	queueImpl := parser.String("queue-impl", queue.Default, "implementation of the task queue of the p and a versions: "+strings.Join(queue.Names(), ", "))
+	lockImpl := parser.String("lock-impl", lock.Default, "implementation of the locks of the feed: "+strings.Join(lock.Names(), ", "))
+	inputFile := parser.String("input", "", "read the requests from this file instead of stdin")
+	outputFile := parser.String("output", "", "write the responses to this file instead of stdout")
+	protocolName := parser.String("protocol", "json", "format of the requests and responses: json (one object per line) or binary (length-prefixed frames, see convert.go)")
+	listenAddress := parser.String("listen", "", "serve clients over TCP at this address (e.g. :7000) instead of stdin and stdout")
+	logLevel := parser.String("log-level", "error", "what to log to stderr: error, info (server, connection and scaling events) or debug (info and every request)")
+	configFile := parser.String("config", "", "JSON file with the value of each flag by name, the command line takes precedence")
+	shutdownTimeout := parser.Duration("shutdown-timeout", 0, "force the shutdown if draining after a signal takes longer than this (0 = wait until drained)")
+	queueCapacity := parser.Int("queue-capacity", 0, "maximum number of queued requests of the p, ws and a versions (0 = unbounded)")
+	reject := parser.Bool("reject", false, "answer with an OVERLOADED error instead of waiting when the queue is full")
+	producers := parser.Int("producers", 1, "number of goroutines decoding the input in parallel")
+	distribution := parser.String("distribution", "rr", "how the ws version distributes requests: rr (round-robin) or hash (by timestamp)")
+	stages := parser.String("pipeline", "", "stages of the pipeline version as name=workers[/buffer],... (stages: decode, validate, execute, encode)")
+	stageStats := parser.Bool("pipeline-stats", false, "print the utilization of each pipeline stage to stderr on shutdown")
+	minConsumers := parser.Int("min-consumers", 1, "consumers the adaptive version never retires (-consumers is the maximum)")
+	scaleLog := parser.Bool("scale-log", false, "log the scaling decisions of the adaptive version to stderr")
+	priority := parser.Bool("priority", false, "serve the queued requests of the p and a versions by priority instead of in order")
+	priorities := parser.String("priorities", "", "default priority of each command as COMMAND=level,... (levels: high, normal, low or 0 to 2)")
+	maxSkips := parser.Int("max-skips", 8, "times queued requests of a priority can be passed over before they are served")
+	rateLimits := parser.String("rate-limit", "", "token bucket limits of each client as name=rate[/burst],... (names: writes, reads, client or a command)")
+	metricsAddress := parser.String("metrics", "", "serve the metrics in the Prometheus text format over HTTP at this address (e.g. :9090)")
+	stats := parser.Bool("stats", false, "keep the metrics to answer the STATS command (implied by -metrics)")
+	structuredLog := parser.Bool("log", false, "log the server events and every request with its timestamps to stderr as JSON lines")
+	traceFile := parser.String("trace", "", "write the timeline of every request to this file in the Chrome trace-event format on shutdown")
+	queueWaitLog := parser.Bool("queue-wait-log", false, "log how long every request waited in the queue to stderr")
+	recordFile := parser.String("record", "", "record every request, the consumer that executed it, the order of its feed operation and its response to this file")
+	replayFile := parser.String("replay", "", "re-execute a recording against a fresh feed and print the requests whose response differs instead of running the server")
+	outputBuffer := parser.Int("output-buffer", server.DefaultOutputBuffer, "bytes of responses buffered before they are written to the output")
+	flushInterval := parser.Duration("flush-interval", 0, "longest time a response stays buffered (0 = written as soon as no other response is waiting)")
+	idempotencyKeys := parser.Int("idempotency-keys", 0, "number of recent idempotency keys whose response is returned to retried ADD and REMOVE requests (0 = keys are ignored, e.g. 10000)")
+	idempotencyTTL := parser.Duration("idempotency-ttl", server.DefaultIdempotencyTTL, "how long the response to a request with an idempotency key is remembered")
+	verify := parser.Bool("verify", false, "check that a serialization of the feed operations explains every response and print the requests it does not explain to stderr")
+	parser.Usage = Usage
 	parser.Parse()
+	if err := loadConfigFile(*configFile); err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
 	// Get the non flag arguments
 	args := parser.Args()
 
-	var mode string
-	var config server.Config
-
-	// Error checking was not asked for but it I felt like after the rest of the code was done, it would be nice to include it.
-	if len(args) == 0 {
-		// If no arguments are given, default to the sequential version
-		mode = "s"
-		config = server.Config{Encoder: encoder, Decoder: decoder, Mode: mode}
-	} else if len(args) == 1 {
-		// If one argument is given and it is a number, then run in parallel mode for those many consumers
-		mode = "p"
-		nConsumers := args[0]
-		numConsumers, err := strconv.Atoi(nConsumers)
+	// The positional form of the graders and benchmarks: no argument runs the
+	// sequential version and one number runs the parallel version with as
+	// many consumers
+	parallel := isSet("consumers")
+	if len(args) == 1 {
+		numConsumers, err := strconv.Atoi(args[0])
 		if err != nil {
 			fmt.Println("Error: ", err)
 			Usage()
 			return
 		}
-		config = server.Config{Encoder: encoder, Decoder: decoder, Mode: mode, ConsumersCount: numConsumers}
+		*consumers = numConsumers
+		parallel = true
+	} else if len(args) > 1 {
+		Usage()
+		return
+	}
+	if *mode == "" {
+		*mode = "s"
+		if parallel {
+			*mode = "p"
+		}
+	}
+	switch *mode {
+	case "s", "pipeline":
+	case "p", "ws", "a":
+		if *consumers < 1 {
+			fmt.Println("Error: the", *mode, "version needs at least one consumer")
+			Usage()
+			return
+		}
+	default:
+		fmt.Println("Error: unknown mode", *mode)
+		Usage()
+		return
+	}
+	if *listenAddress != "" && (*inputFile != "" || *outputFile != "") {
+		fmt.Println("Error: -listen cannot be combined with -input or -output")
+		Usage()
+		return
+	}
+	switch *logLevel {
+	case "error":
+	case "info":
+		*scaleLog = true
+	case "debug":
+		*scaleLog, *structuredLog, *queueWaitLog = true, true, true
+	default:
+		fmt.Println("Error: unknown log level", *logLevel)
+		Usage()
+		return
+	}
 
-	} else {
+	protocol, err := server.LookupProtocol(*protocolName)
+	if err != nil {
+		fmt.Println("Error: ", err)
 		Usage()
 		return
 	}
 
+	config := server.Config{
+		Protocol:       protocol,
+		Mode:           *mode,
+		ConsumersCount: *consumers,
+		FeedImpl:       *feedImpl,
+		QueueImpl:      *queueImpl,
+		LockImpl:       *lockImpl,
+	}
+
+	// The first SIGINT/SIGTERM drains the server, the second one forces it to stop
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	config.Shutdown = signals
+	config.ShutdownTimeout = *shutdownTimeout
+	config.QueueCapacity = *queueCapacity
+	config.RejectWhenFull = *reject
+	config.ProducersCount = *producers
+	config.Distribution = *distribution
+	config.Output = server.OutputConfig{BufferSize: *outputBuffer, FlushInterval: *flushInterval}
+	if *idempotencyKeys > 0 {
+		config.Idempotency = server.NewIdempotencyCache(*idempotencyKeys, *idempotencyTTL)
+	}
+	pipeline, err := server.ParsePipelineConfig(*stages)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+	if *stageStats {
+		pipeline.Stats = os.Stderr
+	}
+	config.Pipeline = pipeline
+	config.Scaling.MinConsumers = *minConsumers
+	commands, err := server.ParsePriorities(*priorities)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+	config.Priorities = server.PriorityConfig{Enabled: *priority, Commands: commands, MaxSkips: *maxSkips}
+	config.RateLimits, err = server.ParseRateLimits(*rateLimits)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+	// The metrics also answer the STATS command, which is empty without them
+	if *stats || *metricsAddress != "" {
+		config.Metrics = server.NewMetrics()
+	}
+	if *metricsAddress != "" {
+		listener, err := net.Listen("tcp", *metricsAddress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", config.Metrics)
+		go http.Serve(listener, mux)
+	}
+	if *structuredLog || *traceFile != "" || *logLevel != "error" {
+		var logWriter io.Writer
+		if *structuredLog || *logLevel != "error" {
+			logWriter = os.Stderr
+		}
+		config.Tracer = trace.NewTracer(logWriter, *traceFile != "")
+		config.Tracer.LogRequests = *structuredLog
+	}
+	if *queueWaitLog {
+		waitLogger := log.New(os.Stderr, "twitter: ", log.LstdFlags|log.Lmicroseconds)
+		config.OnQueueWait = func(id interface{}, wait time.Duration) {
+			waitLogger.Printf("request %v waited %v in the queue", id, wait)
+		}
+	}
+	if *scaleLog {
+		config.Scaling.Logger = log.New(os.Stderr, "twitter: ", log.LstdFlags|log.Lmicroseconds)
+	}
+
+	if *replayFile != "" {
+		replay(config, *replayFile)
+		return
+	}
+	if *recordFile != "" || *verify {
+		var file io.Writer
+		if *recordFile != "" {
+			if file, err = os.Create(*recordFile); err != nil {
+				fmt.Fprintln(os.Stderr, "Error: ", err)
+				os.Exit(1)
+			}
+		}
+		// The checker needs the entries of the requests that were never answered
+		config.Recorder = record.NewRecorder(file, *verify)
+	}
+
 	// Run the server
-	server.Run(config)
+	if *listenAddress != "" {
+		listener, err := net.Listen("tcp", *listenAddress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+		err = server.Serve(config, listener)
+		exit(config, *traceFile, *verify, err)
+		return
+	}
+	// Create the streaming encoder and decoder
+	// Encoder pushes to stdout or the output file
+	// Decoder pulls from stdin or the input file
+	var input io.Reader = os.Stdin
+	if *inputFile != "" && *inputFile != "-" {
+		file, err := os.Open(*inputFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+	var output *os.File = os.Stdout
+	if *outputFile != "" && *outputFile != "-" {
+		output, err = os.Create(*outputFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			os.Exit(1)
+		}
+	}
+	config.Reader = input
+	config.Decoder = protocol.NewDecoder(input)
+	config.Writer = output
+	config.Encoder = protocol.NewEncoder(output)
+	err = server.Run(config)
+	if output != os.Stdout {
+		if closeErr := output.Close(); err == nil && closeErr != nil {
+			err = closeErr
+		}
+	}
+	exit(config, *traceFile, *verify, err)
+}
+
+// exit writes the trace and the recording of the run, checks the run if
+// asked to and exits with the status of the error the server stopped with
+func exit(config server.Config, traceFile string, verify bool, err error) {
+	if recordErr := config.Recorder.Close(); recordErr != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", recordErr)
+	}
+	if traceFile != "" {
+		if traceErr := writeTrace(config.Tracer, traceFile); traceErr != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", traceErr)
+		}
+	}
+	if verify && err == nil {
+		err = check(config.Recorder)
+	}
+	switch err {
+	case nil:
+	case server.ErrInterrupted:
+		os.Exit(exitInterrupted)
+	case server.ErrForcedShutdown:
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(exitForced)
+	default:
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
 
+// check prints every request of the run whose response no serialization
+// explains to stderr as a JSON line
+func check(recorder *record.Recorder) error {
+	violations := server.Check(recorder.Entries())
+	encoder := json.NewEncoder(os.Stderr)
+	for _, violation := range violations {
+		encoder.Encode(map[string]interface{}{
+			"arrival":  violation.Entry.Arrival,
+			"consumer": violation.Entry.Consumer,
+			"request":  violation.Entry.Request,
+			"response": violation.Entry.Response,
+			"reason":   violation.Reason,
+		})
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%v requests are not explained by any serialization", len(violations))
+	}
+	return nil
+}
+
+// replay re-executes a recording and prints every request whose response
+// differs as a JSON line, it exits with status 1 if any does
+func replay(config server.Config, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	differences, err := server.Replay(config, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, difference := range differences {
+		encoder.Encode(map[string]interface{}{
+			"arrival":    difference.Entry.Arrival,
+			"consumer":   difference.Entry.Consumer,
+			"request":    difference.Entry.Request,
+			"recorded":   difference.Entry.Response,
+			"replayed":   difference.Replayed,
+			"concurrent": difference.Concurrent,
+		})
+	}
+	if len(differences) > 0 {
+		fmt.Fprintln(os.Stderr, len(differences), "responses differ from the recording")
+		file.Close()
+		os.Exit(1)
+	}
+}
+
+// isSet returns whether a flag was given on the command line or by the
+// config file
+func isSet(name string) bool {
+	set := false
+	parser.Visit(func(f *parser.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// loadConfigFile sets the flags that were not given on the command line from
+// a JSON object of flag names to values, e.g. {"mode": "p", "consumers": 8}
+func loadConfigFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Numbers are kept as written, fmt.Sprint would print the large ones
+	// in exponent form, which the integer flags reject
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("config file %v: %v", path, err)
+	}
+	for name, value := range values {
+		if parser.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("config file %v: unknown flag %v", path, name)
+		}
+		if isSet(name) {
+			continue
+		}
+		if err := parser.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("config file %v: %v: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// writeTrace writes the requests traced during the run to a file in the
+// Chrome trace-event format
+func writeTrace(tracer *trace.Tracer, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tracer.WriteChrome(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
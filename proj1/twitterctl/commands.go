@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"proj1/server"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// help describes the commands of the REPL
+const help = `Commands:
+  add <body> <timestamp>   add a post, quote bodies with spaces: add "hello world" 123
+  rm <timestamp>           remove the post with a timestamp (also remove)
+  has <timestamp>          check whether the feed has a post (also contains)
+  feed [--limit n]         show the posts, the most recent first
+  stats                    show the metrics of the server
+  quota [client]           show the rate limit usage of a client, or of every client
+  help                     show this help
+  quit                     send DONE and exit (also exit or Ctrl-D)
+Options of every command:
+  --client name            client the request counts against for the rate limits
+  --key key                idempotency key of an add or rm
+  --priority level         high, normal, low or 0 to 2
+  --timeout duration       answer with a TIMEOUT error if not executed in time, e.g. 50ms
+`
+
+// command is a line of the REPL translated to a request
+type command struct {
+	request server.Request
+	limit   int // Posts of a FEED shown (0 = all)
+}
+
+// tokenize splits a line into words. Double-quoted words use the escapes of
+// Go strings, single-quoted words are taken as they are.
+func tokenize(line string) ([]string, error) {
+	var words []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, errors.New("unterminated \"")
+			}
+			word, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted word %v", line[i:end+1])
+			}
+			words = append(words, word)
+			i = end + 1
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated '")
+			}
+			words = append(words, line[i+1:i+1+end])
+			i += end + 2
+		default:
+			end := strings.IndexAny(line[i:], " \t")
+			if end < 0 {
+				end = len(line) - i
+			}
+			words = append(words, line[i:i+end])
+			i += end
+		}
+	}
+	return words, nil
+}
+
+// parseCommand translates the words of a line to a request
+func parseCommand(words []string) (command, error) {
+	var cmd command
+	var args []string
+	for i := 1; i < len(words); i++ {
+		word := words[i]
+		if !strings.HasPrefix(word, "--") {
+			args = append(args, word)
+			continue
+		}
+		name, value := word[2:], ""
+		if equals := strings.IndexByte(name, '='); equals >= 0 {
+			name, value = name[:equals], name[equals+1:]
+		} else if i+1 < len(words) {
+			i++
+			value = words[i]
+		} else {
+			return cmd, fmt.Errorf("--%v needs a value", name)
+		}
+		if err := cmd.setOption(name, value); err != nil {
+			return cmd, err
+		}
+	}
+
+	name := strings.ToLower(words[0])
+	arity := map[string]int{"add": 2, "rm": 1, "remove": 1, "has": 1, "contains": 1, "feed": 0, "stats": 0, "quota": -1}
+	expected, ok := arity[name]
+	if !ok {
+		return cmd, fmt.Errorf("unknown command %q, try help", words[0])
+	}
+	if expected >= 0 && len(args) != expected || expected < 0 && len(args) > 1 {
+		return cmd, fmt.Errorf("wrong number of arguments for %v, try help", name)
+	}
+	if cmd.limit != 0 && name != "feed" {
+		return cmd, errors.New("--limit is an option of feed")
+	}
+	request := &cmd.request
+	var err error
+	switch name {
+	case "add":
+		request.Command, request.Body = "ADD", args[0]
+		request.Timestamp, err = parseTimestamp(args[1])
+	case "rm", "remove":
+		request.Command = "REMOVE"
+		request.Timestamp, err = parseTimestamp(args[0])
+	case "has", "contains":
+		request.Command = "CONTAINS"
+		request.Timestamp, err = parseTimestamp(args[0])
+	case "feed":
+		request.Command = "FEED"
+	case "stats":
+		request.Command = "STATS"
+	case "quota":
+		request.Command = "QUOTA"
+		if len(args) == 1 {
+			request.Client = args[0]
+		}
+	}
+	return cmd, err
+}
+
+// setOption sets an option given as --name value
+func (cmd *command) setOption(name, value string) error {
+	switch name {
+	case "client":
+		cmd.request.Client = value
+	case "key":
+		cmd.request.IdempotencyKey = value
+	case "priority":
+		cmd.request.Priority = value
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid --timeout %q", value)
+		}
+		cmd.request.Timeout = timeout
+	case "limit":
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("invalid --limit %q", value)
+		}
+		cmd.limit = limit
+	default:
+		return fmt.Errorf("unknown option --%v, try help", name)
+	}
+	return nil
+}
+
+func parseTimestamp(word string) (float64, error) {
+	timestamp, err := strconv.ParseFloat(word, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", word)
+	}
+	return timestamp, nil
+}
+
+// printResponse prints the response to a request with its id
+func printResponse(w io.Writer, cmd command, id float64, response server.Response, err error) {
+	if responseErr, ok := err.(*server.ResponseError); ok {
+		fmt.Fprintf(w, "#%v error: %v", id, responseErr.Code)
+		if responseErr.RetryAfter > 0 {
+			fmt.Fprintf(w, ", retry after %v", responseErr.RetryAfter)
+		}
+		fmt.Fprintln(w)
+		return
+	} else if err != nil {
+		fmt.Fprintf(w, "#%v error: %v\n", id, err)
+		return
+	}
+	switch cmd.request.Command {
+	case "FEED":
+		posts := response.Feed
+		noun := "posts"
+		if len(posts) == 1 {
+			noun = "post"
+		}
+		fmt.Fprintf(w, "#%v %v %v", id, len(posts), noun)
+		if cmd.limit > 0 && cmd.limit < len(posts) {
+			fmt.Fprintf(w, ", the %v most recent", cmd.limit)
+			posts = posts[:cmd.limit]
+		}
+		fmt.Fprintln(w)
+		for _, post := range posts {
+			fmt.Fprintf(w, "  %12v  %q\n", post.Timestamp, post.Body)
+		}
+	case "STATS", "QUOTA":
+		value := response.Stats
+		if cmd.request.Command == "QUOTA" {
+			value = response.Quota
+		}
+		encoded, _ := json.MarshalIndent(value, "", "  ")
+		fmt.Fprintf(w, "#%v %s\n", id, encoded)
+	default:
+		fmt.Fprintf(w, "#%v %v\n", id, response.Success)
+	}
+}
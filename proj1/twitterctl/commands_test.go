@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"proj1/server"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	var tests = []struct {
+		line     string
+		expected []string
+	}{
+		{"add hello 1", []string{"add", "hello", "1"}},
+		{"  add\t\"hello world\"  1 ", []string{"add", "hello world", "1"}},
+		{`add "say \"hi\"\n" 1`, []string{"add", "say \"hi\"\n", "1"}},
+		{`add 'no \escapes' 1`, []string{"add", `no \escapes`, "1"}},
+		{`add "" 1`, []string{"add", "", "1"}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if words, err := tokenize(test.line); err != nil || !reflect.DeepEqual(words, test.expected) {
+			t.Errorf("Expected %q for %q, got %q (%v)", test.expected, test.line, words, err)
+		}
+	}
+	for _, line := range []string{`add "hello 1`, "add 'hello 1", `add "\q" 1`} {
+		if _, err := tokenize(line); err == nil {
+			t.Errorf("Expected an error for %q", line)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	var tests = []struct {
+		line     string
+		expected command
+	}{
+		{`add "hello" 123`, command{request: server.Request{Command: "ADD", Body: "hello", Timestamp: 123}}},
+		{"rm 1.5", command{request: server.Request{Command: "REMOVE", Timestamp: 1.5}}},
+		{"remove 2", command{request: server.Request{Command: "REMOVE", Timestamp: 2}}},
+		{"HAS 3", command{request: server.Request{Command: "CONTAINS", Timestamp: 3}}},
+		{"feed --limit 10", command{request: server.Request{Command: "FEED"}, limit: 10}},
+		{"feed --limit=5", command{request: server.Request{Command: "FEED"}, limit: 5}},
+		{"stats", command{request: server.Request{Command: "STATS"}}},
+		{"quota alice", command{request: server.Request{Command: "QUOTA", Client: "alice"}}},
+		{"add x 1 --client bob --key k --priority high --timeout 50ms", command{request: server.Request{
+			Command: "ADD", Body: "x", Timestamp: 1, Client: "bob", IdempotencyKey: "k", Priority: "high", Timeout: 50 * time.Millisecond,
+		}}},
+	}
+	for _, test := range tests {
+		words, _ := tokenize(test.line)
+		if cmd, err := parseCommand(words); err != nil || cmd != test.expected {
+			t.Errorf("Expected %+v for %q, got %+v (%v)", test.expected, test.line, cmd, err)
+		}
+	}
+	for _, line := range []string{"like 1", "add x", "rm", "rm abc", "feed 1", "has 1 --limit 2", "feed --limit 0", "feed --limit", "add x 1 --color red", "quota a b"} {
+		words, _ := tokenize(line)
+		if _, err := parseCommand(words); err == nil {
+			t.Errorf("Expected an error for %q", line)
+		}
+	}
+}
+
+func TestPrintResponse(t *testing.T) {
+	feed := command{request: server.Request{Command: "FEED"}, limit: 1}
+	posts := server.Response{Feed: []server.Post{{Body: "b", Timestamp: 2}, {Body: "a", Timestamp: 1}}}
+	var tests = []struct {
+		cmd      command
+		response server.Response
+		err      error
+		expected string
+	}{
+		{command{request: server.Request{Command: "ADD"}}, server.Response{Success: true}, nil, "#7 true\n"},
+		{feed, posts, nil, "#7 2 posts, the 1 most recent\n             2  \"b\"\n"},
+		{command{request: server.Request{Command: "QUOTA"}}, server.Response{Quota: map[string]interface{}{"a": 1}}, nil, "#7 {\n  \"a\": 1\n}\n"},
+		{feed, server.Response{}, &server.ResponseError{Code: server.ErrorRateLimited, RetryAfter: time.Second}, "#7 error: RATE_LIMITED, retry after 1s\n"},
+	}
+	for _, test := range tests {
+		var output bytes.Buffer
+		printResponse(&output, test.cmd, 7, test.response, test.err)
+		if output.String() != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, output.String())
+		}
+	}
+}
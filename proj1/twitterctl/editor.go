@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C discards the line
+var errInterrupted = errors.New("interrupted")
+
+// Control keys understood by the editor
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// editor reads lines from a terminal in raw mode with Emacs-style editing
+// keys, the arrow keys and a history of the lines read
+type editor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history []string
+	// The line being edited, the cursor position in it and the history
+	// entry shown (len(history) = the new line)
+	line   []rune
+	cursor int
+	shown  int
+	draft  []rune // The new line while a history entry is shown
+}
+
+func newEditor(in io.Reader, out io.Writer) *editor {
+	return &editor{in: bufio.NewReader(in), out: out}
+}
+
+// readLine reads a line after printing prompt. It returns io.EOF for Ctrl-D
+// on an empty line and errInterrupted for Ctrl-C.
+func (editor *editor) readLine(prompt string) (string, error) {
+	editor.line, editor.cursor, editor.shown, editor.draft = nil, 0, len(editor.history), nil
+	fmt.Fprint(editor.out, prompt)
+	for {
+		key, _, err := editor.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(editor.line) > 0 {
+				break
+			}
+			return "", err
+		}
+		switch key {
+		case keyEnter, '\n':
+			fmt.Fprint(editor.out, "\n")
+			line := string(editor.line)
+			editor.remember(line)
+			return line, nil
+		case keyCtrlC:
+			fmt.Fprint(editor.out, "^C\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(editor.line) == 0 {
+				fmt.Fprint(editor.out, "\n")
+				return "", io.EOF
+			}
+			editor.deleteAt(editor.cursor)
+		case keyBackspace, keyDelete:
+			if editor.cursor > 0 {
+				editor.cursor--
+				editor.deleteAt(editor.cursor)
+			}
+		case keyCtrlA:
+			editor.cursor = 0
+		case keyCtrlE:
+			editor.cursor = len(editor.line)
+		case keyCtrlB:
+			editor.move(-1)
+		case keyCtrlF:
+			editor.move(1)
+		case keyCtrlK:
+			editor.line = editor.line[:editor.cursor]
+		case keyCtrlU:
+			editor.line = append([]rune(nil), editor.line[editor.cursor:]...)
+			editor.cursor = 0
+		case keyCtrlW:
+			editor.deleteWord()
+		case keyCtrlL:
+			fmt.Fprint(editor.out, "\x1b[H\x1b[2J")
+		case keyCtrlP:
+			editor.browse(-1)
+		case keyCtrlN:
+			editor.browse(1)
+		case keyEscape:
+			editor.escape()
+		default:
+			if unicode.IsPrint(key) {
+				editor.insert(key)
+			}
+		}
+		editor.render(prompt)
+	}
+	// The input ended without a newline
+	line := string(editor.line)
+	editor.remember(line)
+	return line, nil
+}
+
+// escape handles the escape sequences of the arrow, Home, End and Delete
+// keys, the others are ignored
+func (editor *editor) escape() {
+	prefix, err := editor.in.ReadByte()
+	if err != nil || (prefix != '[' && prefix != 'O') {
+		return
+	}
+	var sequence []byte
+	for {
+		b, err := editor.in.ReadByte()
+		if err != nil {
+			return
+		}
+		sequence = append(sequence, b)
+		// Parameters are digits and semicolons, the final byte is a letter
+		// or a tilde
+		if (b < '0' || b > '9') && b != ';' {
+			break
+		}
+	}
+	switch string(sequence) {
+	case "A":
+		editor.browse(-1)
+	case "B":
+		editor.browse(1)
+	case "C":
+		editor.move(1)
+	case "D":
+		editor.move(-1)
+	case "H", "1~", "7~":
+		editor.cursor = 0
+	case "F", "4~", "8~":
+		editor.cursor = len(editor.line)
+	case "3~":
+		editor.deleteAt(editor.cursor)
+	}
+}
+
+// insert adds a character at the cursor
+func (editor *editor) insert(key rune) {
+	editor.line = append(editor.line, 0)
+	copy(editor.line[editor.cursor+1:], editor.line[editor.cursor:])
+	editor.line[editor.cursor] = key
+	editor.cursor++
+}
+
+// deleteAt removes the character at a position, if any
+func (editor *editor) deleteAt(position int) {
+	if position < len(editor.line) {
+		editor.line = append(editor.line[:position], editor.line[position+1:]...)
+	}
+}
+
+// deleteWord removes the word before the cursor and the spaces after it
+func (editor *editor) deleteWord() {
+	start := editor.cursor
+	for start > 0 && unicode.IsSpace(editor.line[start-1]) {
+		start--
+	}
+	for start > 0 && !unicode.IsSpace(editor.line[start-1]) {
+		start--
+	}
+	editor.line = append(editor.line[:start], editor.line[editor.cursor:]...)
+	editor.cursor = start
+}
+
+// move moves the cursor within the line
+func (editor *editor) move(offset int) {
+	if cursor := editor.cursor + offset; cursor >= 0 && cursor <= len(editor.line) {
+		editor.cursor = cursor
+	}
+}
+
+// browse replaces the line with an older (-1) or newer (1) line of the
+// history, the line being typed is kept as the newest
+func (editor *editor) browse(offset int) {
+	shown := editor.shown + offset
+	if shown < 0 || shown > len(editor.history) {
+		return
+	}
+	if editor.shown == len(editor.history) {
+		editor.draft = editor.line
+	}
+	editor.shown = shown
+	if shown == len(editor.history) {
+		editor.line = editor.draft
+	} else {
+		editor.line = []rune(editor.history[shown])
+	}
+	editor.cursor = len(editor.line)
+}
+
+// remember adds a line to the history, unless it is blank or repeats the
+// last one
+func (editor *editor) remember(line string) {
+	blank := true
+	for _, r := range line {
+		blank = blank && unicode.IsSpace(r)
+	}
+	if !blank && (len(editor.history) == 0 || editor.history[len(editor.history)-1] != line) {
+		editor.history = append(editor.history, line)
+	}
+}
+
+// render redraws the line and puts the cursor back in place
+func (editor *editor) render(prompt string) {
+	fmt.Fprintf(editor.out, "\r%v%v\x1b[K", prompt, string(editor.line))
+	if back := len(editor.line) - editor.cursor; back > 0 {
+		fmt.Fprintf(editor.out, "\x1b[%vD", back)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEditor(t *testing.T) {
+	var tests = []struct {
+		keys     string
+		expected []string // Lines read, "^C" for an interrupted line
+	}{
+		{"add x 1\r", []string{"add x 1"}},
+		{"ad x 1\x01\x1b[C\x1b[Cd\r", []string{"add x 1"}},
+		{"add x 12\x7f\x7f1\r", []string{"add x 1"}},
+		{"rm 1\x1b[D\x1b[3~\x052\r", []string{"rm 2"}},
+		{"add hello world\x17\x17x 1\r", []string{"add x 1"}},
+		{"add x 1 junk\x02\x02\x02\x02\x02\x0b\r", []string{"add x 1"}},
+		{"junk\x15feed\r", []string{"feed"}},
+		{"feed\x03stats\r", []string{"^C", "stats"}},
+		// The history is browsed with the arrows and Ctrl-P/Ctrl-N
+		{"has 1\rhas 2\r\x1b[A\x1b[A\r", []string{"has 1", "has 2", "has 1"}},
+		{"has 1\rdraft\x10\x0e\r", []string{"has 1", "draft"}},
+		{"has 1\r\x1b[A\x1b[B\x1b[B\r", []string{"has 1", ""}},
+		{"stats", []string{"stats"}},
+	}
+	for _, test := range tests {
+		editor := newEditor(strings.NewReader(test.keys), ioutil.Discard)
+		var lines []string
+		for {
+			line, err := editor.readLine(prompt)
+			if err == io.EOF {
+				break
+			} else if err == errInterrupted {
+				line = "^C"
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+		}
+		if strings.Join(lines, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.keys, lines)
+		}
+	}
+
+	// Ctrl-D ends the input on an empty line only
+	editor := newEditor(strings.NewReader("x\x01\x04\r\x04"), ioutil.Discard)
+	if line, err := editor.readLine(prompt); line != "" || err != nil {
+		t.Errorf("Expected Ctrl-D to delete the character, got %q (%v)", line, err)
+	}
+	if _, err := editor.readLine(prompt); err != io.EOF {
+		t.Errorf("Expected the end of the input, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// makeRaw switches the terminal of fd to raw mode for the editor and returns
+// the function restoring its previous mode. It fails if fd is not a terminal.
+func makeRaw(fd uintptr) (func(), error) {
+	var previous syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, &previous); err != nil {
+		return nil, err
+	}
+	raw := previous
+	// Keys are read one at a time without echo, Ctrl-C and Ctrl-D are read
+	// as keys. The output is still translated so \n starts a new line.
+	raw.Iflag &^= syscall.ICRNL | syscall.INLCR | syscall.IXON | syscall.ISTRIP
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(fd, syscall.TCSETS, &previous) }, nil
+}
+
+func ioctl(fd uintptr, request uintptr, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
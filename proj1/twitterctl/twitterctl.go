@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	parser "flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"proj1/client"
+	"proj1/server"
+	"strings"
+	"time"
+)
+
+// prompt is printed before each line read from a terminal
+const prompt = "twitter> "
+
+func Usage() {
+	fmt.Println("Usage: twitterctl [flags] [-- <flags of the spawned server>]\n Sends the commands typed at the prompt to a twitter server and prints the responses, type help for the commands.\n Without -connect the server is spawned as a subprocess with the flags given after --.\nFlags:")
+	parser.CommandLine.SetOutput(os.Stdout)
+	parser.PrintDefaults()
+}
+
+func main() {
+	connect := parser.String("connect", "", "connect to a server started with -listen at this address instead of spawning one")
+	serverPath := parser.String("server", "twitter", "twitter binary to spawn")
+	protocolName := parser.String("protocol", "json", "protocol of the server: json or binary")
+	timeout := parser.Duration("timeout", 10*time.Second, "deadline of each request")
+	showRequests := parser.Bool("show-requests", false, "print each request sent, as JSON")
+	parser.Usage = Usage
+	parser.Parse()
+	protocol, err := server.LookupProtocol(*protocolName)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+
+	var conn *client.Client
+	if *connect != "" {
+		conn, err = client.Dial(*connect, protocol)
+	} else {
+		cmd := exec.Command(*serverPath, append([]string{"-protocol", *protocolName}, parser.Args()...)...)
+		cmd.Stderr = os.Stderr
+		conn, err = client.Exec(cmd, protocol)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+	session := &session{client: conn, out: os.Stdout, timeout: *timeout, showRequests: *showRequests}
+	session.run(newLineReader(os.Stdin, os.Stdout))
+	if err := conn.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
+
+// lineReader reads the lines typed by the user
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// newLineReader returns the editor if in is a terminal, the lines of a
+// script are read without a prompt
+func newLineReader(in *os.File, out io.Writer) lineReader {
+	restore, err := makeRaw(in.Fd())
+	if err != nil {
+		return scriptReader{bufio.NewScanner(in)}
+	}
+	restore()
+	return &terminalReader{fd: in.Fd(), editor: newEditor(in, out)}
+}
+
+// terminalReader switches the terminal to raw mode while a line is edited
+type terminalReader struct {
+	fd     uintptr
+	editor *editor
+}
+
+func (reader *terminalReader) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(reader.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	return reader.editor.readLine(prompt)
+}
+
+// scriptReader reads the lines of a script
+type scriptReader struct {
+	scanner *bufio.Scanner
+}
+
+func (reader scriptReader) readLine(string) (string, error) {
+	if !reader.scanner.Scan() {
+		if err := reader.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return reader.scanner.Text(), nil
+}
+
+// session executes the commands of the user one at a time
+type session struct {
+	client       *client.Client
+	out          io.Writer
+	timeout      time.Duration // Deadline of each request
+	showRequests bool
+}
+
+// run executes the commands until quit or the end of the input
+func (session *session) run(lines lineReader) {
+	for {
+		line, err := lines.readLine(prompt)
+		if err == errInterrupted {
+			continue
+		} else if err != nil {
+			return
+		}
+		words, err := tokenize(line)
+		if err != nil {
+			fmt.Fprintln(session.out, "error:", err)
+			continue
+		}
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		switch strings.ToLower(words[0]) {
+		case "help":
+			fmt.Fprint(session.out, help)
+			continue
+		case "quit", "exit":
+			return
+		}
+		cmd, err := parseCommand(words)
+		if err != nil {
+			fmt.Fprintln(session.out, "error:", err)
+			continue
+		}
+		session.execute(cmd)
+	}
+}
+
+// execute sends a request and prints its response
+func (session *session) execute(cmd command) {
+	ctx, cancel := context.WithTimeout(context.Background(), session.timeout)
+	defer cancel()
+	future := session.client.Do(ctx, cmd.request)
+	if session.showRequests {
+		if message, err := cmd.request.Message(ctx); err == nil {
+			message["id"] = future.ID()
+			encoded, _ := json.Marshal(message)
+			fmt.Fprintf(session.out, "> %s\n", encoded)
+		}
+	}
+	select {
+	case <-future.Done():
+		response, err := future.Wait()
+		printResponse(session.out, cmd, future.ID(), response, err)
+	case <-ctx.Done():
+		fmt.Fprintf(session.out, "#%v error: no response after %v\n", future.ID(), session.timeout)
+	}
+}
@@ -0,0 +1,402 @@
+// Package wire implements the compact binary protocol of the server, an
+// alternative to newline-delimited JSON that avoids reflection on the common
+// fields of the requests and responses.
+//
+// Every message is a frame: its length as an unsigned varint followed by the
+// payload. The payload is laid out as
+//
+//	command   byte              one of the Op constants (OpNone = no command)
+//	flags     byte              which of the optional fields follow
+//	id        signed varint     if flags&FlagID
+//	timestamp float64, LE       if flags&FlagTimestamp
+//	body      uvarint + bytes   if flags&FlagBody
+//	success   byte (0 or 1)     if flags&FlagSuccess
+//	feed      uvarint count,    if flags&FlagFeed
+//	          count × (timestamp float64 LE, body uvarint + bytes)
+//	extras    uvarint + bytes   if flags&FlagExtras, a JSON object holding
+//	                            every other field
+//
+// Requests and responses share the layout, so a message decodes to the same
+// map[string]interface{} as its JSON form: numbers are float64, the feed is
+// a []interface{} of {"body", "timestamp"} maps.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Opcodes of the commands
+const (
+	OpNone byte = iota
+	OpAdd
+	OpRemove
+	OpContains
+	OpFeed
+	OpDone
+	OpStats
+	OpQuota
+)
+
+// commands are the names of the opcodes
+var commands = [...]string{"", "ADD", "REMOVE", "CONTAINS", "FEED", "DONE", "STATS", "QUOTA"}
+
+// Flags of the optional fields of a payload
+const (
+	FlagID byte = 1 << iota
+	FlagTimestamp
+	FlagBody
+	FlagSuccess
+	FlagFeed
+	FlagExtras
+)
+
+// MaxFrame is the largest payload accepted by ReadFrame
+const MaxFrame = 64 << 20
+
+// ErrMalformed is returned for a payload that does not follow the layout
+var ErrMalformed = errors.New("wire: malformed payload")
+
+// opcode returns the opcode of a command, OpNone if it has none
+func opcode(command string) byte {
+	for op, name := range commands {
+		if op > 0 && name == command {
+			return byte(op)
+		}
+	}
+	return OpNone
+}
+
+// IsDone checks whether a payload is the DONE command
+func IsDone(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == OpDone
+}
+
+// AppendFrame appends the frame of a message to dst
+func AppendFrame(dst []byte, message map[string]interface{}) ([]byte, error) {
+	payload, err := Marshal(message)
+	if err != nil {
+		return dst, err
+	}
+	dst = appendUvarint(dst, uint64(len(payload)))
+	return append(dst, payload...), nil
+}
+
+// Marshal returns the payload of a message, without the length prefix
+func Marshal(message map[string]interface{}) ([]byte, error) {
+	payload := make([]byte, 2, 32)
+	var flags byte
+	var extras map[string]interface{}
+	// extra keeps a field that has no compact encoding for the JSON extras
+	extra := func(key string, value interface{}) {
+		if extras == nil {
+			extras = make(map[string]interface{})
+		}
+		extras[key] = value
+	}
+
+	if command, ok := message["command"].(string); ok && opcode(command) != OpNone {
+		payload[0] = opcode(command)
+	} else if command, ok := message["command"]; ok {
+		extra("command", command)
+	}
+	if id, ok := message["id"].(float64); ok && id == math.Trunc(id) && math.Abs(id) < 1<<53 {
+		flags |= FlagID
+		payload = appendVarint(payload, int64(id))
+	} else if id, ok := message["id"]; ok {
+		extra("id", id)
+	}
+	if timestamp, ok := message["timestamp"].(float64); ok {
+		flags |= FlagTimestamp
+		payload = appendFloat(payload, timestamp)
+	} else if timestamp, ok := message["timestamp"]; ok {
+		extra("timestamp", timestamp)
+	}
+	if body, ok := message["body"].(string); ok {
+		flags |= FlagBody
+		payload = appendString(payload, body)
+	} else if body, ok := message["body"]; ok {
+		extra("body", body)
+	}
+	if success, ok := message["success"].(bool); ok {
+		flags |= FlagSuccess
+		if success {
+			payload = append(payload, 1)
+		} else {
+			payload = append(payload, 0)
+		}
+	} else if success, ok := message["success"]; ok {
+		extra("success", success)
+	}
+	if posts, ok := compactFeed(message["feed"]); ok {
+		flags |= FlagFeed
+		payload = appendUvarint(payload, uint64(len(posts)))
+		for _, post := range posts {
+			payload = appendFloat(payload, post["timestamp"].(float64))
+			payload = appendString(payload, post["body"].(string))
+		}
+	} else if feed, ok := message["feed"]; ok {
+		extra("feed", feed)
+	}
+	for key, value := range message {
+		switch key {
+		case "command", "id", "timestamp", "body", "success", "feed":
+		default:
+			extra(key, value)
+		}
+	}
+	if extras != nil {
+		encoded, err := json.Marshal(extras)
+		if err != nil {
+			return nil, err
+		}
+		flags |= FlagExtras
+		payload = appendUvarint(payload, uint64(len(encoded)))
+		payload = append(payload, encoded...)
+	}
+	payload[1] = flags
+	return payload, nil
+}
+
+// compactFeed returns the posts of a feed field if every post only has a
+// string body and a float64 timestamp
+func compactFeed(field interface{}) ([]map[string]interface{}, bool) {
+	feed, ok := field.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	posts := make([]map[string]interface{}, len(feed))
+	for i, element := range feed {
+		post, ok := element.(map[string]interface{})
+		if !ok || len(post) != 2 {
+			return nil, false
+		}
+		if _, ok := post["body"].(string); !ok {
+			return nil, false
+		}
+		if _, ok := post["timestamp"].(float64); !ok {
+			return nil, false
+		}
+		posts[i] = post
+	}
+	return posts, true
+}
+
+// Unmarshal decodes a payload, without the length prefix
+func Unmarshal(payload []byte) (map[string]interface{}, error) {
+	if len(payload) < 2 || int(payload[0]) >= len(commands) {
+		return nil, ErrMalformed
+	}
+	message := make(map[string]interface{})
+	if payload[0] != OpNone {
+		message["command"] = commands[payload[0]]
+	}
+	flags := payload[1]
+	reader := payloadReader{payload: payload, offset: 2}
+	if flags&FlagID != 0 {
+		message["id"] = float64(reader.varint())
+	}
+	if flags&FlagTimestamp != 0 {
+		message["timestamp"] = reader.float()
+	}
+	if flags&FlagBody != 0 {
+		message["body"] = string(reader.bytes())
+	}
+	if flags&FlagSuccess != 0 {
+		message["success"] = reader.byte() == 1
+	}
+	if flags&FlagFeed != 0 {
+		count := reader.uvarint()
+		if count > uint64(len(payload)) {
+			return nil, ErrMalformed
+		}
+		feed := make([]interface{}, 0, count)
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			timestamp := reader.float()
+			feed = append(feed, map[string]interface{}{"body": string(reader.bytes()), "timestamp": timestamp})
+		}
+		message["feed"] = feed
+	}
+	if flags&FlagExtras != 0 {
+		extras := reader.bytes()
+		if reader.err == nil {
+			if err := json.Unmarshal(extras, &message); err != nil {
+				return nil, fmt.Errorf("wire: malformed extras: %v", err)
+			}
+		}
+	}
+	if reader.err != nil || reader.offset != len(payload) {
+		return nil, ErrMalformed
+	}
+	return message, nil
+}
+
+// ReadFrame reads the payload of the next frame. It returns io.EOF at the
+// end of the input between frames and io.ErrUnexpectedEOF inside a frame.
+func ReadFrame(reader *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxFrame {
+		return nil, fmt.Errorf("wire: frame of %v bytes is too large", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Encoder writes messages as frames to an output stream. Like a
+// json.Encoder every frame is written with a single Write, so concurrent
+// calls to Encode do not interleave frames when the writer serializes writes.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder that writes to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the frame of a map[string]interface{} or a pointer to one
+// with a single Write
+func (encoder *Encoder) Encode(v interface{}) error {
+	var message map[string]interface{}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		message = value
+	case *map[string]interface{}:
+		message = *value
+	default:
+		return fmt.Errorf("wire: cannot encode %T", v)
+	}
+	frame, err := AppendFrame(nil, message)
+	if err != nil {
+		return err
+	}
+	_, err = encoder.w.Write(frame)
+	return err
+}
+
+// Decoder reads frames from an input stream
+type Decoder struct {
+	reader *bufio.Reader
+}
+
+// NewDecoder returns a decoder that reads from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r)}
+}
+
+// Decode reads the next frame into a *map[string]interface{}
+func (decoder *Decoder) Decode(v interface{}) error {
+	target, ok := v.(*map[string]interface{})
+	if !ok {
+		return fmt.Errorf("wire: cannot decode into %T", v)
+	}
+	payload, err := ReadFrame(decoder.reader)
+	if err != nil {
+		return err
+	}
+	message, err := Unmarshal(payload)
+	if err != nil {
+		return err
+	}
+	*target = message
+	return nil
+}
+
+func appendUvarint(dst []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(dst, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
+
+func appendVarint(dst []byte, value int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(dst, scratch[:binary.PutVarint(scratch[:], value)]...)
+}
+
+func appendFloat(dst []byte, value float64) []byte {
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(value))
+	return append(dst, scratch[:]...)
+}
+
+func appendString(dst []byte, value string) []byte {
+	dst = appendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// payloadReader reads the fields of a payload, the first error sticks
+type payloadReader struct {
+	payload []byte
+	offset  int
+	err     error
+}
+
+func (reader *payloadReader) uvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.payload[reader.offset:])
+	if n <= 0 {
+		reader.err = ErrMalformed
+		return 0
+	}
+	reader.offset += n
+	return value
+}
+
+func (reader *payloadReader) varint() int64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(reader.payload[reader.offset:])
+	if n <= 0 {
+		reader.err = ErrMalformed
+		return 0
+	}
+	reader.offset += n
+	return value
+}
+
+func (reader *payloadReader) float() float64 {
+	if reader.err != nil || len(reader.payload)-reader.offset < 8 {
+		reader.err = ErrMalformed
+		return 0
+	}
+	value := math.Float64frombits(binary.LittleEndian.Uint64(reader.payload[reader.offset:]))
+	reader.offset += 8
+	return value
+}
+
+func (reader *payloadReader) byte() byte {
+	if reader.err != nil || reader.offset >= len(reader.payload) {
+		reader.err = ErrMalformed
+		return 0
+	}
+	value := reader.payload[reader.offset]
+	reader.offset++
+	return value
+}
+
+func (reader *payloadReader) bytes() []byte {
+	length := reader.uvarint()
+	if reader.err != nil || length > uint64(len(reader.payload)-reader.offset) {
+		reader.err = ErrMalformed
+		return nil
+	}
+	value := reader.payload[reader.offset : reader.offset+int(length)]
+	reader.offset += int(length)
+	return value
+}
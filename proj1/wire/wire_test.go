@@ -0,0 +1,155 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var tests = []string{
+		`{"command": "ADD", "id": 1, "body": "just setting up my twttr", "timestamp": 43289}`,
+		`{"command": "REMOVE", "id": -7, "timestamp": 1.5}`,
+		`{"command": "FEED", "id": 3}`,
+		`{"command": "DONE"}`,
+		`{"command": "CONTAINS", "id": 2, "timestamp": 5, "client": "alice", "priority": "high", "timeout_ms": 20}`,
+		`{"command": "LIKE", "id": 4}`,
+		`{"id": 1.5, "success": true}`,
+		`{"id": "seven", "success": false, "error": "TIMEOUT", "queue_wait_ms": 12.5}`,
+		`{"id": 3, "feed": [{"body": "b", "timestamp": 2}, {"body": "a", "timestamp": 1}]}`,
+		`{"id": 3, "feed": []}`,
+		`{"id": 3, "feed": [{"body": "a", "timestamp": 1, "likes": 2}]}`,
+		`{"id": 9, "stats": {"requests": {"ADD": 3}}}`,
+	}
+	for _, test := range tests {
+		var message map[string]interface{}
+		if err := json.Unmarshal([]byte(test), &message); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := AppendFrame(nil, message)
+		if err != nil {
+			t.Fatalf("%v: %v", test, err)
+		}
+		payload, err := ReadFrame(bufio.NewReader(bytes.NewReader(frame)))
+		if err != nil {
+			t.Fatalf("%v: %v", test, err)
+		}
+		decoded, err := Unmarshal(payload)
+		if err != nil {
+			t.Fatalf("%v: %v", test, err)
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Errorf("Expected %v, got %v", message, decoded)
+		}
+		if IsDone(payload) != (message["command"] == "DONE") {
+			t.Errorf("%v: wrong IsDone", test)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	message := map[string]interface{}{"command": "ADD", "id": 1.0, "body": "hello", "timestamp": 2.0}
+	payload, err := Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opcode, flags, one byte of id, the timestamp and the body with its length
+	if len(payload) != 2+1+8+1+5 {
+		t.Errorf("Expected the common fields without extras, got %v bytes", len(payload))
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	var tests = [][]byte{
+		{},
+		{OpAdd},
+		{99, 0},
+		{OpAdd, FlagTimestamp, 1, 2},
+		{OpAdd, FlagBody, 10, 'a'},
+		{OpFeed, FlagFeed, 200},
+		{OpAdd, 0, 1},
+		{OpAdd, FlagExtras, 2, '{', 'x'},
+	}
+	for _, test := range tests {
+		if _, err := Unmarshal(test); err == nil {
+			t.Errorf("Expected an error for %v", test)
+		}
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var buffer bytes.Buffer
+	encoder := NewEncoder(&buffer)
+	for i := 0; i < 3; i++ {
+		response := map[string]interface{}{"id": float64(i), "success": true}
+		if err := encoder.Encode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Encode("text"); err == nil {
+		t.Errorf("Expected an error for a value that is not a message")
+	}
+	full := buffer.Bytes()
+
+	decoder := NewDecoder(bytes.NewReader(full))
+	for i := 0; i < 3; i++ {
+		var message map[string]interface{}
+		if err := decoder.Decode(&message); err != nil || message["id"] != float64(i) {
+			t.Fatalf("Expected message %v, got %v (%v)", i, message, err)
+		}
+	}
+	var message map[string]interface{}
+	if err := decoder.Decode(&message); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last frame, got %v", err)
+	}
+	decoder = NewDecoder(bytes.NewReader(full[:len(full)-1]))
+	decoder.Decode(&message)
+	decoder.Decode(&message)
+	if err := decoder.Decode(&message); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+}
+
+func TestConcurrentEncode(t *testing.T) {
+	var mutex sync.Mutex
+	var buffer bytes.Buffer
+	encoder := NewEncoder(writerFunc(func(p []byte) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return buffer.Write(p)
+	}))
+	var wg sync.WaitGroup
+	for goID := 0; goID < 8; goID++ {
+		wg.Add(1)
+		go func(goID int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				encoder.Encode(map[string]interface{}{"id": float64(goID*500 + i), "success": true})
+			}
+		}(goID)
+	}
+	wg.Wait()
+	decoder := NewDecoder(&buffer)
+	seen := make(map[float64]bool)
+	for {
+		var message map[string]interface{}
+		if err := decoder.Decode(&message); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Interleaved frames: %v", err)
+		}
+		seen[message["id"].(float64)] = true
+	}
+	if len(seen) != 8*500 {
+		t.Errorf("Expected %v messages, got %v", 8*500, len(seen))
+	}
+}
+
+// writerFunc adapts a function to an io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
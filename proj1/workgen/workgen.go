@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	parser "flag"
+	"fmt"
+	"io"
+	"os"
+	"proj1/client"
+	"proj1/semaphore"
+	"proj1/server"
+	"proj1/workload"
+	"sort"
+	"sync"
+	"time"
+)
+
+func Usage() {
+	fmt.Println("Usage: workgen [flags] [<output file>] \n Generates a workload of requests for twitter.go, as newline-delimited JSON tasks or binary frames with -protocol binary. \n The tasks are written to stdout by default, so they can be piped into twitter.go, or streamed to a server with -connect.\nFlags:")
+	parser.CommandLine.SetOutput(os.Stdout)
+	parser.PrintDefaults()
+}
+
+func main() {
+	requests := parser.Int("requests", 10000, "number of requests, DONE excluded")
+	mixSpec := parser.String("mix", workload.DefaultMix, "relative weight of each command as command=weight,... (commands: add, remove, contains, feed)")
+	targets := parser.String("targets", workload.Uniform, "which posts CONTAINS and REMOVE target: uniform (any post added so far) or zipf (mostly the recent ones)")
+	zipfS := parser.Float64("zipf-s", 1.1, "skew of the zipf distribution, greater than 1 (higher = more requests on the most recent posts)")
+	randomInserts := parser.Float64("random-inserts", 0, "share of the ADDs inserted at a random time before the most recent post instead of appended (0 = append only, 1 = random insertion)")
+	bodySizes := parser.String("body-size", "16", "length of the bodies: a length (16), a uniform range (8-64) or an exponential distribution with a mean (exp:32)")
+	seed := parser.Int64("seed", 1, "seed of the workload, the same flags and seed give the same requests")
+	done := parser.Bool("done", true, "end the tasks with DONE")
+	protocolName := parser.String("protocol", "json", "format of the tasks: json (one object per line) or binary (length-prefixed frames)")
+	connect := parser.String("connect", "", "stream the requests to a server started with -listen at this address and print a summary of the responses to stderr instead of writing the tasks")
+	window := parser.Int("window", 1024, "most requests waiting for their response with -connect")
+	parser.Usage = Usage
+	parser.Parse()
+	args := parser.Args()
+	if len(args) > 1 || *window < 1 {
+		Usage()
+		return
+	}
+	protocol, err := server.LookupProtocol(*protocolName)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+	config := workload.Config{Requests: *requests, Targets: *targets, ZipfS: *zipfS, RandomInserts: *randomInserts, Seed: *seed}
+	if config.Mix, err = workload.ParseMix(*mixSpec); err == nil {
+		config.Bodies, err = workload.ParseBodySizes(*bodySizes)
+	}
+	var generator *workload.Generator
+	if err == nil {
+		generator, err = workload.NewGenerator(config)
+	}
+	if err != nil {
+		fmt.Println("Error: ", err)
+		Usage()
+		return
+	}
+
+	if *connect != "" {
+		err = stream(generator, *connect, protocol, *window)
+	} else {
+		err = writeTasks(generator, args, protocol, *done)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
+
+// writeTasks writes the requests to the output file, stdout if there is
+// none or it is "-"
+func writeTasks(generator *workload.Generator, args []string, protocol server.Protocol, done bool) error {
+	output := os.Stdout
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	writer := bufio.NewWriter(output)
+	err := encodeTasks(generator, writer, protocol, done)
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// encodeTasks writes every request of the generator, numbered from 1
+func encodeTasks(generator *workload.Generator, w io.Writer, protocol server.Protocol, done bool) error {
+	var frame []byte
+	for id := 1; ; id++ {
+		request, ok := generator.Next()
+		if !ok {
+			break
+		}
+		message, err := request.Message(context.Background())
+		if err != nil {
+			return err
+		}
+		message["id"] = float64(id)
+		if frame, err = protocol.AppendFrame(frame[:0], message); err != nil {
+			return err
+		}
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+	if !done {
+		return nil
+	}
+	frame, err := protocol.AppendFrame(frame[:0], map[string]interface{}{"command": "DONE"})
+	if err == nil {
+		_, err = w.Write(frame)
+	}
+	return err
+}
+
+// stream sends the requests to a server, at most window of them waiting for
+// their response, and prints how they were answered
+func stream(generator *workload.Generator, address string, protocol server.Protocol, window int) error {
+	conn, err := client.Dial(address, protocol)
+	if err != nil {
+		return err
+	}
+	var mutex sync.Mutex
+	outcomes := make(map[string]int) // Responses by error code, "ok" for the executed requests
+	inFlight := semaphore.NewSemaphore(window)
+	start := time.Now()
+	sent := 0
+	for {
+		request, ok := generator.Next()
+		if !ok {
+			break
+		}
+		inFlight.Down()
+		sent++
+		conn.Do(context.Background(), request).Then(func(response server.Response, err error) {
+			outcome := "ok"
+			if responseErr, ok := err.(*server.ResponseError); ok {
+				outcome = responseErr.Code
+			} else if err != nil {
+				outcome = err.Error()
+			}
+			mutex.Lock()
+			outcomes[outcome]++
+			mutex.Unlock()
+			inFlight.Up()
+		})
+	}
+	err = conn.Close()
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(os.Stderr, "%v requests in %v (%.0f/s)\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	names := make([]string, 0, len(outcomes))
+	for name := range outcomes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16v %v\n", name, outcomes[name])
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+// Package workload generates streams of requests that model the traffic of
+// a feed: the share of each command, which posts the reads and removes
+// target, whether new posts are the most recent ones and how long their
+// bodies are. The same configuration and seed always give the same stream.
+package workload
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"proj1/server"
+	"strconv"
+	"strings"
+)
+
+// Distributions of the timestamps targeted by CONTAINS and REMOVE
+const (
+	Uniform = "uniform" // Every post added so far is as likely
+	Zipf    = "zipf"    // The most recent posts are the most likely
+)
+
+// DefaultMix is the share of each command of the default workload
+const DefaultMix = "add=40,contains=50,remove=9,feed=1"
+
+// Config describes a workload
+type Config struct {
+	Requests int     // Number of requests
+	Mix      Mix     // Share of each command
+	Targets  string  // Distribution of the posts targeted by CONTAINS and REMOVE: Uniform (default) or Zipf
+	ZipfS    float64 // Skew of the Zipf distribution, greater than 1 (default 1.1)
+	// Share of the ADDs whose post is inserted at a random time before the
+	// most recent post, the others are appended as the most recent post (0 =
+	// append only, 1 = random insertion)
+	RandomInserts float64
+	Bodies        BodySizes // Length of the body of each post
+	Seed          int64
+}
+
+// Mix is the relative weight of each command
+type Mix struct {
+	Add, Remove, Contains, Feed float64
+}
+
+// ParseMix parses weights given as command=weight,... where the commands
+// are add, remove, contains and feed. The weights need not sum to 1 or 100,
+// the missing commands have no weight.
+func ParseMix(spec string) (Mix, error) {
+	var mix Mix
+	weights := map[string]*float64{"add": &mix.Add, "remove": &mix.Remove, "contains": &mix.Contains, "feed": &mix.Feed}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		weight, ok := weights[strings.ToLower(parts[0])]
+		if len(parts) != 2 || !ok {
+			return mix, fmt.Errorf("invalid mix %q, expected command=weight,... with commands add, remove, contains and feed", spec)
+		}
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || value < 0 || math.IsInf(value, 0) {
+			return mix, fmt.Errorf("invalid weight %q of %v", parts[1], parts[0])
+		}
+		*weight = value
+	}
+	if mix.total() == 0 {
+		return mix, fmt.Errorf("invalid mix %q, every weight is 0", spec)
+	}
+	return mix, nil
+}
+
+func (mix Mix) total() float64 {
+	return mix.Add + mix.Remove + mix.Contains + mix.Feed
+}
+
+// BodySizes is the distribution of the length of the bodies
+type BodySizes struct {
+	Min, Max int     // Uniform between Min and Max, both included
+	Mean     float64 // Exponential with this mean instead if not 0
+}
+
+// ParseBodySizes parses a distribution of body lengths: a length (16), a
+// uniform range (8-64) or an exponential distribution given its mean
+// (exp:32), which has a long tail of large bodies
+func ParseBodySizes(spec string) (BodySizes, error) {
+	invalid := fmt.Errorf("invalid body sizes %q, expected a length, min-max or exp:mean", spec)
+	if strings.HasPrefix(spec, "exp:") {
+		mean, err := strconv.ParseFloat(spec[len("exp:"):], 64)
+		if err != nil || mean <= 0 || math.IsInf(mean, 0) {
+			return BodySizes{}, invalid
+		}
+		return BodySizes{Mean: mean}, nil
+	}
+	bounds := strings.SplitN(spec, "-", 2)
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil || min < 0 {
+		return BodySizes{}, invalid
+	}
+	max := min
+	if len(bounds) == 2 {
+		if max, err = strconv.Atoi(bounds[1]); err != nil || max < min {
+			return BodySizes{}, invalid
+		}
+	}
+	return BodySizes{Min: min, Max: max}, nil
+}
+
+// Generator produces the requests of a workload one at a time
+type Generator struct {
+	config    Config
+	random    *rand.Rand
+	generated int
+	added     []float64  // Timestamp of every post added, in the order of the ADDs
+	newest    float64    // Most recent timestamp added
+	zipf      *rand.Zipf // Ranks of the Zipf targets among zipfCount posts
+	zipfCount int
+}
+
+// NewGenerator checks a configuration and returns the generator of its
+// requests
+func NewGenerator(config Config) (*Generator, error) {
+	if config.Requests < 0 {
+		return nil, fmt.Errorf("invalid number of requests %v", config.Requests)
+	}
+	if config.Mix.total() == 0 {
+		config.Mix, _ = ParseMix(DefaultMix)
+	}
+	switch config.Targets {
+	case "":
+		config.Targets = Uniform
+	case Uniform, Zipf:
+	default:
+		return nil, fmt.Errorf("unknown distribution %q (available: uniform, zipf)", config.Targets)
+	}
+	if config.ZipfS == 0 {
+		config.ZipfS = 1.1
+	}
+	if config.ZipfS <= 1 {
+		return nil, fmt.Errorf("invalid Zipf skew %v, it must be greater than 1", config.ZipfS)
+	}
+	if config.RandomInserts < 0 || config.RandomInserts > 1 {
+		return nil, fmt.Errorf("invalid share of random inserts %v, it must be between 0 and 1", config.RandomInserts)
+	}
+	return &Generator{config: config, random: rand.New(rand.NewSource(config.Seed)), newest: -1}, nil
+}
+
+// Next returns the next request, false once every request was generated
+func (generator *Generator) Next() (server.Request, bool) {
+	if generator.generated >= generator.config.Requests {
+		return server.Request{}, false
+	}
+	generator.generated++
+	mix := generator.config.Mix
+	draw := generator.random.Float64() * mix.total()
+	switch {
+	case draw < mix.Add:
+		return server.Request{Command: "ADD", Body: generator.body(), Timestamp: generator.insert()}, true
+	case draw < mix.Add+mix.Remove:
+		return server.Request{Command: "REMOVE", Timestamp: generator.target()}, true
+	case draw < mix.Add+mix.Remove+mix.Contains:
+		return server.Request{Command: "CONTAINS", Timestamp: generator.target()}, true
+	}
+	return server.Request{Command: "FEED"}, true
+}
+
+// insert returns the timestamp of a new post
+func (generator *Generator) insert() float64 {
+	timestamp := generator.newest + 1
+	if generator.newest > 0 && generator.random.Float64() < generator.config.RandomInserts {
+		// Between the oldest possible and the most recent post, practically
+		// never the timestamp of another post
+		timestamp = generator.random.Float64() * generator.newest
+	}
+	generator.added = append(generator.added, timestamp)
+	if timestamp > generator.newest {
+		generator.newest = timestamp
+	}
+	return timestamp
+}
+
+// target returns the timestamp of a post added before, possibly removed
+// since. Zipf ranks the posts by the order they were added in, the last one
+// first.
+func (generator *Generator) target() float64 {
+	count := len(generator.added)
+	if count == 0 {
+		// Nothing to find yet
+		return 0
+	}
+	var rank int
+	if generator.config.Targets == Zipf {
+		// The distribution only changes with the number of posts
+		if generator.zipf == nil || generator.zipfCount != count {
+			generator.zipf = rand.NewZipf(generator.random, generator.config.ZipfS, 1, uint64(count-1))
+			generator.zipfCount = count
+		}
+		rank = int(generator.zipf.Uint64())
+	} else {
+		rank = generator.random.Intn(count)
+	}
+	return generator.added[count-1-rank]
+}
+
+// body returns a body of random lowercase letters
+func (generator *Generator) body() string {
+	sizes := generator.config.Bodies
+	length := sizes.Min
+	if sizes.Mean > 0 {
+		length = int(generator.random.ExpFloat64() * sizes.Mean)
+	} else if sizes.Max > sizes.Min {
+		length += generator.random.Intn(sizes.Max - sizes.Min + 1)
+	}
+	body := make([]byte, length)
+	for i := range body {
+		body[i] = byte('a' + generator.random.Intn(26))
+	}
+	return string(body)
+}
@@ -0,0 +1,194 @@
+package workload
+
+import (
+	"proj1/server"
+	"reflect"
+	"testing"
+)
+
+// generate returns every request of a configuration
+func generate(t *testing.T, config Config) []server.Request {
+	generator, err := NewGenerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []server.Request
+	for {
+		request, ok := generator.Next()
+		if !ok {
+			return requests
+		}
+		requests = append(requests, request)
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	var tests = []struct {
+		spec     string
+		expected Mix
+	}{
+		{"add=40,contains=50,remove=9,feed=1", Mix{Add: 40, Contains: 50, Remove: 9, Feed: 1}},
+		{"ADD=1, feed=0.5", Mix{Add: 1, Feed: 0.5}},
+	}
+	for _, test := range tests {
+		if mix, err := ParseMix(test.spec); err != nil || mix != test.expected {
+			t.Errorf("Expected %+v for %q, got %+v (%v)", test.expected, test.spec, mix, err)
+		}
+	}
+	for _, spec := range []string{"", "add", "like=1", "add=-1", "add=x", "add=0,feed=0"} {
+		if _, err := ParseMix(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestParseBodySizes(t *testing.T) {
+	var tests = []struct {
+		spec     string
+		expected BodySizes
+	}{
+		{"16", BodySizes{Min: 16, Max: 16}},
+		{"0", BodySizes{}},
+		{"8-64", BodySizes{Min: 8, Max: 64}},
+		{"exp:32", BodySizes{Mean: 32}},
+	}
+	for _, test := range tests {
+		if sizes, err := ParseBodySizes(test.spec); err != nil || sizes != test.expected {
+			t.Errorf("Expected %+v for %q, got %+v (%v)", test.expected, test.spec, sizes, err)
+		}
+	}
+	for _, spec := range []string{"", "-1", "64-8", "8-", "exp:", "exp:0", "x"} {
+		if _, err := ParseBodySizes(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestGeneratorConfig(t *testing.T) {
+	for _, config := range []Config{{Requests: -1}, {Targets: "normal"}, {ZipfS: 1}, {RandomInserts: 1.5}} {
+		if _, err := NewGenerator(config); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
+
+func TestGeneratorSeed(t *testing.T) {
+	config := Config{Requests: 1000, Targets: Zipf, RandomInserts: 0.5, Bodies: BodySizes{Min: 1, Max: 10}, Seed: 7}
+	first, second := generate(t, config), generate(t, config)
+	if len(first) != 1000 || !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same 1000 requests for the same seed")
+	}
+	config.Seed = 8
+	if reflect.DeepEqual(first, generate(t, config)) {
+		t.Errorf("Expected other requests for another seed")
+	}
+}
+
+func TestGeneratorMix(t *testing.T) {
+	requests := generate(t, Config{Requests: 10000, Mix: Mix{Add: 6, Contains: 3, Remove: 1}})
+	counts := make(map[string]int)
+	for _, request := range requests {
+		counts[request.Command]++
+	}
+	var tests = []struct {
+		command  string
+		expected int
+	}{
+		{"ADD", 6000},
+		{"CONTAINS", 3000},
+		{"REMOVE", 1000},
+		{"FEED", 0},
+	}
+	for _, test := range tests {
+		if difference := counts[test.command] - test.expected; difference < -300 || difference > 300 {
+			t.Errorf("Expected about %v %v requests, got %v", test.expected, test.command, counts[test.command])
+		}
+	}
+}
+
+func TestGeneratorTimestamps(t *testing.T) {
+	// Appended posts are the most recent, the reads target posts added before
+	added := make(map[float64]bool)
+	newest := -1.0
+	for _, request := range generate(t, Config{Requests: 2000, Mix: Mix{Add: 1, Contains: 1}}) {
+		switch request.Command {
+		case "ADD":
+			if request.Timestamp <= newest {
+				t.Fatalf("Expected an appended post after %v, got %v", newest, request.Timestamp)
+			}
+			newest = request.Timestamp
+			added[request.Timestamp] = true
+		case "CONTAINS":
+			if len(added) > 0 && !added[request.Timestamp] {
+				t.Fatalf("Expected a post added before, got %v", request.Timestamp)
+			}
+		}
+	}
+
+	// Random inserts land before the most recent post
+	inserted := 0
+	newest = -1
+	for _, request := range generate(t, Config{Requests: 2000, Mix: Mix{Add: 1}, RandomInserts: 0.5}) {
+		if request.Timestamp < newest {
+			inserted++
+		} else {
+			newest = request.Timestamp
+		}
+	}
+	if inserted < 800 || inserted > 1200 {
+		t.Errorf("Expected about 1000 random inserts, got %v", inserted)
+	}
+
+	// Zipf targets the most recent posts far more than uniform
+	for _, test := range []struct {
+		targets string
+		min     int
+		max     int
+	}{{Uniform, 0, 50}, {Zipf, 150, 500}} {
+		requests := generate(t, Config{Requests: 2000, Mix: Mix{Add: 1, Contains: 1}, Targets: test.targets})
+		recent := 0
+		for i, request := range requests {
+			// The most recent post or one of the 10 before it
+			if request.Command == "CONTAINS" && i > 1000 && request.Timestamp >= newestBefore(requests[:i])-10 {
+				recent++
+			}
+		}
+		if recent < test.min || recent > test.max {
+			t.Errorf("%v: expected %v to %v reads of the 11 most recent posts, got %v", test.targets, test.min, test.max, recent)
+		}
+	}
+}
+
+// newestBefore returns the most recent post added by the requests
+func newestBefore(requests []server.Request) float64 {
+	for i := len(requests) - 1; i >= 0; i-- {
+		if requests[i].Command == "ADD" {
+			return requests[i].Timestamp
+		}
+	}
+	return 0
+}
+
+func TestGeneratorBodies(t *testing.T) {
+	var tests = []struct {
+		sizes    BodySizes
+		min, max int
+	}{
+		{BodySizes{Min: 5, Max: 5}, 5, 5},
+		{BodySizes{Min: 2, Max: 8}, 2, 8},
+		{BodySizes{Mean: 4}, 0, 1000},
+	}
+	for _, test := range tests {
+		total := 0
+		requests := generate(t, Config{Requests: 1000, Mix: Mix{Add: 1}, Bodies: test.sizes})
+		for _, request := range requests {
+			if len(request.Body) < test.min || len(request.Body) > test.max {
+				t.Fatalf("Expected bodies of %v to %v characters, got %q", test.min, test.max, request.Body)
+			}
+			total += len(request.Body)
+		}
+		if test.sizes.Mean > 0 && (total < 3000 || total > 5000) {
+			t.Errorf("Expected a mean length of about 4, got %v", float64(total)/1000)
+		}
+	}
+}